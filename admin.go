@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+)
+
+// adminMux serves fakettp's own endpoints, apart from the traffic it fakes and proxies
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/har", harHandler)
+	mux.HandleFunc("/violations", violationsHandler)
+	mux.HandleFunc("/sessions", sessionsHandler)
+	mux.HandleFunc("/sessions/", sessionsHandler)
+	mux.HandleFunc(healthPath, healthHandler)
+	return mux
+}
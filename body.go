@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// defaultBodyInspectLimit is how much of a request body is read for matching by default
+const defaultBodyInspectLimit = 1 << 20
+
+// bodyInspectLimit returns how much of a request body fakes, fallbacks and contract
+// validation look at
+func (c *Config) bodyInspectLimit() int {
+	if c.BodyInspectLimit > 0 {
+		return c.BodyInspectLimit
+	}
+	return defaultBodyInspectLimit
+}
+
+// peekBody reads up to limit bytes of the request body, for matching, and puts them back in
+// front of the rest of the body. Only the bytes read are buffered, so a body over the limit
+// still streams through to the upstream. It reports if the body is longer than limit.
+func peekBody(r *http.Request, limit int) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	r.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(data), r.Body), Closer: r.Body}
+	if len(data) > limit {
+		return data[:limit], true, err
+	}
+	return data, false, err
+}
+
+// peekedBody is a request body with its first bytes read back in
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// limitRequestBody answers 413 for requests whose Content-Length is over max_request_body,
+// reporting if it did. Bodies of unknown length are cut off once they go over it, which
+// fails reading them with an *http.MaxBytesError, see bodyTooLarge.
+func limitRequestBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	if r.ContentLength > limit {
+		writeBodyTooLarge(w, r, limit)
+		return true
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return false
+}
+
+// bodyTooLarge reports if err comes from reading a body over max_request_body
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	rl := reqLog(r)
+	rl.decide("invalid", "")
+	rl.Warn("request body too large", "content_length", r.ContentLength, "max_request_body", limit)
+	http.Error(w, "fakettp: request body too large", http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeekBody(t *testing.T) {
+	t.Log(">> verify peeked bytes are put back in front of the body")
+	{
+		r := httptest.NewRequest("POST", "/", strings.NewReader("0123456789"))
+		data, truncated, err := peekBody(r, 4)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := fmt.Sprintf("%s %v", data, truncated), "0123 true"; got != want {
+			t.Errorf("got peek %s, want %s", got, want)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := string(body), "0123456789"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify bodies within the limit are not truncated")
+	{
+		r := httptest.NewRequest("POST", "/", strings.NewReader("0123"))
+		data, truncated, _ := peekBody(r, 4)
+		if got, want := fmt.Sprintf("%s %v", data, truncated), "0123 false"; got != want {
+			t.Errorf("got peek %s, want %s", got, want)
+		}
+	}
+}
+
+// postBody posts body to the fake server, chunked when contentLength is not set
+func postBody(t *testing.T, path, id, body string, contentLength bool) (*http.Response, string) {
+	var reader io.Reader = strings.NewReader(body)
+	if !contentLength {
+		// hide the length so the request is chunked
+		reader = io.MultiReader(reader)
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path), reader)
+	if err != nil {
+		t.Fatalf("unable to set up request - %v", err)
+	}
+	req.Header.Set("X-Request-Id", id)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error performing HTTP request - %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.BodyInspectLimit = 16
+		c.MaxRequestBody = 64
+		c.Fakes = append(c.Fakes,
+			&Fake{HyjackPath: "/upload", RequestBodySubStr: "early", ResponseCode: http.StatusOK, ResponseBody: "matched"},
+			&Fake{HyjackPath: "/upload", RequestBodySubStr: "late", ResponseCode: http.StatusOK, ResponseBody: "matched late"},
+		)
+	})
+
+	t.Log(">> verify fakes only match on the first body_inspect_limit bytes")
+	{
+		_, body := postBody(t, "/upload", "body-early", "early"+strings.Repeat(".", 30), true)
+		if got, want := body, "matched"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+		_, body = postBody(t, "/upload", "body-late", strings.Repeat(".", 30)+"late", true)
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("got body %q for a match past the limit, want %q", got, want)
+		}
+		if got, want := harEntryFor(t, "body-late").Request.PostData.Text, strings.Repeat(".", 30)+"late"; got != want {
+			t.Errorf("got request body %q upstream, want the whole body %q", got, want)
+		}
+	}
+
+	t.Log(">> verify bodies over max_request_body are answered 413")
+	{
+		for _, contentLength := range []bool{true, false} {
+			for _, path := range []string{"/upload", "/proxied-upload"} {
+				id := fmt.Sprintf("too-large-%s-%v", path[1:], contentLength)
+				resp, _ := postBody(t, path, id, strings.Repeat("x", 100), contentLength)
+				if got, want := resp.StatusCode, http.StatusRequestEntityTooLarge; got != want {
+					t.Errorf("got status %d for %s with content length %v, want %d", got, path, contentLength, want)
+				}
+				if got, want := harEntryFor(t, id).Decision, "invalid"; got != want {
+					t.Errorf("got decision %s, want %s", got, want)
+				}
+			}
+		}
+		resp, body := postBody(t, "/proxied-upload", "within-limit", strings.Repeat("x", 64), false)
+		if got, want := fmt.Sprintf("%d %s", resp.StatusCode, body), "200 proxied"; got != want {
+			t.Errorf("got %s for a body within the limit, want %s", got, want)
+		}
+	}
+}
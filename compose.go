@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configExtensions are the files read from config directories
+var configExtensions = map[string]bool{".json": true, ".conf": true, ".yaml": true, ".yml": true, ".toml": true}
+
+// loadConfig reads the config files and directories in order and merges them, then applies
+// the overlays, returning the combined config as JSON. Later files override the settings of
+// earlier ones, and their fakes are added after the earlier fakes. Each file's include list
+// is merged before the file itself.
+func loadConfig(paths []string, overlays []string, format string) ([]byte, error) {
+	merged := map[string]interface{}{}
+	for _, path := range paths {
+		if err := addConfigPath(merged, path, format, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range overlays {
+		overlay := map[string]interface{}{}
+		if err := addConfigPath(overlay, path, format, nil); err != nil {
+			return nil, err
+		}
+		if err := applyOverlay(merged, overlay); err != nil {
+			return nil, fmt.Errorf("overlay %s - %v", path, err)
+		}
+	}
+
+	// disabled fakes are dropped entirely, so they cannot match nor show up in the logs
+	dropDisabled(merged)
+	for _, l := range configListeners(merged) {
+		dropDisabled(l)
+	}
+	return json.Marshal(merged)
+}
+
+// dropDisabled removes the disabled fakes of a config or listener
+func dropDisabled(config map[string]interface{}) {
+	if _, ok := config["fakes"]; !ok {
+		return
+	}
+	// an empty list rather than nil, so disabling every fake leaves none
+	fakes := []interface{}{}
+	for _, fake := range configFakes(config) {
+		if m, ok := fake.(map[string]interface{}); ok && m["disabled"] == true {
+			continue
+		}
+		fakes = append(fakes, fake)
+	}
+	config["fakes"] = fakes
+}
+
+// addConfigPath merges a config file, or each config file of a directory in name order
+func addConfigPath(merged map[string]interface{}, path, format string, stack []string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return addConfigFile(merged, path, format, stack)
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !configExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+			continue
+		}
+		if err := addConfigFile(merged, filepath.Join(path, entry.Name()), format, stack); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addConfigFile merges a config file after its includes. stack holds the files including
+// it, to catch include cycles.
+func addConfigFile(merged map[string]interface{}, path, format string, stack []string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for i, including := range stack {
+		if including == abs {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), abs)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fileFormat, err := configFormat(path, format)
+	if err != nil {
+		return err
+	}
+	data, err = normalizeConfig(data, fileFormat, filepath.Dir(path), os.LookupEnv)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	includes, err := configIncludes(doc["include"])
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	delete(doc, "include")
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("%s: include %s - %v", path, include, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("%s: include %s matches no files", path, include)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if err := addConfigPath(merged, match, format, append(stack, abs)); err != nil {
+				return err
+			}
+		}
+	}
+
+	mergeConfig(merged, doc)
+	return nil
+}
+
+// configIncludes reads the include directive, a path or a list of paths
+func configIncludes(v interface{}) ([]string, error) {
+	switch include := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{include}, nil
+	case []interface{}:
+		paths := make([]string, 0, len(include))
+		for _, p := range include {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("include: want a path, got %v", p)
+			}
+			paths = append(paths, s)
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("include: want a path or a list of paths, got %v", v)
+}
+
+// mergeConfig adds src to dst: fakes are appended, listeners are merged with the listener
+// of the same name (or appended), other settings are replaced
+func mergeConfig(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch key {
+		case "fakes":
+			dst["fakes"] = append(configFakes(dst), configFakes(src)...)
+		case "listeners":
+			items, ok := value.([]interface{})
+			if !ok {
+				// left for the config parsing to report
+				dst[key] = value
+				continue
+			}
+			list, _ := dst["listeners"].([]interface{})
+			for _, item := range items {
+				l, ok := item.(map[string]interface{})
+				if existing := findListener(dst, l["name"]); ok && existing != nil {
+					mergeConfig(existing, l)
+					continue
+				}
+				list = append(list, item)
+			}
+			dst["listeners"] = list
+		default:
+			dst[key] = value
+		}
+	}
+}
+
+func configFakes(config map[string]interface{}) []interface{} {
+	fakes, _ := config["fakes"].([]interface{})
+	return fakes
+}
+
+// configListeners returns the listeners of a config that are objects
+func configListeners(config map[string]interface{}) []map[string]interface{} {
+	items, _ := config["listeners"].([]interface{})
+	var listeners []map[string]interface{}
+	for _, item := range items {
+		if l, ok := item.(map[string]interface{}); ok {
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners
+}
+
+// findListener returns the config's listener with the name, nil when there is none
+func findListener(config map[string]interface{}, name interface{}) map[string]interface{} {
+	if name == nil {
+		return nil
+	}
+	for _, l := range configListeners(config) {
+		if l["name"] == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// applyOverlay replaces settings with the overlay's, and patches the fakes named by the
+// overlay's fakes with their fields, whichever listener they are in. An overlay fake with
+// "disabled": true turns the named fake off. The overlay's listeners replace the settings
+// of the listeners they name.
+func applyOverlay(merged, overlay map[string]interface{}) error {
+	for key, value := range overlay {
+		if key != "fakes" && key != "listeners" {
+			merged[key] = value
+		}
+	}
+
+	for i, patch := range configListeners(overlay) {
+		l := findListener(merged, patch["name"])
+		if l == nil {
+			return fmt.Errorf("listeners[%d]: no listener is named %v", i, patch["name"])
+		}
+		if _, ok := patch["fakes"]; ok {
+			return fmt.Errorf("listeners[%d]: overlay listeners cannot have fakes, patch them by name in the overlay's fakes", i)
+		}
+		for key, value := range patch {
+			l[key] = value
+		}
+	}
+
+	all := configFakes(merged)
+	for _, l := range configListeners(merged) {
+		all = append(all, configFakes(l)...)
+	}
+
+	for i, item := range configFakes(overlay) {
+		patch, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("fakes[%d]: want a fake, got %v", i, item)
+		}
+		name, _ := patch["name"].(string)
+		if name == "" {
+			return fmt.Errorf("fakes[%d]: overlay fakes need the name of the fake they patch", i)
+		}
+
+		found := false
+		for _, fake := range all {
+			if m, ok := fake.(map[string]interface{}); ok && m["name"] == name {
+				for key, value := range patch {
+					m[key] = value
+				}
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("fakes[%d]: no fake is named %q", i, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfigFiles writes the files under a new temp dir and returns the dir
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("unable to write %s - %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestConfigComposition(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"base.yaml":             "include: services\nproxy_host: apid.docker\nport: 5000\nfakes:\n  - name: health\n    hyjack: /health\n",
+		"services/billing.toml": "[[fakes]]\nname = \"invoices\"\nhyjack = \"/invoices\"\ncode = 200\n",
+		"services/users.json":   `{"include": "../shared/*.yaml", "fakes": [{"name": "users", "hyjack": "/users", "code": 200}]}`,
+		"services/notes.txt":    "not a config",
+		"shared/auth.yaml":      "fakes:\n  - name: auth\n    hyjack: /auth\n",
+		"single.yaml":           "fakes:\n  - name: health\n    hyjack: /health\n",
+		"prod.yaml":             "port: 80\nfakes:\n  - name: version\n    hyjack: /version\n",
+		"overlays/outage.yaml":  "proxy_delay: 1s\nfakes:\n  - name: users\n    code: 503\n    body: down\n  - name: health\n    disabled: true\n",
+		"overlays/unknown.yaml": "fakes:\n  - name: nope\n    code: 503\n",
+		"overlays/health.yaml":  "fakes:\n  - name: health\n    disabled: true\n",
+		"overlays/unnamed.yaml": "fakes:\n  - code: 503\n",
+		"cycle/a.yaml":          "include: b.yaml\n",
+		"cycle/b.yaml":          "include: a.yaml\n",
+		"missing/include.yaml":  "include: nothing/*.yaml\n",
+	})
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	load := func(paths []string, overlays []string) *Config {
+		data, err := loadConfig(paths, overlays, "")
+		if err != nil {
+			t.Fatalf("got error loading config - %v", err)
+		}
+		config := &Config{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("unable to parse merged config - %v", err)
+		}
+		return config
+	}
+	names := func(config *Config) string {
+		var names []string
+		for _, fake := range config.Fakes {
+			names = append(names, fake.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	t.Log(">> verify includes and directories merge in order, with later files overriding settings")
+	{
+		config := load([]string{path("base.yaml"), path("prod.yaml")}, nil)
+		if got, want := names(config), "invoices,auth,users,health,version"; got != want {
+			t.Errorf("got fakes %s, want %s", got, want)
+		}
+		if got, want := config.Port, 80; got != want {
+			t.Errorf("got port %d, want %d", got, want)
+		}
+		if got, want := config.ProxyHost, "apid.docker"; got != want {
+			t.Errorf("got proxy host %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify overlays patch and disable fakes by name")
+	{
+		config := load([]string{path("base.yaml")}, []string{path("overlays/outage.yaml")})
+		if got, want := names(config), "invoices,auth,users"; got != want {
+			t.Errorf("got fakes %s, want %s", got, want)
+		}
+		users := config.Fakes[2]
+		if got, want := users.ResponseCode, 503; got != want || users.ResponseBody != "down" || users.HyjackPath != "/users" {
+			t.Errorf("got patched fake %s, want code %d with body down on /users", users, want)
+		}
+		if got, want := config.ProxyDelayRaw, "1s"; got != want {
+			t.Errorf("got proxy delay %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify an overlay can disable the only fake")
+	{
+		config := load([]string{path("single.yaml")}, []string{path("overlays/health.yaml")})
+		if got := len(config.Fakes); got != 0 {
+			t.Errorf("got fakes %s, want none", names(config))
+		}
+	}
+
+	t.Log(">> verify composition errors")
+	{
+		cases := []struct {
+			paths, overlays []string
+			want            string
+		}{
+			{[]string{path("base.yaml")}, []string{path("overlays/unknown.yaml")}, `fakes[0]: no fake is named "nope"`},
+			{[]string{path("base.yaml")}, []string{path("overlays/unnamed.yaml")}, "overlay fakes need the name"},
+			{[]string{path("cycle/a.yaml")}, nil, "include cycle"},
+			{[]string{path("missing/include.yaml")}, nil, "matches no files"},
+			{[]string{path("nope.yaml")}, nil, "no such file"},
+		}
+		for _, c := range cases {
+			_, err := loadConfig(c.paths, c.overlays, "")
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got error %v, want it to contain %s", err, c.want)
+			}
+		}
+	}
+}
+
+func TestListenerComposition(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"billing.yaml":         "listeners:\n  - name: billing\n    port: 5001\n    proxy_host: http://billing\n    fakes:\n      - name: invoices\n        hyjack: /invoices\n",
+		"billing-more.yaml":    "listeners:\n  - name: billing\n    port: 5011\n    fakes:\n      - name: refunds\n        hyjack: /refunds\n",
+		"users.json":           `{"listeners": [{"name": "users", "port": 5002, "fakes": [{"name": "users", "hyjack": "/users"}]}]}`,
+		"overlays/outage.yaml": "listeners:\n  - name: users\n    proxy_host: http://users-staging\nfakes:\n  - name: refunds\n    disabled: true\n  - name: users\n    code: 503\n",
+		"overlays/fakes.yaml":  "listeners:\n  - name: users\n    fakes: []\n",
+		"overlays/nope.yaml":   "listeners:\n  - name: nope\n    port: 1\n",
+	})
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	paths := []string{path("billing.yaml"), path("billing-more.yaml"), path("users.json")}
+
+	load := func(overlays []string) *Config {
+		data, err := loadConfig(paths, overlays, "")
+		if err != nil {
+			t.Fatalf("got error loading config - %v", err)
+		}
+		config := &Config{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("unable to parse merged config - %v", err)
+		}
+		return config
+	}
+	describe := func(config *Config) string {
+		var listeners []string
+		for _, l := range config.Listeners {
+			var fakes []string
+			for _, fake := range l.Fakes {
+				fakes = append(fakes, fmt.Sprintf("%s:%d", fake.Name, fake.ResponseCode))
+			}
+			listeners = append(listeners, fmt.Sprintf("%s %d %s [%s]", l.Name, l.Port, l.ProxyHost, strings.Join(fakes, ",")))
+		}
+		return strings.Join(listeners, "; ")
+	}
+
+	t.Log(">> verify listeners of the same name merge, with their fakes appended")
+	{
+		if got, want := describe(load(nil)), "billing 5011 http://billing [invoices:0,refunds:0]; users 5002  [users:0]"; got != want {
+			t.Errorf("got listeners %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify overlays patch listeners, and fakes in listeners by name")
+	{
+		if got, want := describe(load([]string{path("overlays/outage.yaml")})), "billing 5011 http://billing [invoices:0]; users 5002 http://users-staging [users:503]"; got != want {
+			t.Errorf("got listeners %s, want %s", got, want)
+		}
+		for overlay, want := range map[string]string{"overlays/fakes.yaml": "cannot have fakes", "overlays/nope.yaml": "no listener is named nope"} {
+			if _, err := loadConfig(paths, []string{path(overlay)}, ""); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v for %s, want it to contain %s", err, overlay, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// configFormat picks the config format from the explicit format if set, otherwise from the
+// file extension, defaulting to json
+func configFormat(path, explicit string) (string, error) {
+	format := strings.ToLower(explicit)
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	switch format {
+	case "", "json", "conf":
+		return "json", nil
+	case "yaml", "yml":
+		return "yaml", nil
+	case "toml":
+		return "toml", nil
+	}
+	if explicit != "" {
+		return "", fmt.Errorf("unknown config format %q (want json, yaml or toml)", explicit)
+	}
+	return "json", nil
+}
+
+// normalizeConfig converts a config in the given format to JSON, checking it maps onto
+// Config so errors can point at the line and column of the original file. When lookup is
+// set, values are interpolated with it before the check, reading relative ${file:path}
+// from dir.
+func normalizeConfig(data []byte, format, dir string, lookup func(string) (string, bool)) ([]byte, error) {
+	var value interface{}
+	positions := make(map[string]string)
+
+	switch format {
+	case "yaml":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if value, err = yamlValue(&doc, "", positions); err != nil {
+			return nil, err
+		}
+	case "toml":
+		m := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			var perr toml.ParseError
+			if errors.As(err, &perr) {
+				return nil, fmt.Errorf("line %d, column %d: %s", perr.Position.Line, perr.Position.Col, perr.Message)
+			}
+			return nil, err
+		}
+		value = m
+	default:
+		position := func(field string, offset int64) string {
+			return offsetPosition(data, jsonValueStart(data, offset))
+		}
+		if lookup == nil || !bytes.Contains(data, []byte("${")) {
+			if err := checkConfigJSON(data, position); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, checkConfigJSON(data, position)
+		}
+	}
+
+	if m, ok := value.(map[string]interface{}); ok && lookup != nil {
+		if err := interpolateConfig(m, dir, lookup); err != nil {
+			return nil, err
+		}
+	}
+
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = checkConfigJSON(converted, func(field string, offset int64) string {
+		if pos, ok := positions[field]; ok {
+			return pos
+		}
+		if format == "toml" {
+			return tomlKeyPosition(data, field)
+		}
+		return ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
+
+// checkConfigJSON decodes the JSON into a Config, using position to say where in the
+// original file a field or offset was
+func checkConfigJSON(data []byte, position func(field string, offset int64) string) error {
+	err := json.Unmarshal(data, &Config{})
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		// the offset is just past the unexpected character
+		return fmt.Errorf("%s: %v", position("", syntaxErr.Offset-1), err)
+	case errors.As(err, &typeErr):
+		msg := fmt.Sprintf("%s: want %s, got %s", configFieldName(typeErr.Field), typeErr.Type, typeErr.Value)
+		if pos := position(typeErr.Field, typeErr.Offset); pos != "" {
+			return fmt.Errorf("%s: %s", pos, msg)
+		}
+		return errors.New(msg)
+	}
+	return err
+}
+
+// configFieldName turns a decoding path such as fakes.1.code into fakes[1].code
+func configFieldName(field string) string {
+	parts := strings.Split(field, ".")
+	name := ""
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil {
+			name += "[" + part + "]"
+		} else if name == "" {
+			name = part
+		} else {
+			name += "." + part
+		}
+	}
+	return name
+}
+
+// jsonValueStart walks back from the end of a string or scalar JSON value to its start, as
+// type errors are reported just past the value
+func jsonValueStart(data []byte, end int64) int64 {
+	if end <= 0 || end > int64(len(data)) {
+		return end
+	}
+	i := end - 1
+	if data[i] == '"' {
+		for i--; i >= 0; i-- {
+			if data[i] == '"' && (i == 0 || data[i-1] != '\\') {
+				return i
+			}
+		}
+		return end
+	}
+	for i >= 0 && !bytes.ContainsRune([]byte(" \t\r\n:,[{"), rune(data[i])) {
+		i--
+	}
+	return i + 1
+}
+
+// offsetPosition converts a byte offset into a line and column
+func offsetPosition(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+// yamlValue converts a YAML node to plain values, recording the position of each field by
+// its decoding path
+func yamlValue(node *yaml.Node, path string, positions map[string]string) (interface{}, error) {
+	positions[path] = fmt.Sprintf("line %d, column %d", node.Line, node.Column)
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return nil, nil
+		}
+		return yamlValue(node.Content[0], path, positions)
+	case yaml.AliasNode:
+		return yamlValue(node.Alias, path, positions)
+	case yaml.MappingNode:
+		m := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d, column %d: keys must be strings", key.Line, key.Column)
+			}
+			v, err := yamlValue(value, join(key.Value), positions)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = v
+		}
+		return m, nil
+	case yaml.SequenceNode:
+		s := make([]interface{}, 0, len(node.Content))
+		for i, item := range node.Content {
+			v, err := yamlValue(item, join(strconv.Itoa(i)), positions)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+		}
+		return s, nil
+	}
+
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return nil, fmt.Errorf("line %d, column %d: %v", node.Line, node.Column, err)
+	}
+	return v, nil
+}
+
+// tomlKeyPosition finds the line of a field such as fakes.1.code in a TOML file, following
+// [table] and [[array]] headers. Inline tables and arrays are not followed.
+func tomlKeyPosition(data []byte, field string) string {
+	parts := strings.Split(field, ".")
+	if len(parts) == 0 {
+		return ""
+	}
+	key := parts[len(parts)-1]
+	want := strings.Join(parts[:len(parts)-1], ".")
+
+	table := ""
+	counts := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "[["):
+			name := strings.TrimSpace(strings.Trim(trimmed, "[]"))
+			table = name + "." + strconv.Itoa(counts[name])
+			counts[name]++
+		case strings.HasPrefix(trimmed, "["):
+			table = strings.TrimSpace(strings.Trim(trimmed, "[]"))
+		default:
+			eq := strings.Index(trimmed, "=")
+			if eq < 0 || table != want {
+				continue
+			}
+			if strings.Trim(strings.TrimSpace(trimmed[:eq]), `"'`) == key {
+				return fmt.Sprintf("line %d, column %d", i+1, strings.Index(line, trimmed)+1)
+			}
+		}
+	}
+	return ""
+}
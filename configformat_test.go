@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFormats(t *testing.T) {
+	parse := func(path string) *Config {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unable to read %s - %v", path, err)
+		}
+		format, err := configFormat(path, "")
+		if err != nil {
+			t.Fatalf("got error picking format for %s - %v", path, err)
+		}
+		normalized, err := normalizeConfig(data, format, "", nil)
+		if err != nil {
+			t.Fatalf("got error normalizing %s - %v", path, err)
+		}
+		config := &Config{}
+		if err := json.Unmarshal(normalized, config); err != nil {
+			t.Fatalf("unable to parse normalized %s - %v", path, err)
+		}
+		return config
+	}
+
+	t.Log(">> verify yaml and toml configs map onto the same config as json")
+	{
+		want := parse("example.conf")
+		for _, path := range []string{"example.yaml", "example.toml"} {
+			got := parse(path)
+			if got.ProxyHost != want.ProxyHost || got.ProxyPort != want.ProxyPort || got.ProxyDelayRaw != want.ProxyDelayRaw || got.Port != want.Port {
+				t.Errorf("%s: got proxy %s:%d delay %s port %d, want %s:%d delay %s port %d", path, got.ProxyHost, got.ProxyPort, got.ProxyDelayRaw, got.Port, want.ProxyHost, want.ProxyPort, want.ProxyDelayRaw, want.Port)
+			}
+			if got, want := len(got.Fakes), len(want.Fakes); got != want {
+				t.Fatalf("%s: got %d fakes, want %d", path, got, want)
+			}
+			for i := range want.Fakes {
+				if !reflect.DeepEqual(got.Fakes[i], want.Fakes[i]) {
+					t.Errorf("%s: got fake %d %s, want %s", path, i, got.Fakes[i], want.Fakes[i])
+				}
+			}
+		}
+	}
+
+	t.Log(">> verify the format is picked by flag, then extension")
+	{
+		cases := []struct{ path, explicit, want string }{
+			{"fakes.yml", "", "yaml"},
+			{"fakes.TOML", "", "toml"},
+			{"fakes.conf", "", "json"},
+			{"fakes.conf", "yaml", "yaml"},
+			{"fakes", "", "json"},
+		}
+		for _, c := range cases {
+			if got, _ := configFormat(c.path, c.explicit); got != c.want {
+				t.Errorf("%s with %q: got format %s, want %s", c.path, c.explicit, got, c.want)
+			}
+		}
+		if _, err := configFormat("fakes.conf", "ini"); err == nil {
+			t.Error("got no error for an unknown format")
+		}
+	}
+}
+
+func TestConfigFormatErrors(t *testing.T) {
+	cases := []struct {
+		format, config, want string
+	}{
+		{"json", "{\n  \"port\": 80,\n  \"fakes\": [{\"code\": \"teapot\"}]\n}", "line 3, column 22: fakes[0].code: want int, got string"},
+		{"json", "{\n  \"port\": 80,\n}", "line 3, column 1: invalid character '}' looking for beginning of object key string"},
+		{"yaml", "port: 80\nfakes:\n  - hyjack: /a\n  - hyjack: /b\n    code: teapot\n", "line 5, column 11: fakes[1].code: want int, got string"},
+		{"yaml", "port: 80\n  fakes: []\n", "yaml: line 2: mapping values are not allowed in this context"},
+		{"toml", "port = 80\n\n[[fakes]]\nhyjack = \"/a\"\n\n[[fakes]]\n  code = \"teapot\"\n", "line 7, column 3: fakes[1].code: want int, got string"},
+		{"toml", "port = 80\nfakes = [\n", "line 2, column 10: unexpected EOF; expected value"},
+	}
+	for _, c := range cases {
+		_, err := normalizeConfig([]byte(c.config), c.format, "", nil)
+		if err == nil {
+			t.Errorf("%s: got no error, want %s", c.format, c.want)
+			continue
+		}
+		if got := err.Error(); got != c.want {
+			t.Errorf("%s: got error %q, want %q", c.format, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Kinds of contract violations
+const (
+	violationOperation      = "operation"
+	violationParameter      = "parameter"
+	violationRequestBody    = "request_body"
+	violationResponseStatus = "response_status"
+	violationResponseBody   = "response_body"
+)
+
+// recentViolations is how many violations the summary keeps per operation
+const recentViolations = 10
+
+// contractValidator checks exchanges against an OpenAPI document
+type contractValidator struct {
+	doc    *openAPIDoc
+	routes []*openAPIRoute
+
+	// strict answers requests that break the contract with a 400 instead of handling them
+	strict bool
+
+	mu    sync.Mutex
+	stats map[string]*contractStats
+}
+
+// openAPIRoute is an operation along with the expression matching its path
+type openAPIRoute struct {
+	name    string
+	method  string
+	pattern *regexp.Regexp
+	params  []string
+	item    *openAPIPathItem
+	op      *openAPIOperation
+}
+
+// contractStats summarize the exchanges checked for an operation
+type contractStats struct {
+	Requests   int            `json:"requests"`
+	Violations int            `json:"violations"`
+	ByKind     map[string]int `json:"by_kind,omitempty"`
+	Recent     []string       `json:"recent,omitempty"`
+}
+
+func newContractValidator(doc *openAPIDoc, strict bool) *contractValidator {
+	v := &contractValidator{doc: doc, strict: strict, stats: make(map[string]*contractStats)}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// paths without templates come first so they win over templated ones
+	var literal, templated []*openAPIRoute
+	for _, path := range paths {
+		item := doc.Paths[path]
+		pattern, params := openAPIPathPattern(doc.basePath() + path)
+		methods, ops := item.operations()
+		for i, op := range ops {
+			route := &openAPIRoute{
+				name:    methods[i] + " " + path,
+				method:  methods[i],
+				pattern: regexp.MustCompile(pattern),
+				params:  params,
+				item:    item,
+				op:      op,
+			}
+			if op.OperationID != "" {
+				route.name = op.OperationID
+			}
+			if len(params) > 0 {
+				templated = append(templated, route)
+			} else {
+				literal = append(literal, route)
+			}
+		}
+	}
+	v.routes = append(literal, templated...)
+	return v
+}
+
+// contractCheck follows a single exchange through validation
+type contractCheck struct {
+	v          *contractValidator
+	rl         *requestLog
+	route      *openAPIRoute
+	pathValues []string
+	method     string
+	violations int
+
+	// rejected is set once the request was answered with a 400 in strict mode
+	rejected bool
+}
+
+// checkRequest validates the request against the operation it matches. The request body
+// is read and put back for the handler.
+func (v *contractValidator) checkRequest(r *http.Request) *contractCheck {
+	c := &contractCheck{v: v, rl: reqLog(r), method: r.Method}
+
+	allowed := []string{}
+	for _, route := range v.routes {
+		m := route.pattern.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		c.route, c.pathValues = route, m[1:]
+		break
+	}
+
+	v.mu.Lock()
+	v.statsFor(c.operation()).Requests++
+	v.mu.Unlock()
+
+	if c.route == nil {
+		if len(allowed) > 0 {
+			c.report(violationOperation, fmt.Sprintf("method %s is not allowed for %s (want %s)", r.Method, r.URL.Path, strings.Join(allowed, ", ")))
+		} else {
+			c.report(violationOperation, fmt.Sprintf("no operation matches %s %s", r.Method, r.URL.Path))
+		}
+		return c
+	}
+
+	c.checkParameters(r)
+
+	body, truncated, err := peekBody(r, requestConfig(r).bodyInspectLimit())
+	if err != nil && !bodyTooLarge(err) {
+		c.rl.Warn("unable to read request body for validation", "error", err)
+	}
+	if truncated {
+		c.rl.Debug("not validating request body over body_inspect_limit")
+		return c
+	}
+	c.checkRequestBody(r.Header.Get("Content-Type"), body)
+	return c
+}
+
+// parameters merges the path item's parameters with the operation's, which take precedence
+func (c *contractCheck) parameters() []*openAPIParameter {
+	byKey := make(map[string]*openAPIParameter)
+	var keys []string
+	for _, p := range append(append([]*openAPIParameter{}, c.route.item.Parameters...), c.route.op.Parameters...) {
+		p = c.v.doc.parameter(p)
+		if p == nil {
+			continue
+		}
+		key := p.In + " " + p.Name
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = p
+	}
+	params := make([]*openAPIParameter, 0, len(keys))
+	for _, key := range keys {
+		params = append(params, byKey[key])
+	}
+	return params
+}
+
+func (c *contractCheck) checkParameters(r *http.Request) {
+	query := r.URL.Query()
+	for _, p := range c.parameters() {
+		var values []string
+		switch p.In {
+		case "path":
+			for i, name := range c.route.params {
+				if name == p.Name && i < len(c.pathValues) {
+					value, err := url.PathUnescape(c.pathValues[i])
+					if err != nil {
+						value = c.pathValues[i]
+					}
+					values = []string{value}
+				}
+			}
+		case "query":
+			values = query[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		case "cookie":
+			if cookie, err := r.Cookie(p.Name); err == nil {
+				values = []string{cookie.Value}
+			}
+		}
+
+		where := p.In + " parameter " + p.Name
+		if len(values) == 0 {
+			if p.Required || p.In == "path" {
+				c.report(violationParameter, where+" is required")
+			}
+			continue
+		}
+
+		schema := c.v.doc.schema(p.Schema)
+		if schema != nil && schema.Type == "array" {
+			if len(values) == 1 && p.In != "query" {
+				values = strings.Split(values[0], ",")
+			}
+			items := make([]interface{}, 0, len(values))
+			for _, value := range values {
+				items = append(items, coerceParameter(c.v.doc.schema(schema.Items), value))
+			}
+			c.reportAll(violationParameter, c.v.doc.validate(schema, items, where))
+			continue
+		}
+		c.reportAll(violationParameter, c.v.doc.validate(schema, coerceParameter(schema, values[0]), where))
+	}
+}
+
+// coerceParameter converts a parameter's text to the schema's type, leaving it as text when
+// it does not convert so validation reports the mismatch
+func coerceParameter(s *openAPISchema, value string) interface{} {
+	if s == nil {
+		return value
+	}
+	switch s.Type {
+	case "integer", "number":
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+func (c *contractCheck) checkRequestBody(contentType string, body []byte) {
+	spec := c.v.doc.requestBody(c.route.op.RequestBody)
+	if spec == nil {
+		return
+	}
+	if len(body) == 0 {
+		if spec.Required {
+			c.report(violationRequestBody, "request body is required")
+		}
+		return
+	}
+	c.reportAll(violationRequestBody, c.v.doc.validateBody(spec.Content, contentType, body, "request body"))
+}
+
+// checkResponse validates the response once it has been written. Bodies that were not
+// fully captured, or that are encoded, are not checked.
+func (c *contractCheck) checkResponse(rec *statusRecorder) {
+	if c.route == nil || c.rejected || rec.status == 0 {
+		return
+	}
+
+	resp := c.responseFor(rec.status)
+	if resp == nil {
+		c.report(violationResponseStatus, fmt.Sprintf("status %d is not documented", rec.status))
+		return
+	}
+	if c.method == http.MethodHead || len(resp.Content) == 0 || rec.body == nil {
+		return
+	}
+	if int64(rec.body.buf.Len()) < rec.body.size {
+		c.rl.Debug("skipping validation of truncated response body")
+		return
+	}
+	if encoding := rec.header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		c.rl.Debug("skipping validation of encoded response body", "encoding", encoding)
+		return
+	}
+	c.reportAll(violationResponseBody, c.v.doc.validateBody(resp.Content, rec.header.Get("Content-Type"), rec.body.buf.Bytes(), "response body"))
+}
+
+// responseFor finds the documented response for the status: exact, by class (2XX), or default
+func (c *contractCheck) responseFor(status int) *openAPIResponse {
+	code := strconv.Itoa(status)
+	for _, key := range []string{code, code[:1] + "XX", code[:1] + "xx", "default"} {
+		if resp, ok := c.route.op.Responses[key]; ok {
+			return c.v.doc.response(resp)
+		}
+	}
+	return nil
+}
+
+// report logs a violation, and records it for the journal, metrics and summary
+func (c *contractCheck) report(kind, violation string) {
+	operation := c.operation()
+	c.violations++
+	c.rl.Warn("contract violation", "operation", operation, "kind", kind, "violation", violation)
+	c.rl.violations = append(c.rl.violations, violation)
+	metrics.violations.inc(c.rl.listener, operation, kind)
+
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	stats := c.v.statsFor(operation)
+	stats.Violations++
+	stats.ByKind[kind]++
+	stats.Recent = append(stats.Recent, time.Now().UTC().Format(time.RFC3339)+" "+c.rl.id+" "+violation)
+	if len(stats.Recent) > recentViolations {
+		stats.Recent = stats.Recent[len(stats.Recent)-recentViolations:]
+	}
+}
+
+func (c *contractCheck) reportAll(kind string, violations []string) {
+	for _, violation := range violations {
+		c.report(kind, violation)
+	}
+}
+
+// operation names the matched operation in logs, metrics and the summary
+func (c *contractCheck) operation() string {
+	if c.route == nil {
+		return "unmatched"
+	}
+	return c.route.name
+}
+
+// statsFor returns the operation's stats; the caller holds mu
+func (v *contractValidator) statsFor(operation string) *contractStats {
+	stats, ok := v.stats[operation]
+	if !ok {
+		stats = &contractStats{ByKind: make(map[string]int)}
+		v.stats[operation] = stats
+	}
+	return stats
+}
+
+// writeInvalidRequest answers a request that broke the contract in strict mode
+func (c *contractCheck) writeInvalidRequest(w http.ResponseWriter) {
+	c.rejected = true
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "request does not match the OpenAPI document",
+		"violations": c.rl.violations,
+	})
+}
+
+// ServeHTTP serves the summary of violations by operation
+func (v *contractValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	summary := struct {
+		Requests   int                       `json:"requests"`
+		Violations int                       `json:"violations"`
+		Operations map[string]*contractStats `json:"operations"`
+	}{Operations: v.stats}
+	for _, stats := range v.stats {
+		summary.Requests += stats.Requests
+		summary.Violations += stats.Violations
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	v.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// violationsHandler serves the validator's summary, when validation is enabled
+func violationsHandler(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	if config == nil || config.validator == nil {
+		http.Error(w, "OpenAPI validation is not enabled (see -openapi_validate)", http.StatusNotFound)
+		return
+	}
+	config.validator.ServeHTTP(w, r)
+}
+
+// validateBody checks a body against the schema of its documented media type. Only JSON
+// bodies are checked against their schema.
+func (doc *openAPIDoc) validateBody(content map[string]*openAPIMediaType, contentType string, body []byte, where string) []string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+	media, ok := content[mediaType]
+	if !ok {
+		major := strings.SplitN(mediaType, "/", 2)[0]
+		if media, ok = content[major+"/*"]; !ok {
+			media, ok = content["*/*"]
+		}
+	}
+	if !ok {
+		documented := make([]string, 0, len(content))
+		for t := range content {
+			documented = append(documented, t)
+		}
+		sort.Strings(documented)
+		return []string{fmt.Sprintf("%s content type %q is not documented (want %s)", where, contentType, strings.Join(documented, ", "))}
+	}
+	if media == nil || media.Schema == nil || !strings.Contains(mediaType, "json") {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return []string{fmt.Sprintf("%s is not valid JSON - %v", where, err)}
+	}
+	return doc.validate(media.Schema, value, where)
+}
+
+// validate checks a decoded JSON value against the schema, returning what does not match
+func (doc *openAPIDoc) validate(s *openAPISchema, value interface{}, where string) []string {
+	return doc.validateDepth(s, value, where, 0)
+}
+
+func (doc *openAPIDoc) validateDepth(s *openAPISchema, value interface{}, where string, depth int) []string {
+	s = doc.schema(s)
+	if s == nil || depth > 32 {
+		return nil
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: want %s, got null", where, s.Type)}
+	}
+
+	var violations []string
+	for _, sub := range s.AllOf {
+		violations = append(violations, doc.validateDepth(sub, value, where, depth+1)...)
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			if len(doc.validateDepth(sub, value, where, depth+1)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violations = append(violations, fmt.Sprintf("%s: matches none of anyOf", where))
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matched := 0
+		for _, sub := range s.OneOf {
+			if len(doc.validateDepth(sub, value, where, depth+1)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			violations = append(violations, fmt.Sprintf("%s: matches %d of oneOf, want exactly 1", where, matched))
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violations = append(violations, fmt.Sprintf("%s: %v is not one of %v", where, value, s.Enum))
+		}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: want object, got %s", where, jsonType(value)))
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: missing required property %s", where, name))
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if allowed, isBool := s.AdditionalProperties.(bool); isBool && !allowed {
+					violations = append(violations, fmt.Sprintf("%s: unexpected property %s", where, name))
+				}
+				continue
+			}
+			violations = append(violations, doc.validateDepth(prop, obj[name], where+"."+name, depth+1)...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: want array, got %s", where, jsonType(value)))
+		}
+		if len(items) < s.MinItems {
+			violations = append(violations, fmt.Sprintf("%s: want at least %d items, got %d", where, s.MinItems, len(items)))
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			violations = append(violations, fmt.Sprintf("%s: want at most %d items, got %d", where, *s.MaxItems, len(items)))
+		}
+		for i, item := range items {
+			violations = append(violations, doc.validateDepth(s.Items, item, fmt.Sprintf("%s[%d]", where, i), depth+1)...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: want string, got %s", where, jsonType(value)))
+		}
+		if n := utf8.RuneCountInString(str); n < s.MinLength {
+			violations = append(violations, fmt.Sprintf("%s: want at least %d characters, got %d", where, s.MinLength, n))
+		} else if s.MaxLength != nil && n > *s.MaxLength {
+			violations = append(violations, fmt.Sprintf("%s: want at most %d characters, got %d", where, *s.MaxLength, n))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			violations = append(violations, fmt.Sprintf("%s: %q does not match pattern %s", where, str, s.Pattern))
+		}
+		if layout, ok := map[string]string{"date-time": time.RFC3339, "date": "2006-01-02"}[s.Format]; ok {
+			if _, err := time.Parse(layout, str); err != nil {
+				violations = append(violations, fmt.Sprintf("%s: %q is not a %s", where, str, s.Format))
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return append(violations, fmt.Sprintf("%s: want %s, got %s", where, s.Type, jsonType(value)))
+		}
+		if s.Type == "integer" && n != float64(int64(n)) {
+			return append(violations, fmt.Sprintf("%s: want integer, got %v", where, n))
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			violations = append(violations, fmt.Sprintf("%s: %v is less than the minimum %v", where, n, *s.Minimum))
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			violations = append(violations, fmt.Sprintf("%s: %v is more than the maximum %v", where, n, *s.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(violations, fmt.Sprintf("%s: want boolean, got %s", where, jsonType(value)))
+		}
+	}
+	return violations
+}
+
+// jsonType names the JSON type of a decoded value
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case float64:
+		return fmt.Sprintf("number %v", v)
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const contractOpenAPI = `
+openapi: 3.0.3
+paths:
+  /orders:
+    post:
+      operationId: createOrder
+      parameters:
+        - name: dry_run
+          in: query
+          schema:
+            type: boolean
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: "#/components/schemas/Order"
+      responses:
+        "201":
+          description: created
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+  /orders/{orderId}:
+    parameters:
+      - name: orderId
+        in: path
+        required: true
+        schema:
+          type: integer
+          minimum: 1
+    get:
+      operationId: getOrder
+      responses:
+        "200":
+          description: an order
+          content:
+            application/json:
+              schema:
+                $ref: "#/components/schemas/Order"
+components:
+  schemas:
+    Order:
+      type: object
+      required: [item, quantity]
+      additionalProperties: false
+      properties:
+        id:
+          type: integer
+        item:
+          type: string
+          minLength: 1
+        quantity:
+          type: integer
+          minimum: 1
+          maximum: 10
+        status:
+          type: string
+          enum: [open, shipped]
+        sku:
+          type: string
+          pattern: "^[A-Z]{2}[0-9]+$"
+`
+
+func TestContractValidate(t *testing.T) {
+	doc, err := parseOpenAPI([]byte(contractOpenAPI))
+	if err != nil {
+		t.Fatalf("got error parsing OpenAPI document - %v", err)
+	}
+	schema := doc.Components.Schemas["Order"]
+
+	t.Log(">> verify valid values pass")
+	{
+		var order interface{}
+		json.Unmarshal([]byte(`{"id": 3, "item": "book", "quantity": 2, "status": "open", "sku": "BK12"}`), &order)
+		if got := doc.validate(schema, order, "body"); len(got) != 0 {
+			t.Errorf("got violations %v, want none", got)
+		}
+	}
+
+	t.Log(">> verify each broken rule is reported")
+	{
+		var order interface{}
+		json.Unmarshal([]byte(`{"id": 1.5, "item": "", "quantity": 11, "status": "lost", "sku": "bk12", "gift": true}`), &order)
+		got := strings.Join(doc.validate(schema, order, "body"), "\n")
+		for _, want := range []string{
+			"body: unexpected property gift",
+			"body.id: want integer, got 1.5",
+			"body.item: want at least 1 characters, got 0",
+			"body.quantity: 11 is more than the maximum 10",
+			"body.status: lost is not one of [open shipped]",
+			`body.sku: "bk12" does not match pattern ^[A-Z]{2}[0-9]+$`,
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("got violations\n%s\nwant them to contain %s", got, want)
+			}
+		}
+		if got, want := fmt.Sprint(doc.validate(schema, []interface{}{}, "body")), "[body: want object, got array]"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify patterns are compiled when the document is parsed")
+	{
+		if schema.Properties["sku"].pattern == nil {
+			t.Error("got no compiled pattern for sku")
+		}
+		bad := strings.Replace(contractOpenAPI, `"^[A-Z]{2}[0-9]+$"`, `"^[A-Z"`, 1)
+		if _, err := parseOpenAPI([]byte(bad)); err == nil || !strings.Contains(err.Error(), "schema Order.sku") {
+			t.Errorf("got error %v, want one for the invalid pattern of Order.sku", err)
+		}
+	}
+}
+
+func TestContractExchanges(t *testing.T) {
+	defaultHyjackTestSetup()
+	doc, _ := parseOpenAPI([]byte(contractOpenAPI))
+	updateConfig(func(c *Config) {
+		c.validator = newContractValidator(doc, false)
+		c.Fakes = append([]*Fake{
+			{HyjackPath: "/orders/1", ResponseCode: http.StatusOK, ResponseHeaders: StringSlice{"Content-Type: application/json"}, ResponseBody: `{"item": "book", "quantity": 1}`},
+			{HyjackPath: "/orders/2", ResponseCode: http.StatusOK, ResponseHeaders: StringSlice{"Content-Type: application/json"}, ResponseBody: `{"item": "book"}`},
+			{HyjackPath: "/orders/3", ResponseCode: http.StatusNotFound},
+		}, c.Fakes...)
+	})
+
+	cases := []struct {
+		id, path string
+		want     []string
+	}{
+		{"contract-ok", "/orders/1", nil},
+		{"contract-body", "/orders/2", []string{"response body: missing required property quantity"}},
+		{"contract-status", "/orders/3", []string{"status 404 is not documented"}},
+		{"contract-param", "/orders/zero", []string{`path parameter orderId: want integer, got string "zero"`, `response body content type "text/plain; charset=utf-8" is not documented (want application/json)`}},
+		{"contract-unknown", "/invoices", []string{"no operation matches GET /invoices"}},
+	}
+	for _, c := range cases {
+		t.Logf(">> verify %s is recorded with violations %v", c.path, c.want)
+		doWithHeaders(t, c.path, map[string]string{"X-Request-Id": c.id})
+		entry := harEntryFor(t, c.id)
+		if got, want := fmt.Sprint(entry.Violations), fmt.Sprint(c.want); got != want {
+			t.Errorf("%s: got violations %s, want %s", c.path, got, want)
+		}
+	}
+
+	t.Log(">> verify the summary counts violations by operation")
+	{
+		rec := httptest.NewRecorder()
+		adminMux().ServeHTTP(rec, httptest.NewRequest("GET", "/violations", nil))
+		var summary struct {
+			Requests   int
+			Violations int
+			Operations map[string]*contractStats
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("unable to parse summary - %v", err)
+		}
+		if got, want := fmt.Sprint(summary.Requests, summary.Violations), "5 5"; got != want {
+			t.Errorf("got requests and violations %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(summary.Operations["getOrder"].ByKind), "map[parameter:1 response_body:2 response_status:1]"; got != want {
+			t.Errorf("got getOrder violations by kind %s, want %s", got, want)
+		}
+		if got, want := summary.Operations["unmatched"].Violations, 1; got != want {
+			t.Errorf("got %d unmatched violations, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify response bodies are checked when the journal is disabled")
+	{
+		defer func(j *journal) { exchanges = j }(exchanges)
+		exchanges = newJournal(0, defaultJournalBodyLimit)
+		doWithHeaders(t, "/orders/2", nil)
+		v := currentConfig().validator
+		// the response is checked once it has been written, so wait for the check
+		got, want := 0, 3
+		for deadline := time.Now().Add(time.Second); got != want && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			v.mu.Lock()
+			got = v.statsFor("getOrder").ByKind[violationResponseBody]
+			v.mu.Unlock()
+		}
+		if got != want {
+			t.Errorf("got %d response body violations, want %d", got, want)
+		}
+	}
+}
+
+func TestContractStrict(t *testing.T) {
+	defaultHyjackTestSetup()
+	doc, _ := parseOpenAPI([]byte(contractOpenAPI))
+	updateConfig(func(c *Config) {
+		c.validator = newContractValidator(doc, true)
+		c.Fakes = append([]*Fake{{HyjackPath: "/orders", ResponseCode: http.StatusCreated}}, c.Fakes...)
+	})
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		defer resp.Body.Close()
+		var answer struct{ Violations []string }
+		json.NewDecoder(resp.Body).Decode(&answer)
+		return resp.StatusCode, strings.Join(answer.Violations, "; ")
+	}
+
+	t.Log(">> verify invalid requests are answered with a 400 listing the violations")
+	{
+		code, violations := post("/orders?dry_run=maybe", `{"item": "book"}`)
+		if got, want := code, http.StatusBadRequest; got != want {
+			t.Errorf("got code %d, want %d", got, want)
+		}
+		if got, want := violations, `query parameter dry_run: want boolean, got string "maybe"; request body: missing required property quantity`; got != want {
+			t.Errorf("got violations %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify valid requests are handled")
+	{
+		if got, want := func() int { code, _ := post("/orders?dry_run=true", `{"item": "book", "quantity": 1}`); return code }(), http.StatusCreated; got != want {
+			t.Errorf("got code %d, want %d", got, want)
+		}
+	}
+}
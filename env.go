@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envFlagPrefix is prepended to a flag's upper cased name to give its environment variable
+const envFlagPrefix = "FAKETTP_"
+
+// interpolation matches $${...} escapes and ${VAR}, ${VAR:-default} and ${file:path}
+var interpolation = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// interpolate replaces ${VAR} with the environment variable, ${VAR:-default} with the
+// variable or the default when it is unset or empty, and ${file:path} with the file's
+// contents less the trailing newline, for secrets mounted as files. A relative path is
+// resolved against dir, the directory of the config file. $${ is a literal ${.
+func interpolate(s, dir string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	out := interpolation.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		expr := match[2 : len(match)-1]
+		if path := strings.TrimPrefix(expr, "file:"); path != expr {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			data, readErr := ioutil.ReadFile(path)
+			if readErr != nil && err == nil {
+				err = fmt.Errorf("reading %s - %v", match, readErr)
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		}
+
+		name, def, hasDefault := strings.Cut(expr, ":-")
+		if value, ok := lookup(name); ok && (value != "" || !hasDefault) {
+			return value
+		}
+		if !hasDefault && err == nil {
+			err = fmt.Errorf("%s is not set (use ${%s:-default} for a default)", name, name)
+		}
+		return def
+	})
+	return out, err
+}
+
+// interpolateConfig interpolates every string in a decoded config. Strings that are set
+// for number or boolean fields, such as "port": "${PORT:-5000}", are converted once
+// interpolated. dir is the directory of the config file, for relative ${file:path}.
+func interpolateConfig(config map[string]interface{}, dir string, lookup func(string) (string, bool)) error {
+	return interpolateObject(config, reflect.TypeOf(Config{}), "", dir, lookup)
+}
+
+func interpolateObject(obj map[string]interface{}, t reflect.Type, where, dir string, lookup func(string) (string, bool)) error {
+	fields := make(map[string]reflect.Type)
+	if t != nil {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+				fields[name] = f.Type
+			}
+		}
+	}
+	for key, value := range obj {
+		name := key
+		if where != "" {
+			name = where + "." + key
+		}
+		v, err := interpolateValue(value, fields[key], name, dir, lookup)
+		if err != nil {
+			return err
+		}
+		obj[key] = v
+	}
+	return nil
+}
+
+func interpolateValue(value interface{}, t reflect.Type, where, dir string, lookup func(string) (string, bool)) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch v := value.(type) {
+	case string:
+		s, err := interpolate(v, dir, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", where, err)
+		}
+		if t == nil || s == v {
+			return s, nil
+		}
+		switch t.Kind() {
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not a number", where, s)
+			}
+			return n, nil
+		case reflect.Bool:
+			b, err := strconv.ParseBool(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not true or false", where, s)
+			}
+			return b, nil
+		}
+		return s, nil
+	case map[string]interface{}:
+		if t != nil && t.Kind() != reflect.Struct {
+			t = nil
+		}
+		return v, interpolateObject(v, t, where, dir, lookup)
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		for i := range v {
+			item, err := interpolateValue(v[i], elem, fmt.Sprintf("%s[%d]", where, i), dir, lookup)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+		return v, nil
+	}
+	return value, nil
+}
+
+// splitList splits a comma separated list. \, is a literal comma, for values such as
+// headers that have commas of their own.
+func splitList(s string) []string {
+	var items []string
+	var item strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ',':
+			item.WriteByte(',')
+			i++
+		case s[i] == ',':
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(s[i])
+		}
+	}
+	return append(items, item.String())
+}
+
+// envFlagName returns the environment variable for a flag, ex: FAKETTP_PROXY_HOST
+func envFlagName(flagName string) string {
+	return envFlagPrefix + strings.ToUpper(flagName)
+}
+
+// applyEnvFlags sets each flag that was not given on the command line from its FAKETTP_*
+// environment variable. Repeatable flags take comma separated values (see splitList). It
+// returns the FAKETTP_* variables that match no flag.
+func applyEnvFlags(fs *flag.FlagSet, environ []string) ([]string, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, envFlagPrefix) {
+			env[name] = value
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envFlagName(f.Name)
+		value, ok := env[name]
+		delete(env, name)
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		values := []string{value}
+		if _, repeatable := f.Value.(*StringSlice); repeatable {
+			values = splitList(value)
+		}
+		for _, v := range values {
+			if setErr := fs.Set(f.Name, strings.TrimSpace(v)); setErr != nil {
+				err = fmt.Errorf("%s: %v", name, setErr)
+				return
+			}
+		}
+	})
+
+	var unknown []string
+	for name := range env {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	return unknown, err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"HOST": "apid.docker", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "token")
+	ioutil.WriteFile(secret, []byte("s3cret\n"), 0600)
+
+	cases := []struct{ in, want, err string }{
+		{"http://${HOST}:80", "http://apid.docker:80", ""},
+		{"${PORT:-5000}", "5000", ""},
+		{"${EMPTY:-fallback}", "fallback", ""},
+		{"[${EMPTY}]", "[]", ""},
+		{"Bearer ${file:" + secret + "}", "Bearer s3cret", ""},
+		{"Bearer ${file:token}", "Bearer s3cret", ""},
+		{"literal $${HOST} and $HOST", "literal ${HOST} and $HOST", ""},
+		{"${MISSING}", "", "MISSING is not set (use ${MISSING:-default} for a default)"},
+		{"${file:" + filepath.Join(dir, "nope") + "}", "", "reading ${file:"},
+	}
+	for _, c := range cases {
+		got, err := interpolate(c.in, dir, lookup)
+		if c.err != "" {
+			if err == nil || len(err.Error()) < len(c.err) || err.Error()[:len(c.err)] != c.err {
+				t.Errorf("%s: got error %v, want %s", c.in, err, c.err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%s: got %q (error %v), want %q", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	t.Setenv("FAKETTP_TEST_HOST", "apid.docker")
+	t.Setenv("FAKETTP_TEST_TOKEN", "abc")
+	dir := writeConfigFiles(t, map[string]string{
+		"env.yaml": `proxy_host: ${FAKETTP_TEST_HOST}
+proxy_port: ${FAKETTP_TEST_PORT:-8082}
+fakes:
+  - hyjack: /token
+    pattern_match: ${FAKETTP_TEST_REGEX:-false}
+    headers: ["Authorization: Bearer ${FAKETTP_TEST_TOKEN}"]
+    body: |
+      {"token": "${FAKETTP_TEST_TOKEN}", "template": "$${name}"}
+`,
+		"bad.json":          `{"fakes": [{"hyjack": "/a"}, {"body": "${FAKETTP_TEST_MISSING}"}]}`,
+		"port.json":         `{"port": "${FAKETTP_TEST_HOST}"}`,
+		"secrets.json":      `{"include": "secrets/auth.json"}`,
+		"secrets/auth.json": `{"fakes": [{"hyjack": "/auth", "body": "${file:token}"}]}`,
+		"secrets/token":     "s3cret\n",
+	})
+	defer os.RemoveAll(dir)
+
+	t.Log(">> verify values are interpolated and converted to their field types")
+	{
+		data, err := loadConfig([]string{filepath.Join(dir, "env.yaml")}, nil, "")
+		if err != nil {
+			t.Fatalf("got error loading config - %v", err)
+		}
+		config := &Config{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("unable to parse config - %v", err)
+		}
+		if got, want := fmt.Sprintf("%s:%d", config.ProxyHost, config.ProxyPort), "apid.docker:8082"; got != want {
+			t.Errorf("got upstream %s, want %s", got, want)
+		}
+		fake := config.Fakes[0]
+		if got, want := fake.ResponseBody, "{\"token\": \"abc\", \"template\": \"${name}\"}\n"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+		if got, want := fmt.Sprint(fake.ResponseHeaders, fake.IsRegex), "[Authorization: Bearer abc] false"; got != want {
+			t.Errorf("got headers and pattern_match %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify relative ${file:path} is read from the directory of the config using it")
+	{
+		data, err := loadConfig([]string{filepath.Join(dir, "secrets.json")}, nil, "")
+		if err != nil {
+			t.Fatalf("got error loading config - %v", err)
+		}
+		config := &Config{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("unable to parse config - %v", err)
+		}
+		if got, want := config.Fakes[0].ResponseBody, "s3cret"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify errors name the field")
+	{
+		for name, want := range map[string]string{
+			"bad.json":  "bad.json: fakes[1].body: FAKETTP_TEST_MISSING is not set (use ${FAKETTP_TEST_MISSING:-default} for a default)",
+			"port.json": `port.json: port: "apid.docker" is not a number`,
+		} {
+			_, err := loadConfig([]string{filepath.Join(dir, name)}, nil, "")
+			if err == nil || err.Error() != filepath.Join(dir, want) {
+				t.Errorf("got error %v, want %s", err, filepath.Join(dir, want))
+			}
+		}
+	}
+}
+
+func TestEnvFlags(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *string, *int, *bool, *time.Duration, *StringSlice) {
+		fs := flag.NewFlagSet("fakettp", flag.ContinueOnError)
+		host := fs.String("proxy_host", "", "")
+		port := fs.Int("proxy_port", 0, "")
+		regex := fs.Bool("pattern_match", false, "")
+		delay := fs.Duration("proxy_delay", 0, "")
+		var methods, headers StringSlice
+		fs.Var(&methods, "method", "")
+		fs.Var(&headers, "header", "")
+		return fs, host, port, regex, delay, &methods
+	}
+	environ := []string{"FAKETTP_PROXY_HOST=env.docker", "FAKETTP_PROXY_PORT=9000", "FAKETTP_PATTERN_MATCH=true", "FAKETTP_PROXY_DELAY=2s", "FAKETTP_METHOD=GET, POST", "FAKETTP_PROXY_HOTS=typo", "PATH=/bin"}
+
+	t.Log(">> verify flags are set from the environment, and command line flags win")
+	{
+		fs, host, port, regex, delay, methods := newFlags()
+		fs.Parse([]string{"-proxy_port", "7000"})
+		unknown, err := applyEnvFlags(fs, environ)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := fmt.Sprintln(*host, *port, *regex, *delay, *methods), "env.docker 7000 true 2s [GET POST]\n"; got != want {
+			t.Errorf("got flags %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(unknown), "[FAKETTP_PROXY_HOTS]"; got != want {
+			t.Errorf("got unknown variables %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify escaped commas stay in the values of repeatable flags")
+	{
+		fs, _, _, _, _, _ := newFlags()
+		fs.Parse(nil)
+		if _, err := applyEnvFlags(fs, []string{`FAKETTP_HEADER=Cache-Control: no-cache\, no-store,X-Env: yes`}); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := fs.Lookup("header").Value.String(), "[Cache-Control: no-cache, no-store X-Env: yes]"; got != want {
+			t.Errorf("got headers %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify bad values name the variable")
+	{
+		fs, _, _, _, _, _ := newFlags()
+		fs.Parse(nil)
+		_, err := applyEnvFlags(fs, []string{"FAKETTP_PROXY_PORT=lots"})
+		if err == nil || err.Error()[:len("FAKETTP_PROXY_PORT: ")] != "FAKETTP_PROXY_PORT: " {
+			t.Errorf("got error %v, want it to name FAKETTP_PROXY_PORT", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// fallbackError is returned from the proxy's ModifyResponse hook to hand an upstream
+// response over to a fallback fake
+type fallbackError struct {
+	match  *fakeMatcher
+	params map[string]string
+	code   int
+}
+
+func (e *fallbackError) Error() string {
+	return "upstream responded with " + strconv.Itoa(e.code)
+}
+
+// fallbackOnStatus returns a ModifyResponse hook that swaps the upstream response for a
+// fallback fake when the upstream status matches one of the fake's fallback_status values
+func fallbackOnStatus(r *http.Request, requestBody []byte) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if m, params := findFallback(r, requestBody, resp.StatusCode); m != nil {
+			return &fallbackError{match: m, params: params, code: resp.StatusCode}
+		}
+		return nil
+	}
+}
+
+// fallbackOnError returns a proxy ErrorHandler that serves a fallback fake when the upstream
+// failed (unreachable, timed out, or handed over by fallbackOnStatus). Without a matching
+// fallback, it responds as configured by proxy_error_code and proxy_error_body.
+func fallbackOnError(requestBody []byte) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		rl := reqLog(r)
+		if fe, ok := err.(*fallbackError); ok {
+			rl.decide("fallback", fe.match.label)
+			rl.Info("using fallback for upstream status", "upstream_status", fe.code)
+			serveFake(w, r, fe.match.fake, fe.params)
+			return
+		}
+
+		if bodyTooLarge(err) {
+			writeBodyTooLarge(w, r, requestConfig(r).MaxRequestBody)
+			return
+		}
+
+		metrics.upstreamErrors.inc(rl.listener, upstreamErrorCause(err))
+		if m, params := findFallback(r, requestBody, 0); m != nil {
+			rl.decide("fallback", m.label)
+			rl.Info("using fallback for upstream error", "cause", upstreamErrorCause(err), "error", err)
+			serveFake(w, r, m.fake, params)
+			return
+		}
+		writeUpstreamError(w, r, err)
+	}
+}
+
+// findFallback returns the first fallback fake matching the request, with the params its
+// path template captured. A code of 0 means the upstream could not be reached, which any
+// matching fallback fake handles; otherwise the fake must list a matching fallback_status.
+func findFallback(r *http.Request, requestBody []byte, code int) (*fakeMatcher, map[string]string) {
+	body := func() string { return string(requestBody) }
+	// session fallbacks are tried before the global ones
+	var fallbacks []*fakeMatcher
+	if s := requestSession(r); s != nil {
+		fallbacks = append(fallbacks, s.index.fallbacks...)
+	}
+	fallbacks = append(fallbacks, requestConfig(r).fakeIndex().fallbacks...)
+	for _, m := range fallbacks {
+		params, ok := m.match(r, body)
+		if !ok {
+			continue
+		}
+
+		if code == 0 {
+			return m, params
+		}
+		for _, status := range m.fake.FallbackStatus {
+			if statusMatches(status, code) {
+				return m, params
+			}
+		}
+	}
+	return nil, nil
+}
+
+// statusMatches compares a status code against an exact code ("503") or a class ("5xx")
+func statusMatches(pattern string, code int) bool {
+	pattern = strings.ToLower(pattern)
+	if strings.HasSuffix(pattern, "xx") && len(pattern) == 3 {
+		return strconv.Itoa(code/100) == pattern[:1]
+	}
+	return pattern == strconv.Itoa(code)
+}
+
+// validStatusPattern reports if the pattern is an exact status code or a status class
+func validStatusPattern(pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	if pattern[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
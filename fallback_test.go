@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestFallbackOnUpstreamStatus(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.Fakes = append(c.Fakes,
+			&Fake{HyjackPath: "/flaky", Fallback: true, FallbackStatus: StringSlice{"5xx"}, ResponseCode: http.StatusOK, ResponseBody: "fallback"},
+			&Fake{HyjackPath: "/foo", Fallback: true, FallbackStatus: StringSlice{"5xx"}, ResponseCode: http.StatusOK, ResponseBody: "fallback"},
+		)
+	})
+
+	t.Log(">> verify a 5xx from upstream is replaced by the fallback fake")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/flaky", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := string(body), "fallback"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify a healthy upstream response is proxied despite a fallback fake")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/foo", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := string(body), "proxied"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+	}
+}
+
+func TestFallbackOnUnreachableUpstream(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		// nothing listens here
+		c.ProxyPort = 4331
+		c.Fakes = append(c.Fakes,
+			&Fake{HyjackPath: "/down", Fallback: true, ResponseCode: http.StatusAccepted, ResponseBody: "fallback"},
+		)
+	})
+
+	t.Log(">> verify an unreachable upstream is replaced by the fallback fake")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/down", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := string(body), "fallback"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusAccepted; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify an unreachable upstream without a fallback is a 502")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/other", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusBadGateway; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+}
+
+func TestStatusMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		code    int
+		want    bool
+	}{
+		{"5xx", 503, true},
+		{"5XX", 500, true},
+		{"5xx", 404, false},
+		{"404", 404, true},
+		{"404", 405, false},
+	}
+	for _, test := range tests {
+		if got := statusMatches(test.pattern, test.code); got != test.want {
+			t.Errorf("statusMatches(%q, %d) got %t, want %t", test.pattern, test.code, got, test.want)
+		}
+	}
+}
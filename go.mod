@@ -0,0 +1,10 @@
+module github.com/sethgrid/fakettp
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require google.golang.org/protobuf v1.36.11
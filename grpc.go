@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcCodes are the gRPC status codes by name
+var grpcCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+// FakeGRPC makes a fake answer a gRPC call, hyjacking its /package.Service/Method path, with
+// messages and then a status in the trailers
+type FakeGRPC struct {
+	// Status is a code name such as NOT_FOUND, or its number; OK by default
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Messages are written as JSON and encoded as the method's output type, found in the
+	// grpc_descriptor_sets. Several messages answer server streaming calls.
+	Messages []json.RawMessage `json:"messages,omitempty"`
+	// MessagesBase64 are messages already encoded, sent after Messages
+	MessagesBase64  []string    `json:"messages_base64,omitempty"`
+	MessageDelayRaw string      `json:"message_delay,omitempty"`
+	Trailers        StringSlice `json:"trailers,omitempty"`
+
+	code         int
+	messageDelay time.Duration
+}
+
+// prepare converts the status, delay and encoded messages for use
+func (g *FakeGRPC) prepare() error {
+	code, err := parseGRPCStatus(g.Status)
+	if err != nil {
+		return err
+	}
+	g.code = code
+	if g.MessageDelayRaw != "" {
+		d, err := time.ParseDuration(g.MessageDelayRaw)
+		if err != nil {
+			return fmt.Errorf("converting message_delay to time duration - %v", err)
+		}
+		g.messageDelay = d
+	}
+	for i, msg := range g.MessagesBase64 {
+		if _, err := base64.StdEncoding.DecodeString(msg); err != nil {
+			return fmt.Errorf("messages_base64[%d]: invalid base64 - %v", i, err)
+		}
+	}
+	return nil
+}
+
+// parseGRPCStatus returns the code of a status given by name or number
+func parseGRPCStatus(status string) (int, error) {
+	if status == "" {
+		return 0, nil
+	}
+	if code, ok := grpcCodes[strings.ToUpper(status)]; ok {
+		return code, nil
+	}
+	if code, err := strconv.Atoi(status); err == nil && code >= 0 && code <= 16 {
+		return code, nil
+	}
+	return 0, fmt.Errorf("unknown grpc status %q (want a name like NOT_FOUND or a code from 0 to 16)", status)
+}
+
+// isGRPC reports if the request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// encodeMessages returns the fake's messages as length prefixed gRPC frames. Messages
+// written as JSON need the descriptor of the method called.
+func (g *FakeGRPC) encodeMessages(protos *protoRegistry, method string) ([][]byte, error) {
+	var payloads [][]byte
+	if len(g.Messages) > 0 {
+		if protos == nil {
+			return nil, fmt.Errorf("encoding messages needs grpc_descriptor_sets (or give messages_base64)")
+		}
+		m := protos.methods[method]
+		if m == nil {
+			return nil, fmt.Errorf("no method %s in the grpc_descriptor_sets", method)
+		}
+		for i, msg := range g.Messages {
+			payload, err := protos.encodeJSON(m.output, msg)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			payloads = append(payloads, payload)
+		}
+	}
+	for i, msg := range g.MessagesBase64 {
+		payload, err := base64.StdEncoding.DecodeString(msg)
+		if err != nil {
+			return nil, fmt.Errorf("messages_base64[%d]: invalid base64 - %v", i, err)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	frames := make([][]byte, len(payloads))
+	for i, payload := range payloads {
+		// an uncompressed flag, then the length
+		frame := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+		frames[i] = append(frame, payload...)
+	}
+	return frames, nil
+}
+
+// serve writes the fake's messages and then its status and trailers, with the fake's
+// headers already set on w. Messages that cannot be encoded are answered INTERNAL.
+func (g *FakeGRPC) serve(w http.ResponseWriter, r *http.Request) {
+	rl := reqLog(r)
+	code, message := g.code, g.Message
+	if g.Status != "" && code == 0 {
+		// the fake was not prepared
+		code, _ = parseGRPCStatus(g.Status)
+	}
+	frames, err := g.encodeMessages(requestConfig(r).protos, r.URL.Path)
+	if err != nil {
+		rl.Error("encoding grpc messages", "error", err)
+		code, message = grpcCodes["INTERNAL"], "fakettp: "+err.Error()
+	}
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/grpc")
+	}
+	w.WriteHeader(http.StatusOK)
+	for i, frame := range frames {
+		if i > 0 && g.messageDelay > 0 {
+			select {
+			case <-time.After(g.messageDelay):
+			case <-r.Context().Done():
+				rl.Info("client went away during grpc stream", "messages", i)
+				return
+			}
+		}
+		if _, err := w.Write(frame); err != nil {
+			rl.Info("client went away during grpc stream", "messages", i, "error", err)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	rl.Info("answering grpc call", "grpc_status", code, "messages", len(frames))
+	header.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		header.Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(message))
+	}
+	for _, trailer := range g.Trailers {
+		if name, value, ok := strings.Cut(trailer, ": "); ok && name != "" {
+			header.Add(http.TrailerPrefix+name, value)
+		} else {
+			rl.Warn("skipping trailer (need a value on both sides of :)", "trailer", trailer)
+		}
+	}
+}
+
+// grpcEncodeMessage percent encodes a grpc-message, as the gRPC HTTP/2 protocol requires:
+// everything but printable ASCII, and %
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// checkGRPCFakes encodes the messages of the fakes answering a single gRPC method, so
+// problems are found at startup rather than on the first call
+func checkGRPCFakes(c *Config) error {
+	check := func(fakes []*Fake, prefix string) error {
+		for i, fake := range fakes {
+			if fake.GRPC == nil || fake.IsRegex || fake.Path != "" || fake.HyjackPath == "" {
+				continue
+			}
+			if _, err := fake.GRPC.encodeMessages(c.protos, fake.HyjackPath); err != nil {
+				return fmt.Errorf("%sfakes[%d]: grpc: %v", prefix, i, err)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Fakes, ""); err != nil {
+		return err
+	}
+	for i, l := range c.Listeners {
+		if err := check(l.Fakes, fmt.Sprintf("listeners[%d].", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// h2cClient speaks HTTP/2 without TLS, as gRPC clients do to plain text servers
+var h2cClient = &http.Client{Transport: func() *http.Transport {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}()}
+
+// grpcCall makes a gRPC call with an empty message to the fake server, returning the
+// response and the messages read from it
+func grpcCall(t *testing.T, path string, headers map[string]string) (*http.Response, []string, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path), strings.NewReader("\x00\x00\x00\x00\x00"))
+	if err != nil {
+		t.Fatalf("unable to set up request - %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := h2cClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+
+	var messages []string
+	for len(data) >= 5 {
+		n := binary.BigEndian.Uint32(data[1:5])
+		if int(n) > len(data)-5 {
+			t.Fatalf("got a frame of %d bytes with %d left", n, len(data)-5)
+		}
+		messages = append(messages, hex.EncodeToString(data[5:5+n]))
+		data = data[5+n:]
+	}
+	if len(data) != 0 {
+		t.Errorf("got %d bytes after the last frame", len(data))
+	}
+	return resp, messages, nil
+}
+
+func TestGRPCFakes(t *testing.T) {
+	defaultHyjackTestSetup()
+	protos, err := loadDescriptorSets([]string{writeDescriptorSet(t, testDescriptorSet())})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	fakes := []*Fake{
+		{HyjackPath: "/test.v1.Items/List", GRPC: &FakeGRPC{
+			Messages: []json.RawMessage{json.RawMessage(`{"name": "a"}`), json.RawMessage(`{"name": "b"}`)},
+			Trailers: StringSlice{"X-Trace: abc"},
+		}},
+		{HyjackPath: "/test.v1.Items/Get", GRPC: &FakeGRPC{Status: "NOT_FOUND", Message: "no item 100%"}},
+		{HyjackPath: "/test.v1.Items/Missing", GRPC: &FakeGRPC{Messages: []json.RawMessage{json.RawMessage(`{}`)}}},
+	}
+	for _, fake := range fakes {
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+	}
+	updateConfig(func(c *Config) {
+		c.protos = protos
+		c.Fakes = append(c.Fakes, fakes...)
+	})
+
+	t.Log(">> verify gRPC fakes answer with their messages and an OK status")
+	{
+		resp, messages, err := grpcCall(t, "/test.v1.Items/List", nil)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := fmt.Sprintf("%s %d %s", resp.Proto, resp.StatusCode, resp.Header.Get("Content-Type")), "HTTP/2.0 200 application/grpc"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+		if got, want := strings.Join(messages, " "), "0a0161 0a0162"; got != want {
+			t.Errorf("got messages %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprintf("%s %s", resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("X-Trace")), "0 abc"; got != want {
+			t.Errorf("got trailers %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify gRPC fakes answer with error statuses")
+	{
+		resp, messages, err := grpcCall(t, "/test.v1.Items/Get", nil)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := len(messages), 0; got != want {
+			t.Errorf("got %d messages, want %d", got, want)
+		}
+		if got, want := fmt.Sprintf("%s %s", resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")), "5 no item 100%25"; got != want {
+			t.Errorf("got trailers %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify messages for methods missing from the descriptors answer INTERNAL")
+	{
+		resp, _, err := grpcCall(t, "/test.v1.Items/Missing", nil)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := resp.Trailer.Get("Grpc-Status"), "13"; got != want {
+			t.Errorf("got status %s, want %s", got, want)
+		}
+		if got, want := resp.Trailer.Get("Grpc-Message"), "no method /test.v1.Items/Missing"; !strings.Contains(got, want) {
+			t.Errorf("got message %q, want it to contain %q", got, want)
+		}
+	}
+
+	t.Log(">> verify faults reset HTTP/2 streams")
+	{
+		for _, fault := range []string{faultReset, faultTruncate} {
+			_, _, err := grpcCall(t, "/test.v1.Items/List", map[string]string{"X-Return-Fault": fault})
+			if err == nil {
+				t.Errorf("fault %s: got no error, want one", fault)
+			}
+		}
+	}
+}
+
+func TestGRPCProxy(t *testing.T) {
+	defaultHyjackTestSetup()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		io.Copy(w, r.Body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"X-Proto", r.Proto)
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	updateConfig(func(c *Config) {
+		c.ProxyHost = "http://127.0.0.1"
+		c.ProxyPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+	})
+
+	t.Log(">> verify gRPC calls are proxied over HTTP/2 with their trailers")
+	{
+		resp, messages, err := grpcCall(t, "/test.v1.Items/Get", map[string]string{"X-Request-Id": "grpc-proxied"})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := fmt.Sprintf("%d %q", len(messages), messages), `1 [""]`; got != want {
+			t.Errorf("got messages %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprintf("%s %s", resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("X-Proto")), "0 HTTP/2.0"; got != want {
+			t.Errorf("got trailers %s, want %s", got, want)
+		}
+		if got, want := harEntryFor(t, "grpc-proxied").Decision, "proxy"; got != want {
+			t.Errorf("got decision %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// The HTTP Archive (HAR) 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/.
+// Fields starting with an underscore are fakettp's own additions.
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+
+	RequestID string `json:"_requestId,omitempty"`
+	Decision  string `json:"_decision,omitempty"`
+	Fake      string `json:"_fake,omitempty"`
+
+	UpstreamHTTPVersion string `json:"_upstreamHttpVersion,omitempty"`
+
+	Violations []string          `json:"_violations,omitempty"`
+	Params     map[string]string `json:"_params,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"_encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// harTimings are in milliseconds. Blocked is the delay fakettp injected, and wait is the
+// time the upstream took to respond, so the two can be told apart; both are repeated in
+// the underscored fields.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+
+	InjectedDelay float64 `json:"_injectedDelay"`
+	Upstream      float64 `json:"_upstream"`
+}
+
+// newHAR converts journal entries to a HAR log
+func newHAR(entries []*journalEntry) *harFile {
+	h := &harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "fakettp", Version: "1.0"},
+		Entries: make([]harEntry, 0, len(entries)),
+	}}
+	for _, e := range entries {
+		h.Log.Entries = append(h.Log.Entries, newHAREntry(e))
+	}
+	return h
+}
+
+func newHAREntry(e *journalEntry) harEntry {
+	entry := harEntry{
+		StartedDateTime:     e.Started.Format(time.RFC3339Nano),
+		Time:                millis(e.Duration),
+		RequestID:           e.ID,
+		Decision:            e.Decision,
+		Fake:                e.Fake,
+		UpstreamHTTPVersion: e.UpstreamProto,
+		Violations:          e.Violations,
+		Params:              e.Params,
+		Request: harRequest{
+			Method:      e.Method,
+			URL:         e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(e.RequestHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    e.RequestBodySize,
+		},
+		Response: harResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Proto,
+			Cookies:     []harCookie{},
+			Headers:     harHeaders(e.ResponseHeader),
+			RedirectURL: e.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.ResponseBodySize,
+		},
+		Timings: harTimings{
+			Blocked:       millis(e.Delay),
+			DNS:           -1,
+			Connect:       -1,
+			SSL:           -1,
+			Wait:          millis(e.Upstream),
+			InjectedDelay: millis(e.Delay),
+			Upstream:      millis(e.Upstream),
+		},
+	}
+	// whatever is not delay or upstream time is spent receiving the response
+	if receive := millis(e.Duration - e.Delay - e.Upstream); receive > 0 {
+		entry.Timings.Receive = receive
+	}
+
+	if u, err := url.Parse(e.URL); err == nil {
+		query := u.Query()
+		keys := make([]string, 0, len(query))
+		for k := range query {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range query[k] {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: k, Value: v})
+			}
+		}
+	}
+	for _, c := range (&http.Request{Header: e.RequestHeader}).Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harCookie{Name: c.Name, Value: c.Value})
+	}
+	for _, c := range (&http.Response{Header: e.ResponseHeader}).Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harCookie{Name: c.Name, Value: c.Value})
+	}
+
+	if e.RequestBodySize > 0 {
+		text, encoding := harText(e.RequestBody)
+		entry.Request.PostData = &harPostData{MimeType: e.RequestHeader.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+
+	entry.Response.Content = harContent{Size: e.ResponseBodySize, MimeType: e.ResponseHeader.Get("Content-Type")}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(e.ResponseBody)
+	if int64(len(e.ResponseBody)) < e.ResponseBodySize {
+		entry.Response.Content.Comment = "body truncated to journal_body_limit"
+	}
+	return entry
+}
+
+// harHeaders flattens headers into sorted name/value pairs
+func harHeaders(h http.Header) []harNameValue {
+	pairs := []harNameValue{}
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+// harText returns the body as text, base64 encoded when it is not valid UTF-8
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harHandler serves the journal as a HAR file
+func harHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(newHAR(exchanges.list()))
+}
+
+// writeHARFile writes the journal to path as a HAR file
+func writeHARFile(path string) error {
+	data, err := json.MarshalIndent(newHAR(exchanges.list()), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// harEntryFor waits for the exchange with the request id to be recorded and returns it
+func harEntryFor(t *testing.T, id string) harEntry {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		adminMux().ServeHTTP(rec, httptest.NewRequest("GET", "/har", nil))
+		var h harFile
+		if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+			t.Fatalf("unable to parse HAR - %v", err)
+		}
+		if got, want := h.Log.Version, "1.2"; got != want {
+			t.Fatalf("got HAR version %s, want %s", got, want)
+		}
+		for _, entry := range h.Log.Entries {
+			if entry.RequestID == id {
+				return entry
+			}
+		}
+	}
+	t.Fatalf("no HAR entry for request %s", id)
+	return harEntry{}
+}
+
+func TestHARExport(t *testing.T) {
+	defaultHyjackTestSetup()
+
+	t.Log(">> verify hyjacked requests are exported with the injected delay")
+	{
+		doWithHeaders(t, "/har-fake?a=1", map[string]string{"X-Request-Id": "har-fake", "X-Return-Data": "faked", "X-Return-Delay": "20ms"})
+		entry := harEntryFor(t, "har-fake")
+		if got, want := entry.Decision, "x-return"; got != want {
+			t.Errorf("got decision %s, want %s", got, want)
+		}
+		if got, want := entry.Response.Content.Text, "faked"; got != want {
+			t.Errorf("got response text %q, want %q", got, want)
+		}
+		if got := entry.Timings.InjectedDelay; got < 20 {
+			t.Errorf("got injected delay %vms, want at least 20ms", got)
+		}
+		if got, want := entry.Timings.Upstream, 0.0; got != want {
+			t.Errorf("got upstream time %vms, want %vms", got, want)
+		}
+		if got, want := fmt.Sprint(entry.Request.QueryString), "[{a 1}]"; got != want {
+			t.Errorf("got query string %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify control headers and the header token are not recorded")
+	{
+		updateConfig(func(c *Config) {
+			c.HeaderToken = "secret"
+		})
+		doWithHeaders(t, "/har-token", map[string]string{"X-Request-Id": "har-token", "X-Return-Token": "secret", "X-Return-Code": "201", "X-Kept": "yes"})
+		var names []string
+		for _, h := range harEntryFor(t, "har-token").Request.Headers {
+			names = append(names, h.Name)
+		}
+		if got := strings.Join(names, " "); strings.Contains(got, "X-Return") || !strings.Contains(got, "X-Kept") {
+			t.Errorf("got recorded headers %s, want X-Kept without the X-Return-* ones", got)
+		}
+	}
+
+	t.Log(">> verify proxied requests are exported with their bodies and upstream time")
+	{
+		req, _ := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%d/har-proxy", currentConfig().Port), strings.NewReader("request body"))
+		req.Header.Set("X-Request-Id", "har-proxy")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		entry := harEntryFor(t, "har-proxy")
+		if got, want := entry.Decision, "proxy"; got != want {
+			t.Errorf("got decision %s, want %s", got, want)
+		}
+		if entry.Request.PostData == nil || entry.Request.PostData.Text != "request body" {
+			t.Errorf("got post data %+v, want the request body", entry.Request.PostData)
+		}
+		if got, want := entry.Response.Content.Text, "proxied"; got != want {
+			t.Errorf("got response text %q, want %q", got, want)
+		}
+		if entry.Timings.Upstream <= 0 {
+			t.Errorf("got upstream time %vms, want more than 0", entry.Timings.Upstream)
+		}
+	}
+}
+
+func TestWriteHARFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.har")
+	if err := writeHARFile(path); err != nil {
+		t.Fatalf("got error writing HAR - %v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	var h harFile
+	if err := json.Unmarshal(data, &h); err != nil {
+		t.Errorf("unable to parse written HAR - %v", err)
+	}
+}
+
+func TestConfigureJournal(t *testing.T) {
+	defer func(j *journal) { exchanges = j }(exchanges)
+
+	t.Log(">> verify the journal is only kept when something can read it")
+	{
+		for _, c := range []struct {
+			config   *Config
+			readable bool
+			want     int
+		}{
+			{&Config{}, false, 0},
+			{&Config{}, true, defaultJournalSize},
+			{&Config{JournalSize: 10}, true, 10},
+			{&Config{JournalSize: -1}, true, -1},
+		} {
+			configureJournal(c.config, c.readable)
+			if got := exchanges.size; got != c.want {
+				t.Errorf("got size %d for journal_size %d (readable %v), want %d", got, c.config.JournalSize, c.readable, c.want)
+			}
+		}
+	}
+
+	t.Log(">> verify nothing is captured when the journal is disabled")
+	{
+		j := newJournal(0, defaultJournalBodyLimit)
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader("order"))
+		body := req.Body
+		rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+		req, record := j.capture(req, rec, &requestLog{}, time.Now())
+		record()
+		if req.Body != body || rec.body != nil {
+			t.Errorf("got request body wrapped %t and response body captured %t, want neither", req.Body != body, rec.body != nil)
+		}
+		if got := len(j.list()); got != 0 {
+			t.Errorf("got %d entries, want none", got)
+		}
+	}
+}
+
+func TestJournalSize(t *testing.T) {
+	j := newJournal(2, 4)
+	for _, id := range []string{"a", "b", "c"} {
+		j.record(&journalEntry{ID: id})
+	}
+	entries := j.list()
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("got %d entries, want %d", got, want)
+	}
+	if got, want := entries[0].ID+entries[1].ID, "bc"; got != want {
+		t.Errorf("got entries %s, want %s", got, want)
+	}
+
+	buf := &limitedBuffer{limit: 4}
+	buf.Write([]byte("truncated"))
+	if got, want := buf.buf.String(), "trun"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if got, want := buf.size, int64(9); got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+}
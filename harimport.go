@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// harImportOptions choose how HAR entries become fakes
+type harImportOptions struct {
+	// match holds the request fields fakes match on: method, path, query and body. query
+	// matches the path with its query; without either, fakes match any path.
+	match map[string]bool
+
+	// duplicates says what to do with entries for the same request: sequence, first or last
+	duplicates string
+
+	// delays replays the recorded time of each entry as the response time
+	delays bool
+}
+
+// parseHARImportOptions reads the comma separated match fields and the duplicates mode
+func parseHARImportOptions(match string, duplicates string, delays bool) (*harImportOptions, error) {
+	opts := &harImportOptions{match: make(map[string]bool), duplicates: duplicates, delays: delays}
+	for _, field := range strings.Split(match, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "":
+		case "method", "path", "query", "body":
+			opts.match[field] = true
+		default:
+			return nil, fmt.Errorf("unknown HAR match field %q (want method, path, query or body)", field)
+		}
+	}
+	switch duplicates {
+	case "sequence", "first", "last":
+	default:
+		return nil, fmt.Errorf("unknown HAR duplicates mode %q (want sequence, first or last)", duplicates)
+	}
+	return opts, nil
+}
+
+// skippedHARHeaders describe the recorded transfer rather than the response, so they are
+// not replayed
+var skippedHARHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Date":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
+
+// fakesFromHAR creates a fake for each distinct request in the HAR data, in the order they
+// first appear. Entries without a response, such as aborted or blocked requests, are
+// skipped. The fakes still need to be prepared before use.
+func fakesFromHAR(data []byte, opts *harImportOptions) ([]*Fake, error) {
+	var h harFile
+	if err := json.Unmarshal(data, &h); err != nil {
+		return nil, fmt.Errorf("parsing HAR - %v", err)
+	}
+
+	var fakes []*Fake
+	byKey := make(map[string]*Fake)
+	for i, entry := range h.Log.Entries {
+		if entry.Response.Status == 0 {
+			logger.Warn("skipping HAR entry without a response", "entry", i, "method", entry.Request.Method, "url", entry.Request.URL)
+			continue
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing url of HAR entry %d - %v", i, err)
+		}
+
+		fake := &Fake{}
+		if opts.match["path"] {
+			fake.HyjackPath = u.Path
+			if fake.HyjackPath == "" {
+				fake.HyjackPath = "/"
+			}
+		}
+		if opts.match["query"] {
+			fake.HyjackPath = u.RequestURI()
+			fake.UseRequestURI = true
+		}
+		if opts.match["method"] {
+			fake.Methods = StringSlice{strings.ToUpper(entry.Request.Method)}
+		}
+		if opts.match["body"] && entry.Request.PostData != nil {
+			fake.RequestBodySubStr = entry.Request.PostData.Text
+		}
+		fake.Name = strings.TrimSpace(fmt.Sprintf("har: %s %s", strings.Join(fake.Methods, ","), fake.HyjackPath))
+
+		resp, err := harFakeResponse(entry, opts.delays)
+		if err != nil {
+			return nil, fmt.Errorf("HAR entry %d - %v", i, err)
+		}
+
+		key := strings.Join([]string{strings.Join(fake.Methods, ","), fake.HyjackPath, fake.RequestBodySubStr}, " ")
+		existing, ok := byKey[key]
+		switch {
+		case !ok:
+			fake.Sequence = []*FakeResponse{resp}
+			byKey[key] = fake
+			fakes = append(fakes, fake)
+		case opts.duplicates == "sequence":
+			existing.Sequence = append(existing.Sequence, resp)
+		case opts.duplicates == "last":
+			existing.Sequence = []*FakeResponse{resp}
+		}
+	}
+
+	// fakes with a single response don't need a sequence
+	for _, fake := range fakes {
+		if len(fake.Sequence) == 1 {
+			resp := fake.Sequence[0]
+			fake.ResponseBody, fake.ResponseBodyBase64 = resp.ResponseBody, resp.ResponseBodyBase64
+			fake.ResponseCode, fake.ResponseHeaders = resp.ResponseCode, resp.ResponseHeaders
+			fake.ResponseTimeRaw = resp.ResponseTimeRaw
+			fake.Sequence = nil
+		}
+	}
+	return fakes, nil
+}
+
+// harFakeResponse converts the recorded response of a HAR entry
+func harFakeResponse(entry harEntry, delays bool) (*FakeResponse, error) {
+	resp := &FakeResponse{ResponseCode: entry.Response.Status}
+	for _, header := range entry.Response.Headers {
+		if skippedHARHeaders[http.CanonicalHeaderKey(header.Name)] {
+			continue
+		}
+		resp.ResponseHeaders = append(resp.ResponseHeaders, header.Name+": "+header.Value)
+	}
+
+	content := entry.Response.Content
+	if content.Encoding == "base64" {
+		body, err := base64.StdEncoding.DecodeString(content.Text)
+		if err != nil {
+			return nil, fmt.Errorf("decoding response content - %v", err)
+		}
+		if utf8.Valid(body) {
+			resp.ResponseBody = string(body)
+		} else {
+			resp.ResponseBodyBase64 = content.Text
+		}
+	} else {
+		resp.ResponseBody = content.Text
+	}
+
+	if delays && entry.Time > 0 {
+		resp.ResponseTimeRaw = time.Duration(entry.Time * float64(time.Millisecond)).String()
+	}
+	return resp, nil
+}
+
+// importHAR reads the HAR file at path and creates its fakes
+func importHAR(path string, opts *harImportOptions) ([]*Fake, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return fakesFromHAR(data, opts)
+}
+
+// writeFakesConfig writes the fakes as a config file
+func writeFakesConfig(path string, fakes []*Fake) error {
+	config := struct {
+		Fakes []*Fake `json:"fakes"`
+	}{fakes}
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sampleHAR records two calls to /items, a search, an image and an aborted request
+const sampleHAR = `{"log": {"version": "1.2", "entries": [
+	{"time": -1, "request": {"method": "GET", "url": "http://example.com/items?aborted=1"},
+	 "response": {"status": 0, "content": {"text": ""}}},
+	{"time": 40, "request": {"method": "get", "url": "http://example.com/items?page=1"},
+	 "response": {"status": 200, "headers": [{"name": "Content-Type", "value": "application/json"}, {"name": "Content-Length", "value": "9"}], "content": {"text": "[\"first\"]"}}},
+	{"time": 10, "request": {"method": "GET", "url": "http://example.com/items?page=2"},
+	 "response": {"status": 503, "content": {"text": "busy"}}},
+	{"time": 5, "request": {"method": "POST", "url": "http://example.com/search", "postData": {"text": "{\"q\":\"cats\"}"}},
+	 "response": {"status": 201, "content": {"text": "Y2F0cw==", "encoding": "base64"}}},
+	{"time": 5, "request": {"method": "GET", "url": "http://example.com/logo.png"},
+	 "response": {"status": 200, "content": {"text": "iVBORw==", "encoding": "base64"}}}
+]}}`
+
+func importSampleHAR(t *testing.T, match, duplicates string, delays bool) []*Fake {
+	opts, err := parseHARImportOptions(match, duplicates, delays)
+	if err != nil {
+		t.Fatalf("got error parsing options - %v", err)
+	}
+	fakes, err := fakesFromHAR([]byte(sampleHAR), opts)
+	if err != nil {
+		t.Fatalf("got error importing HAR - %v", err)
+	}
+	for _, fake := range fakes {
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("got error preparing %s - %v", fake, err)
+		}
+	}
+	return fakes
+}
+
+func TestHARImport(t *testing.T) {
+	t.Log(">> verify entries for the same request become a sequence")
+	{
+		fakes := importSampleHAR(t, "method,path", "sequence", true)
+		if got, want := len(fakes), 3; got != want {
+			t.Fatalf("got %d fakes, want %d", got, want)
+		}
+		items := fakes[0]
+		if got, want := fmt.Sprintf("%s %v", items.HyjackPath, items.Methods), "/items [GET]"; got != want {
+			t.Errorf("got fake for %s, want %s", got, want)
+		}
+		if got, want := len(items.Sequence), 2; got != want {
+			t.Fatalf("got %d responses, want %d", got, want)
+		}
+		if got, want := items.Sequence[0].ResponseBody, `["first"]`; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(items.Sequence[0].ResponseHeaders), "[Content-Type: application/json]"; got != want {
+			t.Errorf("got headers %s, want %s", got, want)
+		}
+		if got, want := items.Sequence[1].ResponseTime.String(), "10ms"; got != want {
+			t.Errorf("got time %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify entries without a response are skipped")
+	{
+		for _, fake := range importSampleHAR(t, "method,query", "sequence", false) {
+			if fake.HyjackPath == "/items?aborted=1" {
+				t.Errorf("got fake %s for an aborted request with code %d, want none", fake, fake.ResponseCode)
+			}
+		}
+	}
+
+	t.Log(">> verify first and last keep a single response")
+	{
+		for duplicates, want := range map[string]int{"first": 200, "last": 503} {
+			fakes := importSampleHAR(t, "method,path", duplicates, false)
+			if got := fakes[0].ResponseCode; got != want || len(fakes[0].Sequence) != 0 {
+				t.Errorf("%s: got code %d with %d sequenced responses, want code %d", duplicates, got, len(fakes[0].Sequence), want)
+			}
+			if got := fakes[0].ResponseTime; got != 0 {
+				t.Errorf("%s: got time %s without har_delays, want none", duplicates, got)
+			}
+		}
+	}
+
+	t.Log(">> verify matching on query and body")
+	{
+		fakes := importSampleHAR(t, "method,query,body", "sequence", false)
+		if got, want := len(fakes), 4; got != want {
+			t.Fatalf("got %d fakes, want %d", got, want)
+		}
+		if got, want := fakes[1].HyjackPath, "/items?page=2"; got != want || !fakes[1].UseRequestURI {
+			t.Errorf("got hyjack %s (request_uri %t), want %s", got, fakes[1].UseRequestURI, want)
+		}
+		if got, want := fakes[2].RequestBodySubStr, `{"q":"cats"}`; got != want {
+			t.Errorf("got request body %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify leaving out the path matches any path")
+	{
+		fakes := importSampleHAR(t, "method,body", "sequence", false)
+		if got, want := len(fakes), 2; got != want {
+			t.Fatalf("got %d fakes, want %d", got, want)
+		}
+		if got, want := fmt.Sprintf("%q %d, %q %q", fakes[0].HyjackPath, len(fakes[0].Sequence), fakes[1].HyjackPath, fakes[1].RequestBodySubStr), `"" 3, "" "{\"q\":\"cats\"}"`; got != want {
+			t.Errorf("got fakes %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify base64 content is decoded, and kept encoded when binary")
+	{
+		fakes := importSampleHAR(t, "method,path", "sequence", false)
+		if got, want := fakes[1].ResponseBody, "cats"; got != want || fakes[1].ResponseBodyBase64 != "" {
+			t.Errorf("got body %q (base64 %q), want %q", got, fakes[1].ResponseBodyBase64, want)
+		}
+		if got, want := fakes[2].ResponseBodyBase64, "iVBORw=="; got != want {
+			t.Errorf("got body_base64 %q, want %q", got, want)
+		}
+		if got, want := fakes[2].ResponseBody, "\x89PNG"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify recorded header values with a \": \" of their own are served whole")
+	{
+		defaultHyjackTestSetup()
+		opts, _ := parseHARImportOptions("path", "sequence", false)
+		fakes, err := fakesFromHAR([]byte(`{"log": {"entries": [{"request": {"method": "GET", "url": "http://example.com/cached"},
+			"response": {"status": 200, "headers": [{"name": "X-Cache", "value": "edge: hit"}], "content": {"text": "ok"}}}]}}`), opts)
+		if err != nil || len(fakes) != 1 {
+			t.Fatalf("got %d fakes and error %v, want one fake", len(fakes), err)
+		}
+		if err := fakes[0].prepare(); err != nil {
+			t.Fatalf("got error preparing %s - %v", fakes[0], err)
+		}
+		updateConfig(func(c *Config) { c.Fakes = append(fakes, c.Fakes...) })
+		resp, _ := doWithHeaders(t, "/cached", nil)
+		if got, want := resp.Header.Get("X-Cache"), "edge: hit"; got != want {
+			t.Errorf("got X-Cache %q, want %q", got, want)
+		}
+		if got := checkHeader(fakes[0].ResponseHeaders[0]); got != "" {
+			t.Errorf("got problem %s, want none", got)
+		}
+	}
+
+	t.Log(">> verify bad options are rejected")
+	{
+		if _, err := parseHARImportOptions("method,headers", "sequence", false); err == nil {
+			t.Error("got no error for an unknown match field")
+		}
+		if _, err := parseHARImportOptions("path", "random", false); err == nil {
+			t.Error("got no error for an unknown duplicates mode")
+		}
+	}
+}
+
+func TestHARImportConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fakes.json")
+	if err := writeFakesConfig(path, importSampleHAR(t, "method,path", "sequence", false)); err != nil {
+		t.Fatalf("got error writing config - %v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("unable to parse written config - %v", err)
+	}
+	if got, want := len(config.Fakes), 3; got != want {
+		t.Fatalf("got %d fakes, want %d", got, want)
+	}
+	if got, want := len(config.Fakes[0].Sequence), 2; got != want {
+		t.Errorf("got %d sequenced responses, want %d", got, want)
+	}
+}
+
+func TestSequencedFake(t *testing.T) {
+	defaultHyjackTestSetup()
+	fake := &Fake{HyjackPath: "/sequenced", Sequence: []*FakeResponse{{ResponseCode: http.StatusServiceUnavailable}, {ResponseBody: "recovered"}}}
+	if err := fake.prepare(); err != nil {
+		t.Fatalf("got error preparing fake - %v", err)
+	}
+	updateConfig(func(c *Config) { c.Fakes = append(c.Fakes, fake) })
+
+	t.Log(">> verify sequenced responses are served in turn, repeating the last")
+	{
+		for _, want := range []string{"503 ", "200 recovered", "200 recovered"} {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/sequenced", currentConfig().Port))
+			if err != nil {
+				t.Fatalf("error performing HTTP request - %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := fmt.Sprintf("%d %s", resp.StatusCode, body); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		}
+	}
+
+	t.Log(">> verify sequence_loop starts over")
+	{
+		looped := &Fake{SequenceLoop: true, Sequence: []*FakeResponse{{ResponseBody: "a"}, {ResponseBody: "b"}}}
+		var got string
+		for i := 0; i < 5; i++ {
+			got += looped.nextResponse(nil).ResponseBody
+		}
+		if want := "ababa"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
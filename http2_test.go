@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 and its key to a temp dir,
+// returning their paths and a pool trusting the certificate
+func writeTestCert(t *testing.T) (certPath, keyPath string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key - %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fakettp test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate - %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to encode key - %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatalf("unable to write certificate - %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unable to write key - %v", err)
+	}
+	pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certPath, keyPath, pool
+}
+
+func TestHTTP2Listener(t *testing.T) {
+	defaultHyjackTestSetup()
+
+	t.Log(">> verify clients can speak HTTP/2 without TLS, and the protocol is recorded")
+	{
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/foo", currentConfig().Port), nil)
+		req.Header.Set("X-Request-Id", "h2c-proxied")
+		resp, err := h2cClient.Do(req)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		resp.Body.Close()
+		if got, want := resp.Proto, "HTTP/2.0"; got != want {
+			t.Errorf("got proto %s, want %s", got, want)
+		}
+		entry := harEntryFor(t, "h2c-proxied")
+		if got, want := fmt.Sprintf("%s %s", entry.Request.HTTPVersion, entry.UpstreamHTTPVersion), "HTTP/2.0 HTTP/1.1"; got != want {
+			t.Errorf("got versions %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify HTTP/2 is negotiated over TLS when a certificate is given")
+	{
+		certPath, keyPath, pool := writeTestCert(t)
+		server := newServer(&Config{TLSCert: certPath, TLSKey: keyPath})
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen - %v", err)
+		}
+		go server.ServeTLS(ln, certPath, keyPath)
+		defer server.Close()
+
+		for _, h2 := range []bool{true, false} {
+			transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, Protocols: new(http.Protocols)}
+			transport.Protocols.SetHTTP1(true)
+			transport.Protocols.SetHTTP2(h2)
+			id := fmt.Sprintf("tls-h2-%v", h2)
+			req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/bar", nil)
+			req.Header.Set("X-Request-Id", id)
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			resp.Body.Close()
+			want := "HTTP/1.1"
+			if h2 {
+				want = "HTTP/2.0"
+			}
+			if got := fmt.Sprintf("%s %d", resp.Proto, resp.StatusCode); got != want+" 418" {
+				t.Errorf("got %s, want %s 418", got, want)
+			}
+			if got := harEntryFor(t, id).Request.HTTPVersion; got != want {
+				t.Errorf("got recorded version %s, want %s", got, want)
+			}
+		}
+	}
+}
+
+func TestUpstreamHTTP2(t *testing.T) {
+	defaultHyjackTestSetup()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetHTTP1(true)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	for _, h2 := range []bool{false, true} {
+		updateConfig(func(c *Config) {
+			c.ProxyHost = "http://127.0.0.1"
+			c.ProxyPort = upstream.Listener.Addr().(*net.TCPAddr).Port
+			c.UpstreamHTTP2 = h2
+			c.transport = newUpstreamTransport(c)
+		})
+
+		t.Logf(">> verify upstream_http2 %v picks the protocol spoken to the upstream", h2)
+		want := "HTTP/1.1"
+		if h2 {
+			want = "HTTP/2.0"
+		}
+		id := fmt.Sprintf("upstream-h2-%v", h2)
+		_, body := doWithHeaders(t, "/foo", map[string]string{"X-Request-Id": id})
+		if got := body; got != want {
+			t.Errorf("got upstream proto %s, want %s", got, want)
+		}
+		if got := harEntryFor(t, id).UpstreamHTTPVersion; got != want {
+			t.Errorf("got recorded upstream version %s, want %s", got, want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -17,6 +18,19 @@ import (
 type testMux struct{}
 
 func (m *testMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/flaky":
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case "/slow":
+		time.Sleep(200 * time.Millisecond)
+	case "/headers":
+		// echo the request headers so tests can see what was proxied
+		req.Header.Write(w)
+		return
+	case "/ws":
+		(&FakeWebSocket{Echo: true}).serve(w, req)
+		return
+	}
 	w.Write([]byte("proxied"))
 }
 
@@ -44,22 +58,28 @@ func defaultHyjackTestSetup() {
 	var IsRegex bool
 	var UseRequestURI bool
 
-	GlobalConfig = populateGlobalConfig(getSampleConfig(), Port, ResponseCode, ResponseTime, ResponseBody, ResponseHeaders, Methods, RequestBodySubStr, HyjackPath, ProxyHost, ProxyPort, ProxyDelayTime, IsRegex, UseRequestURI)
+	storeConfig(populateGlobalConfig(getSampleConfig(), Port, ResponseCode, ResponseTime, ResponseBody, ResponseHeaders, Methods, RequestBodySubStr, HyjackPath, ProxyHost, ProxyPort, ProxyDelayTime, IsRegex, UseRequestURI))
 
 	if !serversStarted {
-		// start fakettp proxy and backing server
-		go startFakettp(GlobalConfig.Port)
-		go func() {
-			err := http.ListenAndServe(fmt.Sprintf(":%d", ProxyPort), &testMux{})
-			if err != nil {
-				fmt.Printf("error creating backing server for hyjack and proxy test - %v", err)
-				os.Exit(1)
-			}
-		}()
+		// the admin endpoints read the journal in tests
+		configureJournal(currentConfig(), true)
+		// both servers listen before they are used, so requests queue until they are served
+		servers, err := openServers(currentConfig())
+		if err != nil {
+			fmt.Printf("error creating fakettp for hyjack and proxy test - %v", err)
+			os.Exit(1)
+		}
+		backing, err := net.Listen("tcp", fmt.Sprintf(":%d", ProxyPort))
+		if err != nil {
+			fmt.Printf("error creating backing server for hyjack and proxy test - %v", err)
+			os.Exit(1)
+		}
+		for _, s := range servers {
+			go s.serve()
+		}
+		go http.Serve(backing, &testMux{})
 		serversStarted = true
 	}
-	// give the services time to start
-	time.Tick(150 * time.Millisecond)
 }
 
 func TestBackingServerSetup(t *testing.T) {
@@ -67,7 +87,7 @@ func TestBackingServerSetup(t *testing.T) {
 
 	t.Log(">> verify requests to backing server work")
 	{
-		resp, err := http.Get(fmt.Sprintf("http://%s:%d/foo", GlobalConfig.ProxyHost, GlobalConfig.ProxyPort))
+		resp, err := http.Get(fmt.Sprintf("http://%s:%d/foo", currentConfig().ProxyHost, currentConfig().ProxyPort))
 		if err != nil {
 			t.Fatalf("error getting url from backing service - %v", err)
 		}
@@ -84,7 +104,7 @@ func TestProxySetup(t *testing.T) {
 	defaultHyjackTestSetup()
 	t.Log(">> verify requests can be proxied")
 	{
-		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/foo", GlobalConfig.ProxyPort))
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/foo", currentConfig().ProxyPort))
 		if err != nil {
 			t.Fatalf("error getting url from proxy service - %v", err)
 		}
@@ -99,7 +119,7 @@ func TestHyjacking(t *testing.T) {
 	defaultHyjackTestSetup()
 	t.Log(">> verify requests can be hyjacked")
 	{
-		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/bar", GlobalConfig.Port))
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/bar", currentConfig().Port))
 		if err != nil {
 			t.Fatalf("error getting url from proxy service - %v", err)
 		}
@@ -120,7 +140,7 @@ func TestProxyBasedOnMethod(t *testing.T) {
 	defaultHyjackTestSetup()
 	t.Log(">> verify that only methods specified are hyjacked (post is not specified, should be proxied)")
 	{
-		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/bar", GlobalConfig.Port), "application/json", strings.NewReader("body!"))
+		resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/bar", currentConfig().Port), "application/json", strings.NewReader("body!"))
 		if err != nil {
 			t.Fatalf("error getting url from proxy service - %v", err)
 		}
@@ -135,10 +155,11 @@ func TestPatternMatching(t *testing.T) {
 	defaultHyjackTestSetup()
 	t.Log(">> verify requests can be hyjacked using pattern matching routes")
 	{
-		GlobalConfig.Fakes[len(GlobalConfig.Fakes)-1].HyjackPath = `\/api\/users\/[0-9]+\/credits.json`
-		GlobalConfig.Fakes[len(GlobalConfig.Fakes)-1].IsRegex = true
+		updateConfig(func(c *Config) {
+			c.Fakes[len(c.Fakes)-1] = &Fake{HyjackPath: `\/api\/users\/[0-9]+\/credits.json`, IsRegex: true, Methods: StringSlice{"GET"}, ResponseCode: http.StatusTeapot, ResponseBody: "hyjacked"}
+		})
 
-		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/users/1234/credits.json", GlobalConfig.Port))
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/users/1234/credits.json", currentConfig().Port))
 		if err != nil {
 			t.Fatalf("error getting url from proxy service - %v", err)
 		}
@@ -154,11 +175,11 @@ func TestRequestURI(t *testing.T) {
 	defaultHyjackTestSetup()
 	t.Log(">> verify requests can be hyjacked using query param")
 	{
-		GlobalConfig.Fakes[len(GlobalConfig.Fakes)-1].HyjackPath = `\/api\/users\/[0-9]+\/credits\.json\?foo`
-		GlobalConfig.Fakes[len(GlobalConfig.Fakes)-1].IsRegex = true
-		GlobalConfig.Fakes[len(GlobalConfig.Fakes)-1].UseRequestURI = true
+		updateConfig(func(c *Config) {
+			c.Fakes[len(c.Fakes)-1] = &Fake{HyjackPath: `\/api\/users\/[0-9]+\/credits\.json\?foo`, IsRegex: true, UseRequestURI: true, Methods: StringSlice{"GET"}, ResponseCode: http.StatusTeapot, ResponseBody: "hyjacked"}
+		})
 
-		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/users/1234/credits.json?foo", GlobalConfig.Port))
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/api/users/1234/credits.json?foo", currentConfig().Port))
 		if err != nil {
 			t.Fatalf("error getting url from proxy service - %v", err)
 		}
@@ -176,7 +197,7 @@ func TestPostBodyHyjacking(t *testing.T) {
 	dontCatchMe := "some other post body" // does not match config in sampleConfig() in config_test.go
 
 	t.Log(">> verify that we can match on post body")
-	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/api/post", GlobalConfig.Port), "text/plain", strings.NewReader(catchMe))
+	resp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/api/post", currentConfig().Port), "text/plain", strings.NewReader(catchMe))
 	if err != nil {
 		t.Fatalf("error getting url from proxy service - %v", err)
 	}
@@ -186,7 +207,7 @@ func TestPostBodyHyjacking(t *testing.T) {
 		t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
 	}
 	t.Log(">> verify that we can match still proxy on post body not matched")
-	resp, err = http.Post(fmt.Sprintf("http://127.0.0.1:%d/api/post", GlobalConfig.Port), "text/plain", strings.NewReader(dontCatchMe))
+	resp, err = http.Post(fmt.Sprintf("http://127.0.0.1:%d/api/post", currentConfig().Port), "text/plain", strings.NewReader(dontCatchMe))
 	if err != nil {
 		t.Fatalf("error getting url from proxy service - %v", err)
 	}
@@ -205,7 +226,7 @@ func TestXReturnOverride(t *testing.T) {
 	log.SetOutput(buf)
 	t.Log(">> verify X-Return-* overrides exiting config")
 	// Override an existing configured endpoint with X-Return-* values
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/bar", GlobalConfig.Port), nil)
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/bar", currentConfig().Port), nil)
 	if err != nil {
 		t.Fatalf("unable to set up request - %v", err)
 	}
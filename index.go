@@ -0,0 +1,257 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// fakeMatcher is a fake with its route compiled for matching
+type fakeMatcher struct {
+	fake *Fake
+	// pos is the fake's position in the config, as the first matching fake wins
+	pos   int
+	label string
+
+	regex *regexp.Regexp
+	path  *pathPattern
+	// prefix is the literal text every path the fake matches starts with, if known
+	prefix string
+	// invalid is set when the route does not compile, so the fake never matches
+	invalid bool
+	// methods are upper cased; nil matches any method
+	methods map[string]bool
+}
+
+// newFakeMatcher compiles the fake's route. A fake with an invalid route never matches.
+func newFakeMatcher(fake *Fake, pos int) *fakeMatcher {
+	m := &fakeMatcher{fake: fake, pos: pos, label: fake.label(pos)}
+	var err error
+	switch {
+	case fake.Path != "":
+		if m.path, err = compilePathPattern(fake.Path); err == nil {
+			m.prefix = m.path.prefix
+		}
+	case fake.IsRegex && fake.HyjackPath != "":
+		if m.regex, err = regexp.Compile(fake.HyjackPath); err == nil {
+			m.prefix = anchoredPrefix(fake.HyjackPath)
+		}
+	}
+	if err != nil {
+		logger.Error("fake never matches, its route is invalid", "fake", m.label, "error", err)
+		m.invalid = true
+	}
+	if len(fake.Methods) > 0 {
+		m.methods = make(map[string]bool, len(fake.Methods))
+		for _, method := range fake.Methods {
+			m.methods[strings.ToUpper(method)] = true
+		}
+	}
+	return m
+}
+
+// anchoredPrefix returns the literal text a regular expression anchored with ^ requires
+// matches to start with, as in ^/api/users/[0-9]+ which requires /api/users/
+func anchoredPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	if lit := re.Sub[1]; lit.Op == syntax.OpLiteral && lit.Flags&syntax.FoldCase == 0 {
+		return string(lit.Rune)
+	}
+	return ""
+}
+
+// exact reports if the fake only matches a single path, which is then its hyjack route
+func (m *fakeMatcher) exact() bool {
+	return !m.invalid && m.regex == nil && m.path == nil && m.fake.HyjackPath != ""
+}
+
+// anyMethod reports if the fake matches regardless of the method. A fake with a request_body
+// matches on the body alone.
+func (m *fakeMatcher) anyMethod() bool {
+	return m.methods == nil || m.fake.RequestBodySubStr != ""
+}
+
+// match reports if the fake matches the request, with the params its path template
+// captured. body is only called for fakes matching on the request body.
+func (m *fakeMatcher) match(r *http.Request, body func() string) (map[string]string, bool) {
+	if m.invalid {
+		return nil, false
+	}
+	path := r.URL.Path
+	if m.fake.UseRequestURI {
+		path = r.RequestURI
+	}
+
+	var params map[string]string
+	switch {
+	case m.path != nil:
+		var ok bool
+		if params, ok = m.path.match(path); !ok {
+			return nil, false
+		}
+	case m.regex != nil:
+		if !m.regex.MatchString(path) {
+			return nil, false
+		}
+	case m.fake.HyjackPath != "" && m.fake.HyjackPath != path:
+		return nil, false
+	}
+
+	if m.fake.RequestBodySubStr != "" {
+		return params, strings.Contains(body(), m.fake.RequestBodySubStr)
+	}
+	if !m.anyMethod() && !m.methods[strings.ToUpper(r.Method)] {
+		return nil, false
+	}
+	return params, true
+}
+
+// prefixIndex holds fakes by the literal prefix of the paths they match, so only the fakes
+// whose prefix a path starts with are tried
+type prefixIndex struct {
+	byPrefix map[string][]*fakeMatcher
+	// lengths are the lengths of the prefixes, ascending
+	lengths []int
+}
+
+func (p *prefixIndex) add(m *fakeMatcher) {
+	if p.byPrefix == nil {
+		p.byPrefix = make(map[string][]*fakeMatcher)
+	}
+	if i := sort.SearchInts(p.lengths, len(m.prefix)); i == len(p.lengths) || p.lengths[i] != len(m.prefix) {
+		p.lengths = append(p.lengths, len(m.prefix))
+		sort.Ints(p.lengths)
+	}
+	p.byPrefix[m.prefix] = append(p.byPrefix[m.prefix], m)
+}
+
+// collect adds the lists of fakes whose prefix the path starts with
+func (p *prefixIndex) collect(path string, lists [][]*fakeMatcher) [][]*fakeMatcher {
+	for _, n := range p.lengths {
+		if n > len(path) {
+			break
+		}
+		if list := p.byPrefix[path[:n]]; len(list) > 0 {
+			lists = append(lists, list)
+		}
+	}
+	return lists
+}
+
+// fakeIndex finds the first fake matching a request without trying each fake in turn.
+// Fakes with an exact hyjack route are looked up by path, then by method. Fakes with a
+// pattern, a path template or no route are looked up by the literal prefix of the paths
+// they match, and then tried one by one.
+type fakeIndex struct {
+	// fakes are the fakes the index was built from
+	fakes []*Fake
+
+	// exact and exactURI hold the fakes with an exact route, matched against the path or
+	// the request uri, by route and then by method ("" for fakes matching any method)
+	exact    map[string]map[string][]*fakeMatcher
+	exactURI map[string]map[string][]*fakeMatcher
+	// dynamic and dynamicURI hold the other fakes
+	dynamic    prefixIndex
+	dynamicURI prefixIndex
+
+	// fallbacks hold the fallback fakes, which only apply once the upstream failed
+	fallbacks []*fakeMatcher
+	// fallbackBody is set when a fallback fake matches on the request body
+	fallbackBody bool
+}
+
+func newFakeIndex(fakes []*Fake) *fakeIndex {
+	return newLabelledFakeIndex(fakes, "")
+}
+
+// newLabelledFakeIndex indexes fakes whose labels in logs and metrics start with prefix
+func newLabelledFakeIndex(fakes []*Fake, prefix string) *fakeIndex {
+	idx := &fakeIndex{
+		fakes:    fakes,
+		exact:    make(map[string]map[string][]*fakeMatcher),
+		exactURI: make(map[string]map[string][]*fakeMatcher),
+	}
+	for i, fake := range fakes {
+		m := newFakeMatcher(fake, i)
+		m.label = prefix + m.label
+		if fake.Fallback {
+			idx.fallbacks = append(idx.fallbacks, m)
+			idx.fallbackBody = idx.fallbackBody || fake.RequestBodySubStr != ""
+			continue
+		}
+		if !m.exact() {
+			if fake.UseRequestURI {
+				idx.dynamicURI.add(m)
+			} else {
+				idx.dynamic.add(m)
+			}
+			continue
+		}
+
+		routes := idx.exact
+		if fake.UseRequestURI {
+			routes = idx.exactURI
+		}
+		byMethod := routes[fake.HyjackPath]
+		if byMethod == nil {
+			byMethod = make(map[string][]*fakeMatcher)
+			routes[fake.HyjackPath] = byMethod
+		}
+		if m.anyMethod() {
+			byMethod[""] = append(byMethod[""], m)
+			continue
+		}
+		for method := range m.methods {
+			byMethod[method] = append(byMethod[method], m)
+		}
+	}
+	return idx
+}
+
+// lookup returns the first fake in config order matching the request, with the params its
+// path template captured. body is only called for candidates matching on the request body,
+// and may be called for several of them.
+func (idx *fakeIndex) lookup(r *http.Request, body func() string) (*fakeMatcher, map[string]string) {
+	method := strings.ToUpper(r.Method)
+	byPath, byURI := idx.exact[r.URL.Path], idx.exactURI[r.RequestURI]
+	lists := make([][]*fakeMatcher, 0, 8)
+	lists = append(lists, byPath[method], byPath[""], byURI[method], byURI[""])
+	lists = idx.dynamic.collect(r.URL.Path, lists)
+	lists = idx.dynamicURI.collect(r.RequestURI, lists)
+
+	// each list is in config order, so merging them tries the candidates in config order
+	for {
+		next := -1
+		for i, list := range lists {
+			if len(list) > 0 && (next < 0 || list[0].pos < lists[next][0].pos) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil, nil
+		}
+		m := lists[next][0]
+		lists[next] = lists[next][1:]
+		if params, ok := m.match(r, body); ok {
+			return m, params
+		}
+	}
+}
+
+// fakeIndex returns the index of the config's fakes, built when the config was stored.
+// Configs that were never stored are indexed on each call.
+func (c *Config) fakeIndex() *fakeIndex {
+	if c.index == nil {
+		return newFakeIndex(c.Fakes)
+	}
+	return c.index
+}
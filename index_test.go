@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFakeIndex(t *testing.T) {
+	fakes := []*Fake{
+		{Name: "post-users", HyjackPath: "/users", Methods: StringSlice{"post"}},
+		{Name: "pattern", HyjackPath: "^/users/[0-9]+$", IsRegex: true},
+		{Name: "user-1", HyjackPath: "/users/1"},
+		{Name: "fallback", HyjackPath: "/users", Fallback: true},
+		{Name: "body", HyjackPath: "/search", Methods: StringSlice{"GET"}, RequestBodySubStr: "needle"},
+		{Name: "uri", HyjackPath: "/search?q=x", UseRequestURI: true},
+		{Name: "template", Path: "/orders/{id:int}"},
+		{Name: "any-users", HyjackPath: "/users"},
+		{Name: "unanchored", HyjackPath: `\/items\/[0-9]+`, IsRegex: true},
+		{Name: "prefixed", HyjackPath: `^/api/(v1|v2)/items`, IsRegex: true},
+		{Name: "catch-all", Methods: StringSlice{"DELETE"}},
+	}
+	idx := newFakeIndex(fakes)
+
+	cases := []struct {
+		method, uri, body string
+		want              string
+		params            string
+		readsBody         bool
+	}{
+		{"POST", "/users", "", "post-users", "map[]", false},
+		{"GET", "/users", "", "any-users", "map[]", false},
+		{"GET", "/users/1", "", "pattern", "map[]", false},
+		{"POST", "/search", "a needle", "body", "map[]", true},
+		{"GET", "/search?q=x", "hay", "uri", "map[]", true},
+		{"GET", "/orders/7", "", "template", "map[id:7]", false},
+		{"GET", "/shop/items/3", "", "unanchored", "map[]", false},
+		{"GET", "/api/v2/items", "", "prefixed", "map[]", false},
+		{"DELETE", "/anything", "", "catch-all", "map[]", false},
+		{"GET", "/anything", "", "", "map[]", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.uri, strings.NewReader(c.body))
+		reads := 0
+		m, params := idx.lookup(r, func() string {
+			reads++
+			return c.body
+		})
+		got := ""
+		if m != nil {
+			got = m.label
+		}
+		if got != c.want || fmt.Sprint(params) != c.params {
+			t.Errorf("%s %s: got fake %q with params %v, want %q with %s", c.method, c.uri, got, params, c.want, c.params)
+		}
+		if (reads > 0) != c.readsBody {
+			t.Errorf("%s %s: read the body %d times, want reads %t", c.method, c.uri, reads, c.readsBody)
+		}
+	}
+
+	if got, want := len(idx.fallbacks), 1; got != want || idx.fallbacks[0].label != "fallback" {
+		t.Errorf("got %d fallbacks, want %d", got, want)
+	}
+}
+
+func TestAnchoredPrefix(t *testing.T) {
+	for pattern, want := range map[string]string{
+		`^/api/users/[0-9]+$`:   "/api/users/",
+		`^\/api\/users\/[0-9]+`: "/api/users/",
+		`\/api\/users`:          "",
+		`^/a|^/b`:               "",
+		`(?i)^/api`:             "",
+		`(?m)^/api`:             "",
+		`^(/api)`:               "",
+	} {
+		if got := anchoredPrefix(pattern); got != want {
+			t.Errorf("%s: got prefix %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+// benchmarkFakes returns n fakes, a mix of exact routes, patterns and path templates
+func benchmarkFakes(n int) []*Fake {
+	fakes := make([]*Fake, 0, n)
+	for i := 0; i < n; i++ {
+		fake := &Fake{ResponseCode: http.StatusOK, ResponseBody: "hyjacked"}
+		switch i % 4 {
+		case 0, 1:
+			fake.HyjackPath = fmt.Sprintf("/api/v1/resource%d", i)
+			fake.Methods = StringSlice{"GET"}
+		case 2:
+			fake.HyjackPath, fake.IsRegex = fmt.Sprintf(`^/api/v2/resource%d/[0-9]+$`, i), true
+		case 3:
+			fake.Path = fmt.Sprintf("/api/v3/resource%d/{id:int}", i)
+		}
+		fakes = append(fakes, fake)
+	}
+	return fakes
+}
+
+// benchmarkPaths are requests matching the last fakes, and none
+var benchmarkPaths = []struct{ name, path string }{
+	{"exact", "/api/v1/resource997"},
+	{"pattern", "/api/v2/resource998/42"},
+	{"template", "/api/v3/resource999/42"},
+	{"miss", "/api/v4/unknown"},
+}
+
+func BenchmarkFakeIndexLookup1k(b *testing.B) {
+	idx := newFakeIndex(benchmarkFakes(1000))
+	for _, p := range benchmarkPaths {
+		b.Run(p.name, func(b *testing.B) {
+			r := httptest.NewRequest("GET", p.path, nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				idx.lookup(r, nil)
+			}
+		})
+	}
+}
+
+func BenchmarkHandler1kFakes(b *testing.B) {
+	saved, savedLogger := currentConfig(), logger
+	defer func() { logger = savedLogger; liveConfig.Store(saved) }()
+	storeConfig(&Config{Fakes: benchmarkFakes(1000)})
+	logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	exchanges.size = 0
+	defer func() { exchanges.size = defaultJournalSize }()
+
+	for _, p := range benchmarkPaths[:3] {
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rec := httptest.NewRecorder()
+					defaultHandler(rec, httptest.NewRequest("GET", p.path, nil))
+					if rec.Code != http.StatusOK {
+						b.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJournalSize      = 1000
+	defaultJournalBodyLimit = 64 * 1024
+)
+
+// journalEntry is a captured exchange, proxied or hyjacked
+type journalEntry struct {
+	ID       string
+	Started  time.Time
+	Duration time.Duration
+	Decision string
+	Fake     string
+
+	// Delay is the injected delay, Upstream the time for the upstream to respond
+	Delay    time.Duration
+	Upstream time.Duration
+	// UpstreamProto is the protocol the upstream answered with
+	UpstreamProto string
+
+	// Violations of the OpenAPI contract, when validating
+	Violations []string
+	// Params captured by the path template of the fake that answered
+	Params map[string]string
+
+	Method          string
+	URL             string
+	Proto           string
+	RequestHeader   http.Header
+	RequestBody     []byte
+	RequestBodySize int64
+
+	Status           int
+	ResponseHeader   http.Header
+	ResponseBody     []byte
+	ResponseBodySize int64
+}
+
+// journal keeps the most recent exchanges, up to its size
+type journal struct {
+	mu      sync.Mutex
+	size    int
+	entries []*journalEntry
+
+	// bodyLimit caps the bytes of each request and response body kept
+	bodyLimit int
+}
+
+// exchanges is the global journal. It keeps nothing until configureJournal turns it on.
+var exchanges = newJournal(0, defaultJournalBodyLimit)
+
+func newJournal(size, bodyLimit int) *journal {
+	return &journal{size: size, bodyLimit: bodyLimit}
+}
+
+// configureJournal sizes the global journal from the config. Exchanges are only kept when
+// something can read them, the admin port or a HAR written on shutdown, so readable turns
+// the journal on.
+func configureJournal(c *Config, readable bool) {
+	size, bodyLimit := c.JournalSize, c.JournalBodyLimit
+	if size == 0 {
+		size = defaultJournalSize
+	}
+	if bodyLimit == 0 {
+		bodyLimit = defaultJournalBodyLimit
+	}
+	if !readable {
+		size = 0
+	}
+	exchanges = newJournal(size, bodyLimit)
+}
+
+func (j *journal) record(e *journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.size <= 0 {
+		return
+	}
+	if len(j.entries) >= j.size {
+		// drop the oldest entry
+		copy(j.entries, j.entries[1:])
+		j.entries = j.entries[:len(j.entries)-1]
+	}
+	j.entries = append(j.entries, e)
+}
+
+// list returns the recorded entries, oldest first
+func (j *journal) list() []*journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]*journalEntry(nil), j.entries...)
+}
+
+// capture starts capturing the request body as it is read, returning the request to
+// handle and a func that records the exchange once it is complete. The request headers are
+// recorded as the upstream would see them, without the control headers and the token.
+// Nothing is captured when the journal is disabled.
+func (j *journal) capture(r *http.Request, rec *statusRecorder, rl *requestLog, start time.Time) (*http.Request, func()) {
+	if j.size <= 0 {
+		return r, func() {}
+	}
+	e := &journalEntry{
+		ID:            rl.id,
+		Started:       start,
+		Method:        r.Method,
+		URL:           requestURL(r),
+		Proto:         r.Proto,
+		RequestHeader: r.Header.Clone(),
+	}
+	requestConfig(r).stripControlHeaders(e.RequestHeader)
+
+	var reqBody *limitedBuffer
+	if r.Body != nil && r.Body != http.NoBody {
+		reqBody = &limitedBuffer{limit: j.bodyLimit}
+		r.Body = &captureReader{ReadCloser: r.Body, body: reqBody}
+	}
+	rec.body = &limitedBuffer{limit: j.bodyLimit}
+
+	return r, func() {
+		e.Duration = time.Since(start)
+		e.Decision, e.Fake = rl.decision, rl.fake
+		e.Delay, e.Upstream, e.UpstreamProto = rl.delay, rl.upstream, rl.upstreamProto
+		e.Violations = rl.violations
+		e.Params = rl.params
+		if reqBody != nil {
+			e.RequestBody, e.RequestBodySize = reqBody.buf.Bytes(), reqBody.size
+		}
+		e.Status = rec.status
+		e.ResponseHeader = rec.header
+		e.ResponseBody, e.ResponseBodySize = rec.body.buf.Bytes(), rec.body.size
+		j.record(e)
+	}
+}
+
+// requestURL rebuilds the absolute URL the client requested
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.RequestURI
+}
+
+// limitedBuffer keeps the first limit bytes written to it, and counts them all
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+	size  int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if room := b.limit - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// captureReader keeps a copy of what is read from a request body
+type captureReader struct {
+	io.ReadCloser
+	body *limitedBuffer
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.body.Write(p[:n])
+	return n, err
+}
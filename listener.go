@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// mainListener labels the metrics of the top level port
+const mainListener = "main"
+
+// Listener is another port fakettp opens, fronting its own upstream with its own fakes.
+// The other settings, such as proxy timeouts and header overrides, are the top level ones.
+type Listener struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+	// Bind is the address to listen on, all interfaces by default
+	Bind          string  `json:"bind"`
+	TLSCert       string  `json:"tls_cert"`
+	TLSKey        string  `json:"tls_key"`
+	ProxyHost     string  `json:"proxy_host"`
+	ProxyPort     int     `json:"proxy_port"`
+	UpstreamHTTP2 bool    `json:"upstream_http2"`
+	Fakes         []*Fake `json:"fakes"`
+
+	// transport and grpcTransport reach ProxyHost. They are made once, so connections to
+	// the upstream are kept across config updates.
+	transport     http.RoundTripper
+	grpcTransport http.RoundTripper
+}
+
+// prepare checks the listener, prepares its fakes and makes its transports with the top
+// level proxy settings. The proxy port defaults to the one of the proxy host's scheme.
+func (l *Listener) prepare(c *Config) error {
+	if l.Name == "" {
+		return errors.New("a listener needs a name")
+	}
+	if l.Name == mainListener || l.Name == adminServer {
+		return fmt.Errorf("the name %s is reserved", l.Name)
+	}
+	if l.Port == 0 {
+		return errors.New("a listener needs a port")
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be given together")
+	}
+	if l.ProxyPort == 0 {
+		l.ProxyPort = 80
+		if strings.HasPrefix(l.ProxyHost, "https://") {
+			l.ProxyPort = 443
+		}
+	}
+	for i, fake := range l.Fakes {
+		log.Printf("creating hyjack %s on listener %s", fake, l.Name)
+		if err := fake.prepare(); err != nil {
+			return fmt.Errorf("fakes[%d]: %v", i, err)
+		}
+	}
+
+	upstream := *c
+	upstream.UpstreamHTTP2 = l.UpstreamHTTP2
+	l.transport = newUpstreamTransport(&upstream)
+	l.grpcTransport = newGRPCTransport(&upstream)
+	return nil
+}
+
+// forListener returns the config the listener's requests are served with: c, with the
+// listener's address, upstream and fakes. The OpenAPI contract describes the top level
+// upstream, so listeners are not validated against it.
+func (c *Config) forListener(l *Listener) *Config {
+	lc := *c
+	lc.Listeners, lc.listeners = nil, nil
+	lc.validator = nil
+	lc.listener = l.Name
+	lc.Port, lc.Bind = l.Port, l.Bind
+	lc.TLSCert, lc.TLSKey = l.TLSCert, l.TLSKey
+	lc.ProxyHost, lc.ProxyPort, lc.UpstreamHTTP2 = l.ProxyHost, l.ProxyPort, l.UpstreamHTTP2
+	lc.transport, lc.grpcTransport = l.transport, l.grpcTransport
+	lc.Fakes = l.Fakes
+	lc.index = newFakeIndex(l.Fakes)
+	return &lc
+}
+
+// listenerConfig returns the config of the named listener, or c itself for the top level
+// port and for listeners it does not have
+func (c *Config) listenerConfig(name string) *Config {
+	if lc, ok := c.listeners[name]; ok {
+		return lc
+	}
+	return c
+}
+
+// listenerName is the name the config's requests are labelled with
+func (c *Config) listenerName() string {
+	if c.listener == "" {
+		return mainListener
+	}
+	return c.listener
+}
+
+type listenerKey struct{}
+
+// requestListener returns the name of the listener the request came in on, empty for the
+// top level port
+func requestListener(r *http.Request) string {
+	name, _ := r.Context().Value(listenerKey{}).(string)
+	return name
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListeners(t *testing.T) {
+	defaultHyjackTestSetup()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("billing upstream"))
+	}))
+	defer upstream.Close()
+
+	updateConfig(func(c *Config) {
+		l := &Listener{
+			Name:      "billing",
+			Port:      4334,
+			ProxyHost: "http://127.0.0.1",
+			ProxyPort: upstream.Listener.Addr().(*net.TCPAddr).Port,
+			Fakes:     []*Fake{{HyjackPath: "/invoices", ResponseCode: http.StatusCreated, ResponseBody: "invoices"}},
+		}
+		if err := l.prepare(c); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		c.Listeners = []*Listener{l}
+	})
+	server := newServer(currentConfig().listenerConfig("billing"))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen - %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	buf := &syncBuffer{}
+	defaultLogger := logger
+	logger = slog.New(slog.NewJSONHandler(buf, nil))
+	defer func() { logger = defaultLogger }()
+
+	get := func(addr, path string, headers map[string]string) string {
+		req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+		req.Header.Set("X-Request-Id", "listener"+strings.ReplaceAll(path, "/", "-"))
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, body)
+	}
+	before := metrics.fakeRequests.value("billing", "fakes[0]")
+
+	t.Log(">> verify a listener answers with its own fakes and upstream")
+	{
+		if got, want := get(ln.Addr().String(), "/invoices", nil), "201 invoices"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+		if got, want := get(ln.Addr().String(), "/bar", nil), "200 billing upstream"; got != want {
+			t.Errorf("got %s for a path only faked on the main port, want %s", got, want)
+		}
+		if got, want := get(fmt.Sprintf("127.0.0.1:%d", currentConfig().Port), "/invoices", nil), "200 proxied"; got != want {
+			t.Errorf("got %s for the listener's fake on the main port, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify the listener's logs and metrics are labelled with its name")
+	{
+		for deadline := time.Now().Add(time.Second); metrics.fakeRequests.value("billing", "fakes[0]") < before+1 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, want := metrics.fakeRequests.value("billing", "fakes[0]"), before+1; got != want {
+			t.Errorf("got %v requests for the listener's fake, want %v", got, want)
+		}
+
+		labelled := false
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("unable to parse log line %q - %v", line, err)
+			}
+			if entry["msg"] == "request complete" && entry["request_id"] == "listener-invoices" {
+				if entry["listener"] == "billing" {
+					labelled = true
+				} else if entry["listener"] != nil {
+					t.Errorf("got listener %v for a request to the main port", entry["listener"])
+				}
+			}
+		}
+		if !labelled {
+			t.Errorf("got no request complete line labelled billing\nlogs:\n%s", buf.String())
+		}
+	}
+
+	t.Log(">> verify sticky overrides and the OpenAPI contract of the main port stay off the listener")
+	{
+		main := fmt.Sprintf("127.0.0.1:%d", currentConfig().Port)
+		sticky := map[string]string{"X-Return-Code": "503", "X-Return-Data": "down", "X-Return-Times": "2"}
+		if got, want := get(ln.Addr().String(), "/invoices", sticky), "503 down"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+		if got, want := get(main, "/invoices", nil), "200 proxied"; got != want {
+			t.Errorf("got %s on the main port for an override set on the listener, want %s", got, want)
+		}
+		if got, want := get(ln.Addr().String(), "/invoices", nil), "503 down"; got != want {
+			t.Errorf("got %s, want the kept override %s", got, want)
+		}
+
+		doc, _ := parseOpenAPI([]byte(contractOpenAPI))
+		updateConfig(func(c *Config) {
+			c.validator = newContractValidator(doc, true)
+		})
+		if got, want := get(main, "/invoices", nil), "400"; !strings.HasPrefix(got, want) {
+			t.Errorf("got %s on the main port, want a strict %s", got, want)
+		}
+		if got, want := get(ln.Addr().String(), "/invoices", nil), "201 invoices"; got != want {
+			t.Errorf("got %s on the listener, want %s", got, want)
+		}
+	}
+}
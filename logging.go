@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// logWriter forwards to the log package's current output, so log.SetOutput also applies
+// to the request logs until main configures logging
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+// logger writes the structured logs. Each request gets its own child logger carrying the
+// request fields, see requestLog.
+var logger = slog.New(slog.NewTextHandler(logWriter{}, nil))
+
+// setupLogging sets the log format (text or json) and the minimum level (debug, info, warn
+// or error). Log lines from the log package are sent through the same handler.
+func setupLogging(format, level string, out io.Writer) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	return nil
+}
+
+// requestLog is the logger for a single request, along with the outcome that is logged
+// once the request completes
+type requestLog struct {
+	*slog.Logger
+
+	id       string
+	decision string
+	fake     string
+	// listener is the name of the listener the request came in on, see Listener
+	listener string
+
+	// delay is the injected delay, upstream the time for the upstream to respond
+	delay    time.Duration
+	upstream time.Duration
+	// upstreamProto is the protocol the upstream answered with, such as HTTP/2.0
+	upstreamProto string
+	// violations of the OpenAPI contract, see contractValidator
+	violations []string
+	// params captured by the path template of the fake that answered
+	params map[string]string
+}
+
+type requestLogKey struct{}
+
+// newRequestLog creates the logger for a request, using the incoming X-Request-Id when
+// present. The id is echoed back in the response.
+func newRequestLog(w http.ResponseWriter, r *http.Request) (*requestLog, *http.Request) {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		// padding and leading zeros keep ids the same width
+		id = fmt.Sprintf("%07x", rand.Int31n(1e8))
+		r.Header.Set("X-Request-Id", id)
+	}
+	w.Header().Set("X-Request-Id", id)
+
+	attrs := []any{"request_id", id, "method", r.Method, "path", r.URL.Path, "proto", r.Proto}
+	config := requestConfig(r)
+	if config.listener != "" {
+		attrs = append(attrs, "listener", config.listener)
+	}
+	rl := &requestLog{
+		Logger:   logger.With(attrs...),
+		id:       id,
+		listener: config.listenerName(),
+	}
+	return rl, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+}
+
+// reqLog returns the logger for the request. Requests that did not go through the
+// handler log without request fields.
+func reqLog(r *http.Request) *requestLog {
+	if r != nil {
+		if rl, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+			return rl
+		}
+	}
+	return &requestLog{Logger: logger}
+}
+
+// decide records how the request was answered: fake, fallback, x-return, invalid or proxy
+func (rl *requestLog) decide(decision string, fake string) {
+	rl.decision = decision
+	rl.fake = fake
+}
+
+// complete logs the outcome of the request and records it in the metrics
+func (rl *requestLog) complete(status int, start time.Time) {
+	duration := time.Since(start)
+	attrs := []any{"decision", rl.decision, "status", status, "duration_ms", float64(duration) / float64(time.Millisecond)}
+	if rl.fake != "" {
+		attrs = append(attrs, "fake", rl.fake)
+	}
+	if rl.upstreamProto != "" {
+		attrs = append(attrs, "upstream_proto", rl.upstreamProto)
+	}
+	rl.Info("request complete", attrs...)
+	metrics.observeRequest(rl, status, duration)
+}
+
+// statusRecorder remembers the status code and headers written to the response, and
+// keeps a copy of the body when body is set
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   *limitedBuffer
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+		s.header = s.ResponseWriter.Header().Clone()
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.body != nil {
+		s.body.Write(p)
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to write from the server while a test reads it
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestLogs(t *testing.T) {
+	defaultHyjackTestSetup()
+	buf := &syncBuffer{}
+	defaultLogger := logger
+	logger = slog.New(slog.NewJSONHandler(buf, nil))
+	defer func() { logger = defaultLogger }()
+
+	t.Log(">> verify concurrent requests log their own request id and outcome")
+	var wg sync.WaitGroup
+	for id, path := range map[string]string{"fake-id": "/bar", "proxy-id": "/foo"} {
+		wg.Add(1)
+		go func(id, path string) {
+			defer wg.Done()
+			resp, _ := doWithHeaders(t, path, map[string]string{"X-Request-Id": id})
+			if got, want := resp.Header.Get("X-Request-Id"), id; got != want {
+				t.Errorf("got X-Request-Id %q, want %q", got, want)
+			}
+		}(id, path)
+	}
+	wg.Wait()
+
+	want := map[string]string{"fake-id": "fake", "proxy-id": "proxy"}
+	got := make(map[string]string)
+	// the outcome is logged once the handler returns, which can trail the response
+	for deadline := time.Now().Add(time.Second); len(got) < len(want) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("unable to parse log line %q - %v", line, err)
+			}
+			if entry["msg"] == "request complete" {
+				got[entry["request_id"].(string)] = entry["decision"].(string)
+			}
+		}
+	}
+	for id, decision := range want {
+		if got[id] != decision {
+			t.Errorf("got decision %q for request %s, want %q\nlogs:\n%s", got[id], id, decision, buf.String())
+		}
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defaultLogger := logger
+	defer func() { logger = defaultLogger }()
+
+	if err := setupLogging("yaml", "info", &bytes.Buffer{}); err == nil {
+		t.Errorf("got no error for an unknown log format, want one")
+	}
+	if err := setupLogging("json", "loud", &bytes.Buffer{}); err == nil {
+		t.Errorf("got no error for an unknown log level, want one")
+	}
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -20,25 +29,210 @@ import (
 type StringSlice []string
 
 type Config struct {
-	ProxyHost      string  `json:"proxy_host"`
-	ProxyPort      int     `json:"proxy_port"`
-	Port           int     `json:"port"`
-	Fakes          []*Fake `json:"fakes"`
-	ProxyDelayRaw  string  `json:"proxy_delay"`
-	ProxyDelayTime time.Duration
+	ProxyHost              string  `json:"proxy_host"`
+	ProxyPort              int     `json:"proxy_port"`
+	Port                   int     `json:"port"`
+	Bind                   string  `json:"bind"`
+	AdminPort              int     `json:"admin_port"`
+	AdminBind              string  `json:"admin_bind"`
+	JournalSize            int     `json:"journal_size"`
+	JournalBodyLimit       int     `json:"journal_body_limit"`
+	BodyInspectLimit       int     `json:"body_inspect_limit"`
+	MaxRequestBody         int64   `json:"max_request_body"`
+	Fakes                  []*Fake `json:"fakes"`
+	ProxyDelayRaw          string  `json:"proxy_delay"`
+	ProxyDialTimeoutRaw    string  `json:"proxy_dial_timeout"`
+	ProxyTLSTimeoutRaw     string  `json:"proxy_tls_timeout"`
+	ProxyHeaderTimeoutRaw  string  `json:"proxy_response_header_timeout"`
+	ProxyTimeoutRaw        string  `json:"proxy_timeout"`
+	ProxyRetries           int     `json:"proxy_retries"`
+	ProxyErrorCode         int     `json:"proxy_error_code"`
+	ProxyErrorBody         string  `json:"proxy_error_body"`
+	FixturesDir            string  `json:"fixtures_dir"`
+	HeaderPrefix           string  `json:"header_prefix"`
+	HeaderToken            string  `json:"header_token"`
+	DisableHeaderOverrides bool    `json:"disable_header_overrides"`
+	// TLSCert and TLSKey serve HTTPS, with HTTP/2 negotiated by ALPN
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// UpstreamHTTP2 proxies over HTTP/2: negotiated by ALPN with https upstreams, and
+	// without TLS (h2c) with http ones
+	UpstreamHTTP2 bool `json:"upstream_http2"`
+	// Listeners are more ports to open, each with its own upstream and fakes
+	Listeners []*Listener `json:"listeners"`
+	// GRPCDescriptorSets are protoc descriptor sets describing the gRPC services faked
+	GRPCDescriptorSets StringSlice `json:"grpc_descriptor_sets"`
+	ProxyDelayTime     time.Duration
+	ProxyDialTimeout   time.Duration
+	ProxyTLSTimeout    time.Duration
+	ProxyHeaderTimeout time.Duration
+	ProxyTimeout       time.Duration
+
+	// transport reaches ProxyHost; nil uses http.DefaultTransport
+	transport http.RoundTripper
+	// grpcTransport reaches ProxyHost over HTTP/2 for gRPC calls
+	grpcTransport http.RoundTripper
+	// protos are the messages and services of the GRPCDescriptorSets
+	protos *protoRegistry
+	// errorBody is the parsed ProxyErrorBody, set by prepareErrorBody
+	errorBody *template.Template
+
+	// validator checks exchanges against an OpenAPI document; nil when not validating
+	validator *contractValidator
+	// index finds the fake matching a request; it is built by storeConfig
+	index *fakeIndex
+	// sessions scope fakes to the requests carrying their id, see session
+	sessions map[string]*session
+	// listener is the name of the Listener the config serves, empty for the top level port;
+	// listeners are the configs of the Listeners, by name, built by storeConfig
+	listener  string
+	listeners map[string]*Config
 }
 
 type Fake struct {
-	HyjackPath        string      `json:"hyjack"`
-	Methods           StringSlice `json:"methods"`
-	RequestBodySubStr string      `json:"request_body"`
-	ResponseBody      string      `json:"body"`
-	ResponseCode      int         `json:"code"`
-	ResponseHeaders   StringSlice `json:"headers"`
-	ResponseTimeRaw   string      `json:"time"`
-	IsRegex           bool        `json:"pattern_match"`
-	UseRequestURI     bool        `json:"request_uri"`
-	ResponseTime      time.Duration
+	HyjackPath         string          `json:"hyjack,omitempty"`
+	Path               string          `json:"path,omitempty"`
+	Methods            StringSlice     `json:"methods,omitempty"`
+	RequestBodySubStr  string          `json:"request_body,omitempty"`
+	ResponseBody       string          `json:"body,omitempty"`
+	ResponseBodyBase64 string          `json:"body_base64,omitempty"`
+	ResponseCode       int             `json:"code,omitempty"`
+	ResponseHeaders    StringSlice     `json:"headers,omitempty"`
+	ResponseTimeRaw    string          `json:"time,omitempty"`
+	IsRegex            bool            `json:"pattern_match,omitempty"`
+	UseRequestURI      bool            `json:"request_uri,omitempty"`
+	Fallback           bool            `json:"fallback,omitempty"`
+	FallbackStatus     StringSlice     `json:"fallback_status,omitempty"`
+	Name               string          `json:"name,omitempty"`
+	Disabled           bool            `json:"disabled,omitempty"`
+	Sequence           []*FakeResponse `json:"sequence,omitempty"`
+	SequenceLoop       bool            `json:"sequence_loop,omitempty"`
+	Template           bool            `json:"template,omitempty"`
+	Stream             *FakeStream     `json:"stream,omitempty"`
+	WebSocket          *FakeWebSocket  `json:"websocket,omitempty"`
+	GRPC               *FakeGRPC       `json:"grpc,omitempty"`
+	ResponseTime       time.Duration   `json:"-"`
+
+	// served counts the responses taken from the sequence
+	served atomic.Uint64
+	// bodyTemplate and headerTemplates are the fake's own response templates when Template is set
+	bodyTemplate    *template.Template
+	headerTemplates []*template.Template
+}
+
+// FakeResponse is one of the responses a fake with a sequence answers with, in order
+type FakeResponse struct {
+	ResponseBody       string        `json:"body,omitempty"`
+	ResponseBodyBase64 string        `json:"body_base64,omitempty"`
+	ResponseCode       int           `json:"code,omitempty"`
+	ResponseHeaders    StringSlice   `json:"headers,omitempty"`
+	ResponseTimeRaw    string        `json:"time,omitempty"`
+	Stream             *FakeStream   `json:"stream,omitempty"`
+	ResponseTime       time.Duration `json:"-"`
+
+	// bodyTemplate and headerTemplates are parsed when the fake has template set
+	bodyTemplate    *template.Template
+	headerTemplates []*template.Template
+}
+
+// prepare converts the fake's string config values (times, base64 bodies and response
+// templates) for use, and checks its route compiles
+func (f *Fake) prepare() error {
+	if f.Path != "" {
+		if f.HyjackPath != "" {
+			return errors.New("set either hyjack or path, not both")
+		}
+		if _, err := compilePathPattern(f.Path); err != nil {
+			return fmt.Errorf("invalid path - %v", err)
+		}
+	} else if f.IsRegex {
+		if _, err := regexp.Compile(f.HyjackPath); err != nil {
+			return fmt.Errorf("invalid hyjack pattern - %v", err)
+		}
+	}
+	for _, status := range f.FallbackStatus {
+		if !validStatusPattern(status) {
+			return fmt.Errorf("invalid fallback_status %q (want a code like 503 or a class like 5xx)", status)
+		}
+	}
+
+	if f.WebSocket != nil {
+		if err := f.WebSocket.prepare(); err != nil {
+			return fmt.Errorf("websocket: %v", err)
+		}
+	}
+	if f.GRPC != nil {
+		if err := f.GRPC.prepare(); err != nil {
+			return fmt.Errorf("grpc: %v", err)
+		}
+	}
+
+	own := &FakeResponse{ResponseBody: f.ResponseBody, ResponseHeaders: f.ResponseHeaders, ResponseTimeRaw: f.ResponseTimeRaw, ResponseBodyBase64: f.ResponseBodyBase64, Stream: f.Stream}
+	responses := append([]*FakeResponse{own}, f.Sequence...)
+	for _, resp := range responses {
+		if resp.ResponseTimeRaw != "" {
+			d, err := time.ParseDuration(resp.ResponseTimeRaw)
+			if err != nil {
+				return fmt.Errorf("converting string delay to time duration - %v", err)
+			}
+			resp.ResponseTime = d
+		}
+		if resp.ResponseBodyBase64 != "" {
+			body, err := base64.StdEncoding.DecodeString(resp.ResponseBodyBase64)
+			if err != nil {
+				return fmt.Errorf("decoding body_base64 - %v", err)
+			}
+			resp.ResponseBody = string(body)
+		}
+		if resp.Stream != nil {
+			if err := resp.Stream.prepare(); err != nil {
+				return err
+			}
+		}
+		if f.Template {
+			if err := resp.parseTemplates(); err != nil {
+				return fmt.Errorf("parsing template - %v", err)
+			}
+		}
+	}
+	if f.ResponseTimeRaw != "" {
+		f.ResponseTime = own.ResponseTime
+	}
+	if f.ResponseBodyBase64 != "" {
+		f.ResponseBody = own.ResponseBody
+	}
+	f.bodyTemplate, f.headerTemplates = own.bodyTemplate, own.headerTemplates
+	return nil
+}
+
+// nextResponse returns the response to serve: the fake's own, or the next in its sequence.
+// Once the sequence is used up, its last response is repeated unless sequence_loop is set.
+// Inside a session, the position in the sequence is the session's own.
+func (f *Fake) nextResponse(s *session) *FakeResponse {
+	if len(f.Sequence) == 0 {
+		return &FakeResponse{
+			ResponseBody:    f.ResponseBody,
+			ResponseCode:    f.ResponseCode,
+			ResponseHeaders: f.ResponseHeaders,
+			ResponseTime:    f.ResponseTime,
+			Stream:          f.Stream,
+			bodyTemplate:    f.bodyTemplate,
+			headerTemplates: f.headerTemplates,
+		}
+	}
+	var n uint64
+	if s != nil {
+		n = s.sequences.next(f)
+	} else {
+		n = f.served.Add(1) - 1
+	}
+	last := uint64(len(f.Sequence) - 1)
+	if f.SequenceLoop {
+		n %= last + 1
+	} else if n > last {
+		n = last
+	}
+	return f.Sequence[n]
 }
 
 func (f *Fake) String() string {
@@ -50,25 +244,48 @@ func (f *Fake) String() string {
 	}
 
 	var path string
-	if len(f.HyjackPath) == 0 {
+	if len(f.Path) > 0 {
+		path = f.Path
+	} else if len(f.HyjackPath) == 0 {
 		path = "all paths"
 	} else {
 		path = f.HyjackPath
 	}
 
-	return fmt.Sprintf("fake: %s %s -> code %d, headers %v, time %s, body `%s`", methods, path, f.ResponseCode, f.ResponseHeaders, f.ResponseTime.String(), f.ResponseBody)
+	var kind string
+	if f.Fallback {
+		kind = "fallback "
+	}
+
+	if len(f.Sequence) > 0 {
+		return fmt.Sprintf("%sfake: %s %s -> sequence of %d responses", kind, methods, path, len(f.Sequence))
+	}
+	return fmt.Sprintf("%sfake: %s %s -> code %d, headers %v, time %s, body `%s`", kind, methods, path, f.ResponseCode, f.ResponseHeaders, f.ResponseTime.String(), f.ResponseBody)
 }
 
-var GlobalConfig *Config
+// label names the fake in logs: its name when set, otherwise its position in the config
+func (f *Fake) label(i int) string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return fmt.Sprintf("fakes[%d]", i)
+}
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
-	var ConfigPath string
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Environ(), os.Stdout))
+	}
+
+	var ConfigPaths StringSlice
+	var ConfigFormat string
+	var Overlays StringSlice
 
 	var Port int
+	var Bind string
 	var ResponseCode int
 	var ResponseTime time.Duration
 	var ResponseBody string
@@ -82,10 +299,39 @@ func main() {
 	var ProxyHost string
 	var ProxyPort int
 	var ProxyDelayTime time.Duration
-
-	flag.StringVar(&ConfigPath, "config", "", "json formatted conf file (see README at github.com/sethgrid/fakettp). If this flag is used, no other flags will be recognized.")
-
-	flag.IntVar(&Port, "port", 0, "set the port on which to listen")
+	var FixturesDir string
+	var HeaderPrefix string
+	var HeaderToken string
+	var DisableHeaderOverrides bool
+	var LogFormat string
+	var LogLevel string
+	var AdminPort int
+	var AdminBind string
+	var HAROut string
+	var HARImport string
+	var HARMatch string
+	var HARDuplicates string
+	var HARDelays bool
+	var HARConfig string
+	var OpenAPIPath string
+	var OpenAPIStatus string
+	var OpenAPISkip StringSlice
+	var OpenAPIValidate string
+	var OpenAPIStrict bool
+	var GRPCDescriptors StringSlice
+	var TLSCert string
+	var TLSKey string
+	var UpstreamHTTP2 bool
+	var ReadyOut string
+	var DrainDelay time.Duration
+	var DrainTimeout time.Duration
+
+	flag.Var(&ConfigPaths, "config", "json, yaml or toml formatted conf file, or a directory of them (see README at github.com/sethgrid/fakettp). Can be repeated; later files override earlier ones and add their fakes.")
+	flag.Var(&Overlays, "overlay", "config file applied after -config, patching or disabling fakes by name (can be repeated)")
+	flag.StringVar(&ConfigFormat, "config_format", "", "format of the -config file: json, yaml or toml (defaults to the file extension, then json)")
+
+	flag.IntVar(&Port, "port", 0, "set the port on which to listen (default 5000 or the config's port, 0 picks a free port)")
+	flag.StringVar(&Bind, "bind", "", "set the address on which to listen (default all interfaces)")
 	flag.IntVar(&ResponseCode, "code", 0, "set the http status code with which to respond")
 	flag.DurationVar(&ResponseTime, "time", time.Millisecond*0, "set the response time, ex: 250ms or 1m5s")
 	flag.StringVar(&ResponseBody, "body", "", "set the response body")
@@ -99,30 +345,241 @@ func main() {
 	flag.StringVar(&ProxyHost, "proxy_host", "", "the host we will reverse proxy to (include protocol)")
 	flag.IntVar(&ProxyPort, "proxy_port", 0, "the proxy port")
 	flag.DurationVar(&ProxyDelayTime, "proxy_delay", time.Millisecond*0, "set the response time for proxied endpoints, ex: 250ms or 1m5s")
+	flag.StringVar(&FixturesDir, "fixtures_dir", "", "directory of files that X-Return-Body-File can name")
+	flag.StringVar(&HeaderPrefix, "header_prefix", "", "prefix of the headers that override responses (default X-Return-)")
+	flag.StringVar(&HeaderToken, "header_token", "", "shared secret that requests must send in the <prefix>Token header to override responses")
+	flag.BoolVar(&DisableHeaderOverrides, "disable_header_overrides", false, "set to true to ignore X-Return-* headers")
+	flag.StringVar(&LogFormat, "log_format", "text", "log output format, text or json")
+	flag.StringVar(&LogLevel, "log_level", "info", "minimum log level: debug, info, warn or error")
+	flag.IntVar(&AdminPort, "admin_port", 0, "set the port for fakettp's own endpoints, such as /metrics (disabled when 0)")
+	flag.StringVar(&AdminBind, "admin_bind", "", "set the address on which the admin port listens (default the -bind address)")
+	flag.StringVar(&HAROut, "har_out", "", "write captured traffic as a HAR file to this path on shutdown")
+	flag.StringVar(&HARImport, "har", "", "HAR file to create fakes from, one per distinct request")
+	flag.StringVar(&HARMatch, "har_match", "method,path", "used with -har, the request fields fakes match on: method, path, query (the path with its query) and body. Without path or query, fakes match any path")
+	flag.StringVar(&HARDuplicates, "har_duplicates", "sequence", "used with -har, how to handle entries for the same request: sequence (answer with each in turn), first or last")
+	flag.BoolVar(&HARDelays, "har_delays", false, "used with -har, set to true to replay the recorded time of each entry")
+	flag.StringVar(&HARConfig, "har_config", "", "used with -har, write the created fakes to this config file and exit")
+	flag.StringVar(&OpenAPIPath, "openapi", "", "OpenAPI 3 document (yaml or json) to create a fake for every operation from")
+	flag.StringVar(&OpenAPIStatus, "openapi_status", "2xx", "used with -openapi, the response status each fake answers with, as codes or classes in order of preference (ex: 201,2xx)")
+	flag.Var(&OpenAPISkip, "openapi_skip", "used with -openapi, an operationId or \"METHOD /path\" to leave to the proxy (can be repeated)")
+	flag.StringVar(&OpenAPIValidate, "openapi_validate", "", "OpenAPI 3 document (yaml or json) to validate requests and responses against")
+	flag.BoolVar(&OpenAPIStrict, "openapi_strict", false, "used with -openapi_validate, set to true to answer requests that do not match the document with a 400")
+	flag.StringVar(&TLSCert, "tls_cert", "", "PEM certificate to serve HTTPS (and HTTP/2) with, used with -tls_key")
+	flag.StringVar(&TLSKey, "tls_key", "", "PEM private key of the -tls_cert")
+	flag.BoolVar(&UpstreamHTTP2, "upstream_http2", false, "set to true to proxy over HTTP/2 (h2c for http upstreams)")
+	flag.Var(&GRPCDescriptors, "grpc_descriptors", "protobuf descriptor set (protoc --descriptor_set_out) of the gRPC services to fake (can be repeated)")
+	flag.StringVar(&ReadyOut, "ready_out", "", "once listening, write the addresses as JSON to this file, or to stdout when -")
+	flag.DurationVar(&DrainDelay, "drain_delay", 0, "time to keep serving on SIGTERM or SIGINT with /__health failing, before connections are refused")
+	flag.DurationVar(&DrainTimeout, "drain_timeout", defaultDrainTimeout, "time given to in-flight requests to complete on SIGTERM or SIGINT")
 	flag.Parse()
 
+	unknownEnv, err := applyEnvFlags(flag.CommandLine, os.Environ())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupLogging(LogFormat, LogLevel, os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range unknownEnv {
+		logger.Warn("ignoring environment variable that matches no flag", "variable", name)
+	}
+
 	ConfigData := []byte{}
-	var err error
 
-	if ConfigPath != "" {
-		ConfigData, err = ioutil.ReadFile(ConfigPath)
+	if len(ConfigPaths) > 0 {
+		ConfigData, err = loadConfig(ConfigPaths, Overlays, ConfigFormat)
 		if err != nil {
-			log.Fatalf("%s", string(ConfigData))
+			log.Fatalf("loading config - %v", err)
+		}
+		if err := reportConfigProblems(ConfigPaths, Overlays, ConfigData); err != nil {
+			log.Fatal(err)
 		}
+	} else if len(Overlays) > 0 {
+		log.Fatal("-overlay needs a -config to apply to")
 	}
 
-	GlobalConfig = populateGlobalConfig(ConfigData, Port, ResponseCode, ResponseTime, ResponseBody, ResponseHeaders, Methods, RequestBodySubStr, HyjackPath, ProxyHost, ProxyPort, ProxyDelayTime, IsRegex, UseRequestURI)
-	log.Printf("starting on port :%d", GlobalConfig.Port)
+	config := populateGlobalConfig(ConfigData, Port, ResponseCode, ResponseTime, ResponseBody, ResponseHeaders, Methods, RequestBodySubStr, HyjackPath, ProxyHost, ProxyPort, ProxyDelayTime, IsRegex, UseRequestURI)
+	// an unset -port keeps the config's port, while -port 0 asks for a free one
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" && Port == 0 {
+			config.Port = 0
+		}
+	})
+	if FixturesDir != "" {
+		config.FixturesDir = FixturesDir
+	}
+	if HeaderPrefix != "" {
+		config.HeaderPrefix = HeaderPrefix
+	}
+	if HeaderToken != "" {
+		config.HeaderToken = HeaderToken
+	}
+	if DisableHeaderOverrides {
+		config.DisableHeaderOverrides = true
+	}
+	if AdminPort != 0 {
+		config.AdminPort = AdminPort
+	}
+	if Bind != "" {
+		config.Bind = Bind
+	}
+	if AdminBind != "" {
+		config.AdminBind = AdminBind
+	}
+	if TLSCert != "" || TLSKey != "" {
+		config.TLSCert, config.TLSKey = TLSCert, TLSKey
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		log.Fatal("tls_cert and tls_key must be given together")
+	}
+	if UpstreamHTTP2 {
+		config.UpstreamHTTP2 = true
+		config.transport = newUpstreamTransport(config)
+	}
 
-	startFakettp(GlobalConfig.Port)
-}
+	configureJournal(config, config.AdminPort != 0 || HAROut != "")
+	if HARImport != "" {
+		opts, err := parseHARImportOptions(HARMatch, HARDuplicates, HARDelays)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fakes, err := importHAR(HARImport, opts)
+		if err != nil {
+			log.Fatalf("importing HAR - %v", err)
+		}
+		if HARConfig != "" {
+			if err := writeFakesConfig(HARConfig, fakes); err != nil {
+				log.Fatalf("writing config - %v", err)
+			}
+			log.Printf("wrote %d fakes to %s", len(fakes), HARConfig)
+			return
+		}
+		for _, fake := range fakes {
+			log.Printf("creating hyjack %s", fake)
+			if err := fake.prepare(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.Fakes = append(config.Fakes, fakes...)
+	}
 
-func startFakettp(port int) {
-	http.HandleFunc("/", defaultHandler)
-	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
+	if OpenAPIPath != "" {
+		doc, err := loadOpenAPI(OpenAPIPath)
+		if err != nil {
+			log.Fatalf("loading OpenAPI document - %v", err)
+		}
+		fakes, err := fakesFromOpenAPI(doc, strings.Split(OpenAPIStatus, ","), OpenAPISkip)
+		if err != nil {
+			log.Fatalf("creating fakes from OpenAPI document - %v", err)
+		}
+		for _, fake := range fakes {
+			log.Printf("creating hyjack %s", fake)
+			if err := fake.prepare(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		config.Fakes = append(config.Fakes, fakes...)
+	}
+
+	if OpenAPIValidate != "" {
+		doc, err := loadOpenAPI(OpenAPIValidate)
+		if err != nil {
+			log.Fatalf("loading OpenAPI document - %v", err)
+		}
+		config.validator = newContractValidator(doc, OpenAPIStrict)
+		log.Printf("validating against %s (%d operations)", OpenAPIValidate, len(config.validator.routes))
+	}
+
+	config.GRPCDescriptorSets = append(config.GRPCDescriptorSets, GRPCDescriptors...)
+	if len(config.GRPCDescriptorSets) > 0 {
+		config.protos, err = loadDescriptorSets(config.GRPCDescriptorSets)
+		if err != nil {
+			log.Fatalf("loading grpc descriptor sets - %v", err)
+		}
+		log.Printf("loaded %d grpc methods from %s", len(config.protos.methods), strings.Join(config.GRPCDescriptorSets, ", "))
+	}
+	if err := checkGRPCFakes(config); err != nil {
+		log.Fatal(err)
+	}
+
+	// storing the config compiles the routes of all the fakes up front
+	storeConfig(config)
+
+	servers, err := openServers(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	for _, s := range servers {
+		switch {
+		case s.name == adminServer:
+			log.Printf("starting admin on %s", s.ln.Addr())
+		case s.name != mainListener:
+			log.Printf("starting listener %s on %s", s.name, s.ln.Addr())
+		case s.tlsCert != "":
+			log.Printf("starting with TLS on %s", s.ln.Addr())
+		default:
+			log.Printf("starting on %s", s.ln.Addr())
+		}
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *openServer) {
+			if err := s.serve(); err != nil {
+				errs <- fmt.Errorf("%s: %v", s.name, err)
+			}
+		}(s)
+	}
+	if ReadyOut != "" {
+		if err := publishReady(ReadyOut, servers, os.Stdout); err != nil {
+			log.Fatalf("publishing addresses - %v", err)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case s := <-sig:
+		log.Printf("received %v, failing readiness checks for %v, then draining requests for up to %v", s, DrainDelay, DrainTimeout)
+	}
+	if err := shutdown(servers, DrainDelay, DrainTimeout); err != nil {
+		log.Printf("closed requests that did not complete - %v", err)
+	}
+	if HAROut != "" {
+		log.Printf("writing HAR to %s", HAROut)
+		if err := writeHARFile(HAROut); err != nil {
+			log.Fatalf("writing HAR - %v", err)
+		}
+	}
+	log.Print("stopped")
+}
+
+// newServer returns the server for the fakes and the proxy. It speaks HTTP/1 and HTTP/2:
+// negotiated with ALPN over TLS, or without TLS (h2c) when the client knows to use it.
+func newServer(c *Config) *http.Server {
+	bind, name := c.Bind, c.listener
+	if bind == "" {
+		bind = "0.0.0.0"
+	}
+	server := &http.Server{
+		Addr:      net.JoinHostPort(bind, strconv.Itoa(c.Port)),
+		Handler:   http.HandlerFunc(defaultHandler),
+		Protocols: new(http.Protocols),
+		// requests are served with the config of the listener they came in on
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerKey{}, name)
+		},
+	}
+	server.Protocols.SetHTTP1(true)
+	if c.TLSCert != "" {
+		server.Protocols.SetHTTP2(true)
+	} else {
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return server
 }
 
 func populateGlobalConfig(ConfigData []byte, Port int, ResponseCode int, ResponseTime time.Duration, ResponseBody string, ResponseHeaders StringSlice, Methods StringSlice, RequestBodySubStr string, HyjackPath string, ProxyHost string, ProxyPort int, ProxyDelayTime time.Duration, IsRegex, UseRequestURI bool) *Config {
@@ -142,17 +599,38 @@ func populateGlobalConfig(ConfigData []byte, Port int, ResponseCode int, Respons
 			config.ProxyDelayTime = d
 		}
 
-		// set all the response times from config file string to time.Duration
-		for _, fake := range config.Fakes {
-			log.Printf("creating hyjack %s", fake)
-			if fake.ResponseTimeRaw == "" {
+		// upstream timeouts
+		timeouts := []struct {
+			name string
+			raw  string
+			d    *time.Duration
+		}{
+			{"proxy_dial_timeout", config.ProxyDialTimeoutRaw, &config.ProxyDialTimeout},
+			{"proxy_tls_timeout", config.ProxyTLSTimeoutRaw, &config.ProxyTLSTimeout},
+			{"proxy_response_header_timeout", config.ProxyHeaderTimeoutRaw, &config.ProxyHeaderTimeout},
+			{"proxy_timeout", config.ProxyTimeoutRaw, &config.ProxyTimeout},
+		}
+		for _, timeout := range timeouts {
+			if timeout.raw == "" {
 				continue
 			}
-			d, err := time.ParseDuration(fake.ResponseTimeRaw)
+			d, err := time.ParseDuration(timeout.raw)
 			if err != nil {
-				log.Fatalf("converting string delay to time duration - %v", err)
+				log.Fatalf("converting %s to time duration - %v", timeout.name, err)
+			}
+			*timeout.d = d
+		}
+
+		if err := config.prepareErrorBody(); err != nil {
+			log.Fatalf("parsing proxy_error_body template - %v", err)
+		}
+
+		// set all the response times from config file string to time.Duration
+		for _, fake := range config.Fakes {
+			log.Printf("creating hyjack %s", fake)
+			if err := fake.prepare(); err != nil {
+				log.Fatal(err)
 			}
-			fake.ResponseTime = d
 		}
 	}
 
@@ -176,6 +654,13 @@ func populateGlobalConfig(ConfigData []byte, Port int, ResponseCode int, Respons
 	if config.ProxyPort == 0 && config.Port != 0 {
 		config.ProxyPort = config.Port
 	}
+	config.transport = newUpstreamTransport(config)
+	config.grpcTransport = newGRPCTransport(config)
+	for i, l := range config.Listeners {
+		if err := l.prepare(config); err != nil {
+			log.Fatalf("listeners[%d]: %v", i, err)
+		}
+	}
 
 	if len(config.Fakes) > 0 && HyjackPath != "" {
 		log.Println("appending fake based on parameters")
@@ -214,202 +699,299 @@ func populateGlobalConfig(ConfigData []byte, Port int, ResponseCode int, Respons
 
 // defaultHanlder will either proxy the request or substitute in the hyjack data
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
-	// capture a request id with padding and leading zeros incase multiple requests
-	// come in at the same time
-	reqID := fmt.Sprintf("[%07x] ", rand.Int31n(1e8))
-	log.SetPrefix(reqID)
+	// readiness checks are answered before anything is logged, recorded or faked
+	if r.URL.Path == healthPath {
+		healthHandler(w, r)
+		return
+	}
+	start := time.Now()
+	// the request is served with the config current when it arrived
+	config := currentConfig().listenerConfig(requestListener(r))
+	r = withConfig(r, config)
+	id, r := sessionID(r)
+	sess := config.sessions[id]
+	rl, r := newRequestLog(w, r)
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	// a session's exchanges are only recorded in its own journal
+	j, overrides := exchanges, stickyOverrides
+	if sess != nil {
+		j, overrides = sess.journal, sess.overrides
+		r = withSession(r, sess)
+	}
+	r, record := j.capture(r, rec, rl, start)
+	// response bodies are checked against the contract even when the journal keeps none
+	if config.validator != nil && rec.body == nil {
+		rec.body = &limitedBuffer{limit: j.bodyLimit}
+	}
+	var check *contractCheck
+	defer func() {
+		if check != nil {
+			check.checkResponse(rec)
+		}
+		rl.complete(rec.status, start)
+		record()
+	}()
 
-	log.Printf("new request %s %s", r.Method, r.RequestURI)
+	if id != "" {
+		rl.Logger = rl.With("session", id)
+	}
+	rl.Info("new request", "uri", r.RequestURI)
+
+	if id != "" && sess == nil {
+		rl.decide("invalid", "")
+		rl.Warn("unknown session")
+		http.Error(w, fmt.Sprintf("fakettp: unknown session %q", id), http.StatusNotFound)
+		return
+	}
+	r.Header.Del(sessionHeader)
+
+	if limitRequestBody(w, r, config.MaxRequestBody) {
+		return
+	}
+
+	if validator := config.validator; validator != nil {
+		check = validator.checkRequest(r)
+		if check.violations > 0 && validator.strict {
+			rl.decide("invalid", "")
+			check.writeInvalidRequest(w)
+			return
+		}
+	}
 
 	// there are two ways that a request gets hyjacked:
 	// 1 - X-Return-* header
 	// 2 - Config
 	// An X-Return-* header always overrides config.
-	requestHyjacked := false
-	var delay time.Duration
-	var code int
-	var headers http.Header
-	var data []byte
-	var err error
-
-	if hdr := r.Header.Get("X-Return-Delay"); hdr != "" {
-		delay, err = time.ParseDuration(hdr)
-		if err != nil {
-			log.Println("cannot set delay", err)
-		}
+	override := &returnOverride{times: 1}
+	if allowReturnOverrides(r) {
+		override = parseReturnOverride(r)
+	} else if !config.DisableHeaderOverrides && len(config.controlHeaders(r.Header)) > 0 {
+		rl.Warn("ignoring X-Return-* headers without a valid token")
 	}
-	// respect config delay if it was not set by header
-	if delay == 0 && GlobalConfig.ProxyDelayTime > 0 {
-		delay = GlobalConfig.ProxyDelayTime
-	}
-
-	if hdr := r.Header.Get("X-Return-Headers"); hdr != "" {
-		requestHyjacked = true
-		err = json.Unmarshal([]byte(hdr), &headers)
-		if err != nil {
-			requestHyjacked = false
-			log.Println("unable to read X-Return-Headers", err)
-		}
-		for k, vs := range headers {
-			for _, v := range vs {
-				w.Header().Add(k, v)
-			}
+	if override.active() && override.times > 1 {
+		rl.Info("keeping X-Return-* override for following requests", "times", override.times-1)
+		overrides.add(r, override)
+	} else if !override.active() && !config.DisableHeaderOverrides {
+		if sticky := overrides.take(r); sticky != nil {
+			rl.Info("using kept X-Return-* override")
+			override = sticky
 		}
 	}
-	if hdr := r.Header.Get("X-Return-Code"); hdr != "" {
-		requestHyjacked = true
-		code, err = strconv.Atoi(hdr)
-		if err != nil {
-			requestHyjacked = false
-			log.Println("unable to read X-Return-Code", err)
-		}
-		if code == 100 {
-			log.Println("code 100 hangs the stdlib. Adusting code to 101")
-			code++
-		}
+
+	var delay time.Duration
+	if override.delay != nil {
+		delay = override.delay.sample()
 	}
-	if hdr := r.Header.Get("X-Return-Data"); hdr != "" {
-		requestHyjacked = true
-		data = []byte(hdr)
+	// respect config delay if it was not set by header
+	if delay == 0 && config.ProxyDelayTime > 0 {
+		delay = config.ProxyDelayTime
 	}
 
-	if requestHyjacked {
-		log.Printf("hyjacking request %s (waiting %s)", r.RequestURI, delay.String())
-		w.WriteHeader(code)
-		for name, values := range headers {
-			log.Printf("setting header %s:%s", name, strings.Join(values, ","))
-			w.Header().Set(name, strings.Join(values, ","))
-		}
+	if override.hyjack {
+		rl.decide("x-return", "")
+		rl.Info("hyjacking request", "delay", delay)
+		rl.delay = delay
 		time.Sleep(delay)
-		w.Write(data)
-		log.Println("hyjack X-Return-* request complete")
+		override.write(w, r)
 		return
 	}
 
-	// If this request was not X-Return-* based, check config.
-	// Range over the configured fakes and determine if we
-	// should hyjack the route
-	for _, fake := range GlobalConfig.Fakes {
-		pathToMatch := r.URL.Path
-		if fake.UseRequestURI {
-			pathToMatch = r.RequestURI
-		}
-
-		// extract the reqeust body, and put it back into the request.
-		var originalRequestBody []byte
-		var err error
-		if r.Body != nil {
-			originalRequestBody, err = ioutil.ReadAll(r.Body)
-			if err != nil {
-				log.Printf("unable to read original request body - %v", err)
+	// If this request was not X-Return-* based, check config for
+	// a fake that hyjacks the route
+	if !override.modify {
+		// the start of the request body is read once, and only if a fake matches on it
+		var requestBody []byte
+		var bodyErr error
+		bodyRead := false
+		readBody := func() string {
+			if !bodyRead {
+				requestBody, _, bodyErr = peekBody(r, config.bodyInspectLimit())
+				if bodyErr != nil && !bodyTooLarge(bodyErr) {
+					rl.Warn("unable to read original request body", "error", bodyErr)
+				}
 			}
-			r.Body.Close()
+			bodyRead = true
+			return string(requestBody)
 		}
-
-		// rehydrate the body (it is drained each read)
-		if len(originalRequestBody) > 0 {
-			r.Body = ioutil.NopCloser(bytes.NewBuffer(originalRequestBody))
+		lookup := func(idx *fakeIndex) (*fakeMatcher, map[string]string) {
+			m, params := idx.lookup(r, readBody)
+			if bodyTooLarge(bodyErr) {
+				return nil, nil
+			}
+			return m, params
 		}
 
-		if willHyjack(r.Method, fake.Methods, pathToMatch, fake.HyjackPath, string(originalRequestBody), fake.RequestBodySubStr, fake.IsRegex) {
-			log.Printf("hyjacking route %s (waiting %s)", fake.HyjackPath, fake.ResponseTime.String())
-			if fake.ResponseTime > 0 {
-				<-time.Tick(fake.ResponseTime)
+		// session fakes are tried before the global ones
+		if sess != nil {
+			if m, params := lookup(sess.index); m != nil {
+				rl.decide("fake", m.label)
+				serveFake(w, r, m.fake, params)
+				return
 			}
-			for _, header := range fake.ResponseHeaders {
-				parts := strings.Split(header, ": ")
-
-				if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
-					key, value := parts[0], parts[1]
-					log.Printf("setting header %s:%s", key, value)
-					w.Header().Add(key, value)
-				} else {
-					log.Printf("skipping header %s (need a value on both sides of :)", header)
-				}
-			}
-			w.WriteHeader(fake.ResponseCode)
-			w.Write([]byte(fake.ResponseBody))
-			log.Println("hyjack request complete")
+		}
+		if m, params := lookup(config.fakeIndex()); m != nil {
+			rl.decide("fake", m.label)
+			serveFake(w, r, m.fake, params)
+			return
+		}
+		if bodyTooLarge(bodyErr) {
+			writeBodyTooLarge(w, r, config.MaxRequestBody)
 			return
 		}
 	}
 	// not hyjacking this time
-	log.Println("proxying request")
+	rl.decide("proxy", "")
+	rl.Info("proxying request")
+	config.stripControlHeaders(r.Header)
 
 	if delay > 0 {
-		log.Printf("delaying proxy request %s", delay.String())
+		rl.Info("delaying proxy request", "delay", delay)
+		rl.delay = delay
 		time.Sleep(delay)
 	}
 
 	director := func(req *http.Request) {
 		// handle both cases where we got `http://hostname` or `hostname`
-		parts := strings.Split(GlobalConfig.ProxyHost, "://")
+		parts := strings.Split(config.ProxyHost, "://")
 		var scheme string
 		var host string
 		if len(parts) == 1 {
 			scheme = "http"
-			host = fmt.Sprintf("%s:%d", parts[0], GlobalConfig.ProxyPort)
+			host = fmt.Sprintf("%s:%d", parts[0], config.ProxyPort)
 		} else if len(parts) >= 2 {
 			scheme = parts[0]
-			host = fmt.Sprintf("%s:%d", parts[1], GlobalConfig.ProxyPort)
+			host = fmt.Sprintf("%s:%d", parts[1], config.ProxyPort)
 		} else {
-			log.Printf("issue splitting host on :// - %s", GlobalConfig.ProxyHost)
+			rl.Error("issue splitting host on ://", "proxy_host", config.ProxyHost)
 			return
 		}
 
-		log.Println("setting scheme as ", scheme)
+		rl.Debug("setting upstream", "scheme", scheme, "host", host)
 		req.URL.Scheme = scheme
 		req.URL.Host = host
 	}
 
-	proxy := &httputil.ReverseProxy{Director: director}
-	proxy.ServeHTTP(w, r)
-	log.Printf("proxy request complete")
-}
-
-// willHyjack returns true when we have a hyjack route that matches our request path,
-// and takes into account the methods we want to hyjack
-func willHyjack(requestMethod string, hyjackMethods StringSlice, requestPath string, hyjackRoute string, requestBody string, requestBodySubStr string, isRegex bool) bool {
-	methodMatches := false
-	routeMatches := false
-	requestBodyMatches := false
-	requireBodyMatch := false
-
-	if hyjackRoute == "" {
-		routeMatches = true
-	} else {
-		if isRegex {
-			var regex = regexp.MustCompile(hyjackRoute)
-			if regex.MatchString(requestPath) {
-				routeMatches = true
-			}
-		} else if hyjackRoute == requestPath {
-			routeMatches = true
+	// keep the start of the request body if a fallback fake may need to match against it,
+	// as the proxy drains it on the way upstream
+	var fallbackBody []byte
+	if config.fakeIndex().fallbackBody || sess != nil && sess.index.fallbackBody {
+		var err error
+		fallbackBody, _, err = peekBody(r, config.bodyInspectLimit())
+		if bodyTooLarge(err) {
+			writeBodyTooLarge(w, r, config.MaxRequestBody)
+			return
+		}
+		if err != nil {
+			rl.Warn("unable to read request body for fallback matching", "error", err)
 		}
 	}
 
-	if requestBodySubStr != "" {
-		requireBodyMatch = true
+	// proxy_timeout bounds exchanges, not the connections upgraded to websockets
+	timeout := config.ProxyTimeout
+	if isWebSocketUpgrade(r) {
+		timeout = 0
 	}
+	r, cancel := withProxyTimeout(r, timeout)
+	defer cancel()
 
-	if requestBodySubStr != "" && strings.Contains(requestBody, requestBodySubStr) {
-		requestBodyMatches = true
+	// gRPC is only spoken over HTTP/2
+	transport := config.transport
+	if isGRPC(r) && config.grpcTransport != nil {
+		transport = config.grpcTransport
 	}
 
-	if len(hyjackMethods) == 0 {
-		methodMatches = true
+	upstreamStart := time.Now()
+	proxy := &httputil.ReverseProxy{
+		Director:  director,
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			rl.upstream = time.Since(upstreamStart)
+			rl.upstreamProto = resp.Proto
+			// the request id was already set on the response
+			resp.Header.Del("X-Request-Id")
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				recordSwitch(rec, resp.Header)
+				if conn, ok := resp.Body.(io.ReadWriteCloser); ok && isWebSocketUpgrade(r) {
+					rl.Info("websocket connected")
+					resp.Body = newLoggedUpgrade(conn, rl)
+				}
+				return nil
+			}
+			if err := fallbackOnStatus(r, fallbackBody)(resp); err != nil {
+				return err
+			}
+			if override.modify {
+				override.modifyResponse(resp)
+			}
+			return nil
+		},
+		ErrorHandler: fallbackOnError(fallbackBody),
+		ErrorLog:     slog.NewLogLogger(rl.Handler(), slog.LevelError),
 	}
-	for _, method := range hyjackMethods {
-		if strings.ToUpper(method) == strings.ToUpper(requestMethod) {
-			methodMatches = true
+	proxy.ServeHTTP(w, r)
+}
+
+// serveFake writes the configured fake response, waiting the fake's response time first.
+// Fakes with template set render their body and headers with the request and the params
+// captured by the fake's path template.
+func serveFake(w http.ResponseWriter, r *http.Request, fake *Fake, params map[string]string) {
+	rl := reqLog(r)
+	resp := fake.nextResponse(requestSession(r))
+	if fake.Path != "" {
+		rl.params = params
+		rl.Info("hyjacking route", "path", fake.Path, "params", rl.params, "delay", resp.ResponseTime)
+	} else {
+		rl.Info("hyjacking route", "hyjack", fake.HyjackPath, "delay", resp.ResponseTime)
+	}
+
+	body, headers := resp.ResponseBody, resp.ResponseHeaders
+	if fake.Template {
+		var err error
+		body, headers, err = resp.render(newFakeTemplateData(r, rl.params))
+		if err != nil {
+			rl.Error("rendering fake template", "error", err)
+			http.Error(w, fmt.Sprintf("fakettp: rendering template - %v", err), http.StatusInternalServerError)
+			return
 		}
 	}
 
-	if requireBodyMatch {
-		return routeMatches && requestBodyMatches
+	rl.delay += resp.ResponseTime
+	if resp.ResponseTime > 0 {
+		<-time.Tick(resp.ResponseTime)
 	}
+	for _, header := range headers {
+		// only the first ": " separates the name, values may have their own
+		key, value, ok := strings.Cut(header, ": ")
 
-	return methodMatches && routeMatches
+		if ok && key != "" && value != "" {
+			rl.Debug("setting header", "header", key, "value", value)
+			w.Header().Add(key, value)
+		} else {
+			rl.Warn("skipping header (need a value on both sides of :)", "header", header)
+		}
+	}
+	if fake.GRPC != nil {
+		fake.GRPC.serve(w, r)
+		return
+	}
+	if fake.WebSocket != nil {
+		fake.WebSocket.serve(w, r)
+		return
+	}
+	if resp.Stream != nil {
+		resp.Stream.setContentType(w.Header())
+	}
+	code := resp.ResponseCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	if resp.Stream != nil {
+		resp.Stream.write(w, r)
+		return
+	}
+	w.Write([]byte(body))
 }
 
 // String adheres to the flag Var interface
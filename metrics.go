@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the histogram upper bounds, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// fakettpMetrics are served in the Prometheus text format on the admin listener's /metrics
+type fakettpMetrics struct {
+	requests        *counterVec
+	fakeRequests    *counterVec
+	upstreamErrors  *counterVec
+	violations      *counterVec
+	requestDuration *histogramVec
+	injectedDelay   *histogramVec
+	upstreamLatency *histogramVec
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *fakettpMetrics {
+	return &fakettpMetrics{
+		requests:        newCounterVec("fakettp_requests_total", "Requests by how they were answered (fake, fallback, x-return, invalid or proxy) and status code.", "listener", "decision", "code"),
+		fakeRequests:    newCounterVec("fakettp_fake_requests_total", "Requests answered by each configured fake.", "listener", "fake"),
+		upstreamErrors:  newCounterVec("fakettp_upstream_errors_total", "Failed upstream exchanges by cause (dial, timeout, tls or other).", "listener", "cause"),
+		violations:      newCounterVec("fakettp_contract_violations_total", "Violations of the OpenAPI contract by operation and kind.", "listener", "operation", "kind"),
+		requestDuration: newHistogramVec("fakettp_request_duration_seconds", "Time to answer requests, by decision.", "listener", "decision"),
+		injectedDelay:   newHistogramVec("fakettp_injected_delay_seconds", "Delays injected by fakes, X-Return-* headers and proxy_delay.", "listener"),
+		upstreamLatency: newHistogramVec("fakettp_upstream_latency_seconds", "Time for the upstream to respond with headers.", "listener"),
+	}
+}
+
+// observeRequest records a completed request, labelled with the listener it came in on
+func (m *fakettpMetrics) observeRequest(rl *requestLog, status int, duration time.Duration) {
+	m.requests.inc(rl.listener, rl.decision, strconv.Itoa(status))
+	if rl.fake != "" {
+		m.fakeRequests.inc(rl.listener, rl.fake)
+	}
+	m.requestDuration.observe(duration.Seconds(), rl.listener, rl.decision)
+	if rl.delay > 0 {
+		m.injectedDelay.observe(rl.delay.Seconds(), rl.listener)
+	}
+	if rl.upstream > 0 {
+		m.upstreamLatency.observe(rl.upstream.Seconds(), rl.listener)
+	}
+}
+
+func (m *fakettpMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.requests.write(w)
+	m.fakeRequests.write(w)
+	m.upstreamErrors.write(w)
+	m.violations.write(w)
+	m.requestDuration.write(w)
+	m.injectedDelay.write(w)
+	m.upstreamLatency.write(w)
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[seriesKey(labelValues)]++
+}
+
+// value returns the count for the label values
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[seriesKey(labelValues)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitSeriesKey(key), "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram over latencyBuckets, partitioned by label values
+type histogramVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(latencyBuckets))}
+		h.series[key] = s
+	}
+	for i, bound := range latencyBuckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s, labelValues := h.series[key], splitSeriesKey(key)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatFloat(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues, "", ""), s.count)
+	}
+}
+
+// series are keyed by their label values joined with a byte that cannot appear in them
+const seriesSep = "\xff"
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, seriesSep)
+}
+
+func splitSeriesKey(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, seriesSep)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders {name="value",...}, with an optional extra label such as le
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		if i < len(values) {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, escapeLabel(values[i])))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabel leaves only characters that %q renders the way Prometheus expects
+func escapeLabel(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.Fakes = append([]*Fake{{Name: "metrics-test", HyjackPath: "/metrics-test", ResponseCode: http.StatusCreated, ResponseTime: 10 * time.Millisecond}}, c.Fakes...)
+	})
+	before := metrics.fakeRequests.value(mainListener, "metrics-test")
+
+	t.Log(">> verify requests are counted per fake")
+	{
+		doWithHeaders(t, "/metrics-test", nil)
+		doWithHeaders(t, "/metrics-test", nil)
+		// the request is recorded once the handler returns, which can trail the response
+		for deadline := time.Now().Add(time.Second); metrics.fakeRequests.value(mainListener, "metrics-test") < before+2 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, want := metrics.fakeRequests.value(mainListener, "metrics-test"), before+2; got != want {
+			t.Errorf("got %v requests for the fake, want %v", got, want)
+		}
+	}
+
+	t.Log(">> verify /metrics renders the Prometheus text format")
+	{
+		rec := httptest.NewRecorder()
+		adminMux().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+		for _, want := range []string{
+			"# TYPE fakettp_requests_total counter",
+			`fakettp_requests_total{listener="main",decision="fake",code="201"}`,
+			`fakettp_fake_requests_total{listener="main",fake="metrics-test"}`,
+			`fakettp_injected_delay_seconds_bucket{listener="main",le="0.025"}`,
+			`fakettp_request_duration_seconds_count{listener="main",decision="fake"}`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("got metrics\n%s\nwant them to contain %s", body, want)
+			}
+		}
+	}
+}
+
+func TestMetricsUpstream(t *testing.T) {
+	defaultHyjackTestSetup()
+	before := metrics.upstreamErrors.value(mainListener, "dial")
+
+	t.Log(">> verify upstream errors are counted by cause")
+	{
+		// nothing listens here
+		updateConfig(func(c *Config) { c.ProxyPort = 4331 })
+		doWithHeaders(t, "/foo", nil)
+		if got, want := metrics.upstreamErrors.value(mainListener, "dial"), before+1; got != want {
+			t.Errorf("got %v dial errors, want %v", got, want)
+		}
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogramVec("test_seconds", "help", "label")
+	h.observe(0.02, "a")
+	h.observe(3, "a")
+
+	var buf strings.Builder
+	h.write(&buf)
+	for _, want := range []string{
+		`test_seconds_bucket{label="a",le="0.01"} 0`,
+		`test_seconds_bucket{label="a",le="0.025"} 1`,
+		`test_seconds_bucket{label="a",le="5"} 2`,
+		`test_seconds_bucket{label="a",le="+Inf"} 2`,
+		`test_seconds_sum{label="a"} 3.02`,
+		`test_seconds_count{label="a"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got histogram\n%s\nwant it to contain %s", buf.String(), want)
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// The parts of an OpenAPI 3 document fakettp uses, see https://spec.openapis.org/oas/v3.0.3.
+// JSON documents are read with the YAML decoder too, as JSON is valid YAML.
+
+type openAPIDoc struct {
+	OpenAPI    string                      `yaml:"openapi"`
+	Servers    []openAPIServer             `yaml:"servers"`
+	Paths      map[string]*openAPIPathItem `yaml:"paths"`
+	Components openAPIComponents           `yaml:"components"`
+}
+
+type openAPIServer struct {
+	URL string `yaml:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas       map[string]*openAPISchema    `yaml:"schemas"`
+	Responses     map[string]*openAPIResponse  `yaml:"responses"`
+	Parameters    map[string]*openAPIParameter `yaml:"parameters"`
+	RequestBodies map[string]*openAPIBody      `yaml:"requestBodies"`
+}
+
+type openAPIPathItem struct {
+	Get        *openAPIOperation   `yaml:"get"`
+	Put        *openAPIOperation   `yaml:"put"`
+	Post       *openAPIOperation   `yaml:"post"`
+	Delete     *openAPIOperation   `yaml:"delete"`
+	Options    *openAPIOperation   `yaml:"options"`
+	Head       *openAPIOperation   `yaml:"head"`
+	Patch      *openAPIOperation   `yaml:"patch"`
+	Trace      *openAPIOperation   `yaml:"trace"`
+	Parameters []*openAPIParameter `yaml:"parameters"`
+}
+
+// operations returns the path's operations by method, in a fixed order
+func (p *openAPIPathItem) operations() ([]string, []*openAPIOperation) {
+	var methods []string
+	var ops []*openAPIOperation
+	for _, m := range []struct {
+		method string
+		op     *openAPIOperation
+	}{
+		{"GET", p.Get}, {"PUT", p.Put}, {"POST", p.Post}, {"DELETE", p.Delete},
+		{"OPTIONS", p.Options}, {"HEAD", p.Head}, {"PATCH", p.Patch}, {"TRACE", p.Trace},
+	} {
+		if m.op != nil {
+			methods = append(methods, m.method)
+			ops = append(ops, m.op)
+		}
+	}
+	return methods, ops
+}
+
+type openAPIOperation struct {
+	OperationID string                      `yaml:"operationId"`
+	Parameters  []*openAPIParameter         `yaml:"parameters"`
+	RequestBody *openAPIBody                `yaml:"requestBody"`
+	Responses   map[string]*openAPIResponse `yaml:"responses"`
+}
+
+type openAPIParameter struct {
+	Ref      string         `yaml:"$ref"`
+	Name     string         `yaml:"name"`
+	In       string         `yaml:"in"`
+	Required bool           `yaml:"required"`
+	Schema   *openAPISchema `yaml:"schema"`
+}
+
+type openAPIBody struct {
+	Ref      string                       `yaml:"$ref"`
+	Required bool                         `yaml:"required"`
+	Content  map[string]*openAPIMediaType `yaml:"content"`
+}
+
+type openAPIResponse struct {
+	Ref     string                       `yaml:"$ref"`
+	Headers map[string]*openAPIHeader    `yaml:"headers"`
+	Content map[string]*openAPIMediaType `yaml:"content"`
+}
+
+type openAPIHeader struct {
+	Schema  *openAPISchema `yaml:"schema"`
+	Example interface{}    `yaml:"example"`
+}
+
+type openAPIMediaType struct {
+	Schema   *openAPISchema             `yaml:"schema"`
+	Example  interface{}                `yaml:"example"`
+	Examples map[string]*openAPIExample `yaml:"examples"`
+}
+
+type openAPIExample struct {
+	Value interface{} `yaml:"value"`
+}
+
+type openAPISchema struct {
+	Ref        string                    `yaml:"$ref"`
+	Type       string                    `yaml:"type"`
+	Format     string                    `yaml:"format"`
+	Properties map[string]*openAPISchema `yaml:"properties"`
+	Required   []string                  `yaml:"required"`
+	Items      *openAPISchema            `yaml:"items"`
+	Enum       []interface{}             `yaml:"enum"`
+	Example    interface{}               `yaml:"example"`
+	Default    interface{}               `yaml:"default"`
+	AllOf      []*openAPISchema          `yaml:"allOf"`
+	OneOf      []*openAPISchema          `yaml:"oneOf"`
+	AnyOf      []*openAPISchema          `yaml:"anyOf"`
+	Minimum    *float64                  `yaml:"minimum"`
+	Maximum    *float64                  `yaml:"maximum"`
+	MinLength  int                       `yaml:"minLength"`
+	MaxLength  *int                      `yaml:"maxLength"`
+	Pattern    string                    `yaml:"pattern"`
+	MinItems   int                       `yaml:"minItems"`
+	MaxItems   *int                      `yaml:"maxItems"`
+	Nullable   bool                      `yaml:"nullable"`
+
+	// AdditionalProperties is false to forbid properties that are not listed
+	AdditionalProperties interface{} `yaml:"additionalProperties"`
+
+	// pattern is Pattern compiled, once the document is parsed
+	pattern *regexp.Regexp
+}
+
+// loadOpenAPI reads an OpenAPI 3 document in YAML or JSON
+func loadOpenAPI(path string) (*openAPIDoc, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseOpenAPI(data)
+}
+
+func parseOpenAPI(data []byte) (*openAPIDoc, error) {
+	doc := &openAPIDoc{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("parsing OpenAPI document - %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q (want 3.x)", doc.OpenAPI)
+	}
+	if err := doc.compilePatterns(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// compilePatterns compiles the pattern of every schema in the document, so requests and
+// responses are not checked against patterns compiled again each time
+func (doc *openAPIDoc) compilePatterns() error {
+	var compile func(s *openAPISchema, where string) error
+	compile = func(s *openAPISchema, where string) error {
+		if s == nil {
+			return nil
+		}
+		if s.Pattern != "" && s.pattern == nil {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern in %s - %v", where, err)
+			}
+			s.pattern = re
+		}
+		for name, prop := range s.Properties {
+			if err := compile(prop, where+"."+name); err != nil {
+				return err
+			}
+		}
+		if err := compile(s.Items, where+"[]"); err != nil {
+			return err
+		}
+		for _, sub := range append(append(append([]*openAPISchema{}, s.AllOf...), s.OneOf...), s.AnyOf...) {
+			if err := compile(sub, where); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	content := func(content map[string]*openAPIMediaType, where string) error {
+		for contentType, media := range content {
+			if media == nil {
+				continue
+			}
+			if err := compile(media.Schema, where+" "+contentType); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	parameters := func(params []*openAPIParameter, where string) error {
+		for _, p := range params {
+			if p == nil {
+				continue
+			}
+			if err := compile(p.Schema, where+" parameter "+p.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	responses := func(responses map[string]*openAPIResponse, where string) error {
+		for code, r := range responses {
+			if r == nil {
+				continue
+			}
+			for name, h := range r.Headers {
+				if h == nil {
+					continue
+				}
+				if err := compile(h.Schema, where+" response "+code+" header "+name); err != nil {
+					return err
+				}
+			}
+			if err := content(r.Content, where+" response "+code); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for name, s := range doc.Components.Schemas {
+		if err := compile(s, "schema "+name); err != nil {
+			return err
+		}
+	}
+	if err := responses(doc.Components.Responses, "components"); err != nil {
+		return err
+	}
+	for name, p := range doc.Components.Parameters {
+		if p == nil {
+			continue
+		}
+		if err := compile(p.Schema, "parameter "+name); err != nil {
+			return err
+		}
+	}
+	for name, b := range doc.Components.RequestBodies {
+		if b == nil {
+			continue
+		}
+		if err := content(b.Content, "request body "+name); err != nil {
+			return err
+		}
+	}
+	for path, item := range doc.Paths {
+		if item == nil {
+			continue
+		}
+		if err := parameters(item.Parameters, path); err != nil {
+			return err
+		}
+		methods, ops := item.operations()
+		for i, op := range ops {
+			where := methods[i] + " " + path
+			if err := parameters(op.Parameters, where); err != nil {
+				return err
+			}
+			if op.RequestBody != nil {
+				if err := content(op.RequestBody.Content, where+" request body"); err != nil {
+					return err
+				}
+			}
+			if err := responses(op.Responses, where); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// basePath is the path of the first server url, which the spec's paths are relative to
+func (doc *openAPIDoc) basePath() string {
+	if len(doc.Servers) == 0 {
+		return ""
+	}
+	u, err := url.Parse(doc.Servers[0].URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// refName returns the component name a local $ref such as #/components/schemas/User points to
+func refName(ref, kind string) string {
+	return strings.TrimPrefix(ref, "#/components/"+kind+"/")
+}
+
+func (doc *openAPIDoc) schema(s *openAPISchema) *openAPISchema {
+	for i := 0; s != nil && s.Ref != "" && i < 32; i++ {
+		s = doc.Components.Schemas[refName(s.Ref, "schemas")]
+	}
+	return s
+}
+
+func (doc *openAPIDoc) response(r *openAPIResponse) *openAPIResponse {
+	for i := 0; r != nil && r.Ref != "" && i < 32; i++ {
+		r = doc.Components.Responses[refName(r.Ref, "responses")]
+	}
+	return r
+}
+
+func (doc *openAPIDoc) parameter(p *openAPIParameter) *openAPIParameter {
+	for i := 0; p != nil && p.Ref != "" && i < 32; i++ {
+		p = doc.Components.Parameters[refName(p.Ref, "parameters")]
+	}
+	return p
+}
+
+func (doc *openAPIDoc) requestBody(b *openAPIBody) *openAPIBody {
+	for i := 0; b != nil && b.Ref != "" && i < 32; i++ {
+		b = doc.Components.RequestBodies[refName(b.Ref, "requestBodies")]
+	}
+	return b
+}
+
+// openAPIPathPattern turns a path template such as /users/{id} into a regular expression,
+// capturing each templated segment, and returns the names of the templated segments
+func openAPIPathPattern(path string) (string, []string) {
+	var names []string
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			parts[i] = "([^/]+)"
+			names = append(names, part[1:len(part)-1])
+		} else {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+	}
+	return "^" + strings.Join(parts, "/") + "$", names
+}
+
+// openAPIPathTemplate turns an OpenAPI path such as /users/{user-id} into a path template,
+// with the param names made valid for it (/users/{user_id}), and reports if it has params
+func openAPIPathTemplate(path string) (string, bool) {
+	templated := false
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name := []byte(part[1 : len(part)-1])
+			for j, c := range name {
+				if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || j > 0 && c >= '0' && c <= '9') {
+					name[j] = '_'
+				}
+			}
+			parts[i] = "{" + string(name) + "}"
+			templated = true
+		}
+	}
+	return strings.Join(parts, "/"), templated
+}
+
+// fakesFromOpenAPI creates a fake for each operation, answering with the first response whose
+// status matches one of the statuses (codes like 200 or classes like 2xx, in order of
+// preference). Operations listed in skip, by operationId or as "METHOD /path", are left to
+// the proxy. Paths without templates come first so they win over templated ones.
+func fakesFromOpenAPI(doc *openAPIDoc, statuses []string, skip []string) ([]*Fake, error) {
+	for i, status := range statuses {
+		statuses[i] = strings.TrimSpace(status)
+		if !validStatusPattern(statuses[i]) {
+			return nil, fmt.Errorf("invalid OpenAPI status %q (want a code like 200 or a class like 2xx)", status)
+		}
+	}
+	skipped := make(map[string]bool)
+	for _, s := range skip {
+		skipped[s] = true
+	}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var literal, templated []*Fake
+	base := doc.basePath()
+	for _, path := range paths {
+		template, isTemplate := openAPIPathTemplate(base + path)
+		methods, ops := doc.Paths[path].operations()
+		for i, op := range ops {
+			name := methods[i] + " " + path
+			if skipped[name] || (op.OperationID != "" && skipped[op.OperationID]) {
+				continue
+			}
+			fake := &Fake{Methods: StringSlice{methods[i]}, Name: "openapi: " + name}
+			if op.OperationID != "" {
+				fake.Name = "openapi: " + op.OperationID
+			}
+			if isTemplate {
+				fake.Path = template
+			} else {
+				fake.HyjackPath = base + path
+			}
+			if err := doc.fillFakeResponse(fake, op, statuses); err != nil {
+				return nil, fmt.Errorf("%s - %v", name, err)
+			}
+			if isTemplate {
+				templated = append(templated, fake)
+			} else {
+				literal = append(literal, fake)
+			}
+		}
+	}
+	return append(literal, templated...), nil
+}
+
+// chooseResponse returns the response key matching the status (a code like 201 or a class
+// like 2xx) and the code to answer with. Explicit codes win over ranges such as 2XX, which
+// answer with the status when it is a code and with the first code of the range otherwise.
+func chooseResponse(codes []string, status string) (string, int) {
+	for _, code := range codes {
+		if n, err := strconv.Atoi(code); err == nil && statusMatches(status, n) {
+			return code, n
+		}
+	}
+	for _, code := range codes {
+		if !validStatusPattern(code) || !strings.HasSuffix(strings.ToLower(code), "xx") {
+			continue
+		}
+		if n, err := strconv.Atoi(status); err == nil {
+			if statusMatches(code, n) {
+				return code, n
+			}
+			continue
+		}
+		if n := int(code[0]-'0') * 100; statusMatches(status, n) {
+			return code, n
+		}
+	}
+	return "", 0
+}
+
+// fillFakeResponse sets the fake's code, headers and body from the operation's responses
+func (doc *openAPIDoc) fillFakeResponse(fake *Fake, op *openAPIOperation, statuses []string) error {
+	codes := make([]string, 0, len(op.Responses))
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	chosen := ""
+	for _, status := range statuses {
+		if chosen, fake.ResponseCode = chooseResponse(codes, status); chosen != "" {
+			break
+		}
+	}
+	if chosen == "" {
+		if _, ok := op.Responses["default"]; !ok {
+			return fmt.Errorf("no response matches %s", strings.Join(statuses, ","))
+		}
+		chosen, fake.ResponseCode = "default", 200
+	}
+
+	resp := doc.response(op.Responses[chosen])
+	if resp == nil {
+		return fmt.Errorf("unresolved response %s", chosen)
+	}
+
+	headerNames := make([]string, 0, len(resp.Headers))
+	for name := range resp.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		h := resp.Headers[name]
+		value := h.Example
+		if value == nil {
+			var err error
+			if value, err = doc.synthesize(h.Schema, "header "+name); err != nil {
+				return err
+			}
+		}
+		if value != nil {
+			fake.ResponseHeaders = append(fake.ResponseHeaders, fmt.Sprintf("%s: %v", name, value))
+		}
+	}
+
+	contentType, media := preferredMediaType(resp.Content)
+	if media == nil {
+		return nil
+	}
+	fake.ResponseHeaders = append(fake.ResponseHeaders, "Content-Type: "+contentType)
+
+	var err error
+	body := media.Example
+	if body == nil && len(media.Examples) > 0 {
+		names := make([]string, 0, len(media.Examples))
+		for name := range media.Examples {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		body = media.Examples[names[0]].Value
+	}
+	if body == nil {
+		if body, err = doc.synthesize(media.Schema, "body"); err != nil {
+			return err
+		}
+	}
+	if s, ok := body.(string); ok && !strings.Contains(contentType, "json") {
+		fake.ResponseBody = s
+		return nil
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encoding example - %v", err)
+	}
+	fake.ResponseBody = string(data)
+	return nil
+}
+
+// preferredMediaType picks JSON when the response offers it, otherwise the first media type
+func preferredMediaType(content map[string]*openAPIMediaType) (string, *openAPIMediaType) {
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		if strings.Contains(t, "json") {
+			return t, content[t]
+		}
+	}
+	if len(types) == 0 {
+		return "", nil
+	}
+	return types[0], content[types[0]]
+}
+
+// synthesize makes an example from the schema, failing when the example does not meet it
+func (doc *openAPIDoc) synthesize(s *openAPISchema, where string) (interface{}, error) {
+	value := doc.exampleFor(s, 0)
+	if value == nil {
+		return nil, nil
+	}
+	// check the example as it is served, with JSON numbers
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("encoding example - %v", err)
+	}
+	var served interface{}
+	if err := json.Unmarshal(data, &served); err != nil {
+		return nil, fmt.Errorf("decoding example - %v", err)
+	}
+	if violations := doc.validate(s, served, where); len(violations) > 0 {
+		return nil, fmt.Errorf("unable to make an example for the schema, give one - %s", strings.Join(violations, "; "))
+	}
+	return value, nil
+}
+
+// exampleFor synthesizes a value that is valid for the schema, using the schema's own
+// examples, defaults and enums where given
+func (doc *openAPIDoc) exampleFor(s *openAPISchema, depth int) interface{} {
+	s = doc.schema(s)
+	if s == nil || depth > 8 {
+		return nil
+	}
+	switch {
+	case s.Example != nil:
+		return s.Example
+	case s.Default != nil:
+		return s.Default
+	case len(s.Enum) > 0:
+		return s.Enum[0]
+	case len(s.AllOf) > 0:
+		merged := map[string]interface{}{}
+		for _, sub := range s.AllOf {
+			if obj, ok := doc.exampleFor(sub, depth+1).(map[string]interface{}); ok {
+				for k, v := range obj {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	case len(s.OneOf) > 0:
+		return doc.exampleFor(s.OneOf[0], depth+1)
+	case len(s.AnyOf) > 0:
+		return doc.exampleFor(s.AnyOf[0], depth+1)
+	}
+
+	switch s.Type {
+	case "array":
+		items := []interface{}{}
+		for i := 0; i < s.MinItems || i < 1; i++ {
+			if item := doc.exampleFor(s.Items, depth+1); item != nil {
+				items = append(items, item)
+			}
+		}
+		return items
+	case "integer":
+		switch {
+		case s.Minimum != nil:
+			return int64(math.Ceil(*s.Minimum))
+		case s.Maximum != nil && *s.Maximum < 0:
+			return int64(math.Floor(*s.Maximum))
+		}
+		return 0
+	case "number":
+		switch {
+		case s.Minimum != nil:
+			return *s.Minimum
+		case s.Maximum != nil && *s.Maximum < 0:
+			return *s.Maximum
+		}
+		return 0.0
+	case "boolean":
+		return true
+	case "string":
+		return exampleString(s)
+	case "object", "":
+		if s.Type == "" && len(s.Properties) == 0 {
+			return nil
+		}
+		obj := map[string]interface{}{}
+		for name, prop := range s.Properties {
+			if v := doc.exampleFor(prop, depth+1); v != nil {
+				obj[name] = v
+			}
+		}
+		return obj
+	}
+	return nil
+}
+
+// exampleString makes a string for the schema: one matching its pattern when it has one,
+// else one of its format, padded to minLength. Strings without a format are cut to
+// maxLength.
+func exampleString(s *openAPISchema) string {
+	if s.Pattern != "" {
+		if re, err := syntax.Parse(s.Pattern, syntax.Perl); err == nil {
+			if v, ok := patternExample(re.Simplify()); ok {
+				return v
+			}
+		}
+	}
+
+	var v string
+	switch s.Format {
+	case "date-time":
+		v = "2006-01-02T15:04:05Z"
+	case "date":
+		v = "2006-01-02"
+	case "uuid":
+		v = "00000000-0000-4000-8000-000000000000"
+	case "email":
+		v = "user@example.com"
+	case "uri", "url":
+		v = "https://example.com"
+	case "byte":
+		v = "c3RyaW5n"
+	default:
+		v = "string"
+		if s.MaxLength != nil && len(v) > *s.MaxLength {
+			v = v[:*s.MaxLength]
+		}
+	}
+	for len(v) < s.MinLength {
+		v += "x"
+	}
+	return v
+}
+
+// patternExample makes the shortest string matching the regular expression, if it can
+func patternExample(re *syntax.Regexp) (string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary, syntax.OpStar, syntax.OpQuest:
+		return "", true
+	case syntax.OpLiteral:
+		return string(re.Rune), true
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return "x", true
+	case syntax.OpCharClass:
+		return classExample(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return patternExample(re.Sub[0])
+	case syntax.OpRepeat:
+		sub, ok := patternExample(re.Sub[0])
+		return strings.Repeat(sub, re.Min), ok
+	case syntax.OpConcat:
+		var b strings.Builder
+		for _, sub := range re.Sub {
+			v, ok := patternExample(sub)
+			if !ok {
+				return "", false
+			}
+			b.WriteString(v)
+		}
+		return b.String(), true
+	case syntax.OpAlternate:
+		return patternExample(re.Sub[0])
+	}
+	return "", false
+}
+
+// classExample picks a character of a class given as ranges, preferring a letter or digit
+func classExample(ranges []rune) (string, bool) {
+	for _, r := range "aA0x_-. " {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= r && r <= ranges[i+1] {
+				return string(r), true
+			}
+		}
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i+1] >= ' ' {
+			return string(max(ranges[i], ' ')), true
+		}
+	}
+	return "", false
+}
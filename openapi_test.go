@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const sampleOpenAPI = `
+openapi: 3.0.3
+servers:
+  - url: https://api.example.com/v1
+paths:
+  /pets:
+    get:
+      operationId: listPets
+      responses:
+        "200":
+          description: all pets
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: "#/components/schemas/Pet"
+    post:
+      operationId: createPet
+      responses:
+        "201":
+          description: created
+          headers:
+            Location:
+              schema:
+                type: string
+              example: /v1/pets/1
+          content:
+            application/json:
+              example: {"id": 1, "name": "rex"}
+        "400":
+          $ref: "#/components/responses/Invalid"
+  /pets/{petId}:
+    get:
+      operationId: getPet
+      responses:
+        "200":
+          description: a pet
+          content:
+            application/json:
+              examples:
+                cat:
+                  value: {"id": 2, "name": "tom", "tag": "cat"}
+        "404":
+          description: not found
+  /pets/mine:
+    get:
+      responses:
+        "200":
+          description: my pet
+          content:
+            text/plain:
+              example: mine
+components:
+  responses:
+    Invalid:
+      description: invalid
+      content:
+        application/json:
+          schema:
+            type: object
+            properties:
+              error:
+                type: string
+                enum: [invalid]
+  schemas:
+    Pet:
+      type: object
+      required: [id, name]
+      properties:
+        id:
+          type: integer
+          format: int64
+          minimum: 1
+        name:
+          type: string
+        born:
+          type: string
+          format: date
+`
+
+func sampleOpenAPIFakes(t *testing.T, statuses []string, skip []string) map[string]*Fake {
+	doc, err := parseOpenAPI([]byte(sampleOpenAPI))
+	if err != nil {
+		t.Fatalf("got error parsing OpenAPI document - %v", err)
+	}
+	fakes, err := fakesFromOpenAPI(doc, statuses, skip)
+	if err != nil {
+		t.Fatalf("got error creating fakes - %v", err)
+	}
+	byName := make(map[string]*Fake)
+	for _, fake := range fakes {
+		byName[fake.Name] = fake
+	}
+	return byName
+}
+
+func TestOpenAPIFakes(t *testing.T) {
+	t.Log(">> verify responses come from examples, or are synthesized from the schema")
+	{
+		fakes := sampleOpenAPIFakes(t, []string{"2xx"}, nil)
+		if got, want := len(fakes), 4; got != want {
+			t.Fatalf("got %d fakes, want %d", got, want)
+		}
+		list := fakes["openapi: listPets"]
+		if got, want := list.ResponseBody, `[{"born":"2006-01-02","id":1,"name":"string"}]`; got != want {
+			t.Errorf("got synthesized body %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprintf("%s %v %t", list.HyjackPath, list.Methods, list.IsRegex), "/v1/pets [GET] false"; got != want {
+			t.Errorf("got match %s, want %s", got, want)
+		}
+
+		create := fakes["openapi: createPet"]
+		if got, want := create.ResponseCode, 201; got != want {
+			t.Errorf("got code %d, want %d", got, want)
+		}
+		if got, want := create.ResponseBody, `{"id":1,"name":"rex"}`; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(create.ResponseHeaders), "[Location: /v1/pets/1 Content-Type: application/json]"; got != want {
+			t.Errorf("got headers %s, want %s", got, want)
+		}
+
+		get := fakes["openapi: getPet"]
+		if got, want := fmt.Sprintf("%q %q", get.HyjackPath, get.Path), `"" "/v1/pets/{petId}"`; got != want {
+			t.Errorf("got hyjack and path %s, want %s", got, want)
+		}
+		if got, want := get.ResponseBody, `{"id":2,"name":"tom","tag":"cat"}`; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+
+		if got, want := fakes["openapi: GET /pets/mine"].ResponseBody, "mine"; got != want {
+			t.Errorf("got text body %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify param names are made valid for path templates")
+	{
+		template, templated := openAPIPathTemplate("/users/{user-id}/keys/{2fa}")
+		if got, want := fmt.Sprintf("%s %t", template, templated), "/users/{user_id}/keys/{_fa} true"; got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify the status preference picks the response")
+	{
+		fakes := sampleOpenAPIFakes(t, []string{"404", "400", "2xx"}, []string{"GET /pets/mine"})
+		if got, want := fakes["openapi: getPet"].ResponseCode, 404; got != want {
+			t.Errorf("got code %d, want %d", got, want)
+		}
+		if got, want := fakes["openapi: createPet"].ResponseBody, `{"error":"invalid"}`; got != want {
+			t.Errorf("got body %s from a $ref response, want %s", got, want)
+		}
+		if _, ok := fakes["openapi: GET /pets/mine"]; ok {
+			t.Error("got a fake for a skipped operation")
+		}
+	}
+
+	t.Log(">> verify synthesized examples meet the schema's constraints")
+	{
+		const constrained = `
+openapi: 3.0.3
+paths:
+  /codes:
+    get:
+      responses:
+        "200":
+          description: codes
+          headers:
+            X-Count:
+              schema:
+                type: integer
+                minimum: 1.5
+          content:
+            application/json:
+              schema:
+                type: object
+                properties:
+                  short:
+                    type: string
+                    maxLength: 3
+                  code:
+                    type: string
+                    pattern: "^[A-Z]{3}-[0-9]{2}$"
+                  balance:
+                    type: number
+                    maximum: -0.5
+`
+		doc, err := parseOpenAPI([]byte(constrained))
+		if err != nil {
+			t.Fatalf("got error parsing OpenAPI document - %v", err)
+		}
+		fakes, err := fakesFromOpenAPI(doc, []string{"2xx"}, nil)
+		if err != nil {
+			t.Fatalf("got error creating fakes - %v", err)
+		}
+		if got, want := fakes[0].ResponseBody, `{"balance":-0.5,"code":"AAA-00","short":"str"}`; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+		if got, want := fmt.Sprint(fakes[0].ResponseHeaders), "[X-Count: 2 Content-Type: application/json]"; got != want {
+			t.Errorf("got headers %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify schemas no example can be made for are rejected")
+	{
+		const unsatisfiable = `
+openapi: 3.0.3
+paths:
+  /codes:
+    get:
+      responses:
+        "200":
+          description: codes
+          content:
+            application/json:
+              schema:
+                type: string
+                minLength: 5
+                maxLength: 2
+`
+		doc, err := parseOpenAPI([]byte(unsatisfiable))
+		if err != nil {
+			t.Fatalf("got error parsing OpenAPI document - %v", err)
+		}
+		if _, err := fakesFromOpenAPI(doc, []string{"2xx"}, nil); err == nil {
+			t.Error("got no error for a schema no example meets")
+		}
+	}
+
+	t.Log(">> verify range responses such as 2XX are chosen after explicit codes")
+	{
+		const ranged = `
+openapi: 3.0.3
+paths:
+  /ranged:
+    get:
+      operationId: ranged
+      responses:
+        "2XX":
+          description: any success
+          content:
+            text/plain:
+              example: ranged
+        default:
+          description: anything else
+          content:
+            text/plain:
+              example: default
+  /explicit:
+    get:
+      operationId: explicit
+      responses:
+        "2XX":
+          description: any success
+          content:
+            text/plain:
+              example: ranged
+        "201":
+          description: created
+          content:
+            text/plain:
+              example: explicit
+`
+		doc, err := parseOpenAPI([]byte(ranged))
+		if err != nil {
+			t.Fatalf("got error parsing OpenAPI document - %v", err)
+		}
+		for _, test := range []struct {
+			statuses []string
+			want     string
+		}{
+			{[]string{"2xx"}, "ranged: 200 ranged, explicit: 201 explicit"},
+			{[]string{"204"}, "ranged: 204 ranged, explicit: 204 ranged"},
+			{[]string{"404", "201"}, "ranged: 201 ranged, explicit: 201 explicit"},
+			{[]string{"500"}, "ranged: 200 default, error"},
+		} {
+			var got []string
+			for _, path := range []string{"/ranged", "/explicit"} {
+				single := &openAPIDoc{OpenAPI: doc.OpenAPI, Paths: map[string]*openAPIPathItem{path: doc.Paths[path]}}
+				fakes, err := fakesFromOpenAPI(single, test.statuses, nil)
+				if err != nil {
+					got = append(got, "error")
+					continue
+				}
+				got = append(got, fmt.Sprintf("%s: %d %s", strings.TrimPrefix(fakes[0].Name, "openapi: "), fakes[0].ResponseCode, fakes[0].ResponseBody))
+			}
+			if got := strings.Join(got, ", "); got != test.want {
+				t.Errorf("%v: got %s, want %s", test.statuses, got, test.want)
+			}
+		}
+	}
+
+	t.Log(">> verify bad documents and statuses are rejected")
+	{
+		if _, err := parseOpenAPI([]byte(`swagger: "2.0"`)); err == nil {
+			t.Error("got no error for a swagger 2.0 document")
+		}
+		doc, _ := parseOpenAPI([]byte(sampleOpenAPI))
+		if _, err := fakesFromOpenAPI(doc, []string{"ok"}, nil); err == nil {
+			t.Error("got no error for an invalid status")
+		}
+	}
+}
+
+func TestOpenAPIServing(t *testing.T) {
+	defaultHyjackTestSetup()
+	doc, _ := parseOpenAPI([]byte(sampleOpenAPI))
+	fakes, err := fakesFromOpenAPI(doc, []string{"2xx"}, nil)
+	if err != nil {
+		t.Fatalf("got error creating fakes - %v", err)
+	}
+	for _, fake := range fakes {
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("got error preparing %s - %v", fake, err)
+		}
+	}
+	updateConfig(func(c *Config) { c.Fakes = append(c.Fakes, fakes...) })
+
+	t.Log(">> verify literal paths win over templates, and other paths are proxied")
+	{
+		for path, want := range map[string]string{
+			"/v1/pets/mine": "200 mine",
+			"/v1/pets/7":    `200 {"id":2,"name":"tom","tag":"cat"}`,
+			"/v1/owners":    "200 proxied",
+		} {
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path))
+			if err != nil {
+				t.Fatalf("error performing HTTP request - %v", err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := fmt.Sprintf("%d %s", resp.StatusCode, body); got != want {
+				t.Errorf("%s: got %q, want %q", path, got, want)
+			}
+		}
+	}
+
+	t.Log(">> verify templated segments are captured as params, as for hand written fakes")
+	{
+		doWithHeaders(t, "/v1/pets/7", map[string]string{"X-Request-Id": "openapi-params"})
+		entry := harEntryFor(t, "openapi-params")
+		if got, want := fmt.Sprintf("%s %v", entry.Fake, entry.Params), "openapi: getPet map[petId:7]"; got != want {
+			t.Errorf("got fake and params %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// pathParamTypes are the values a typed path param such as {id:int} matches
+var pathParamTypes = map[string]string{
+	"":      `[^/]+`,
+	"int":   `-?[0-9]+`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	"alpha": `[a-zA-Z]+`,
+}
+
+var pathParamName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// pathPattern is a compiled path template, see compilePathPattern
+type pathPattern struct {
+	regex *regexp.Regexp
+	names []string
+	// prefix is the literal text every matching path starts with
+	prefix string
+}
+
+// compilePathPattern compiles a path template such as /users/{id:int}/**. {name} matches a
+// path segment and captures it as the param name, and {name:type} only matches an int, a
+// uuid or alpha characters. * matches within a segment, and ** any number of segments
+// (including none, so /files/** matches /files too). Everything else matches as is.
+func compilePathPattern(path string) (*pathPattern, error) {
+	p := &pathPattern{}
+	expr := "^"
+	for i := 0; i < len(path); {
+		switch {
+		case path[i] == '{':
+			end := strings.IndexByte(path[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("missing } for the param at %q", path[i:])
+			}
+			name, kind, _ := strings.Cut(path[i+1:i+end], ":")
+			if !pathParamName.MatchString(name) {
+				return nil, fmt.Errorf("invalid param name %q", name)
+			}
+			class, ok := pathParamTypes[kind]
+			if !ok {
+				return nil, fmt.Errorf("param %s has unknown type %q (want int, uuid or alpha)", name, kind)
+			}
+			for _, existing := range p.names {
+				if existing == name {
+					return nil, fmt.Errorf("param %s is used twice", name)
+				}
+			}
+			p.names = append(p.names, name)
+			expr += "(" + class + ")"
+			i += end + 1
+		case segmentsGlob(path, i):
+			expr += "(?:/.*)?"
+			i += 3
+		case strings.HasPrefix(path[i:], "**"):
+			expr += ".*"
+			i += 2
+		case path[i] == '*':
+			expr += "[^/]*"
+			i++
+		default:
+			end := i + 1
+			for end < len(path) && path[end] != '{' && path[end] != '*' && !segmentsGlob(path, end) {
+				end++
+			}
+			if i == len(p.prefix) {
+				p.prefix = path[:end]
+			}
+			expr += regexp.QuoteMeta(path[i:end])
+			i = end
+		}
+	}
+
+	var err error
+	if p.regex, err = regexp.Compile(expr + "$"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// segmentsGlob reports if a /** glob that spans whole segments starts at i
+func segmentsGlob(path string, i int) bool {
+	return strings.HasPrefix(path[i:], "/**") && (i+3 == len(path) || path[i+3] == '/')
+}
+
+// match reports if the path matches, with the params it captured
+func (p *pathPattern) match(path string) (map[string]string, bool) {
+	m := p.regex.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+	if len(p.names) == 0 {
+		return nil, true
+	}
+	params := make(map[string]string, len(p.names))
+	for i, name := range p.names {
+		params[name] = m[i+1]
+	}
+	return params, true
+}
+
+// fakeTemplateData is available to the body and headers of fakes with template set
+type fakeTemplateData struct {
+	Params map[string]string
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+func newFakeTemplateData(r *http.Request, params map[string]string) *fakeTemplateData {
+	if params == nil {
+		params = map[string]string{}
+	}
+	return &fakeTemplateData{
+		Params: params,
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+	}
+}
+
+// parseTemplates parses the response's body and headers as templates
+func (resp *FakeResponse) parseTemplates() error {
+	var err error
+	if resp.bodyTemplate, err = template.New("body").Parse(resp.ResponseBody); err != nil {
+		return err
+	}
+	resp.headerTemplates = make([]*template.Template, len(resp.ResponseHeaders))
+	for i, header := range resp.ResponseHeaders {
+		if resp.headerTemplates[i], err = template.New("header").Parse(header); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render executes the response's body and header templates
+func (resp *FakeResponse) render(data *fakeTemplateData) (string, StringSlice, error) {
+	if resp.bodyTemplate == nil {
+		// the fake was not prepared; parse a copy as responses are shared between requests
+		parsed := *resp
+		if err := parsed.parseTemplates(); err != nil {
+			return "", nil, err
+		}
+		resp = &parsed
+	}
+	var body strings.Builder
+	if err := resp.bodyTemplate.Execute(&body, data); err != nil {
+		return "", nil, err
+	}
+	headers := make(StringSlice, len(resp.headerTemplates))
+	for i, tmpl := range resp.headerTemplates {
+		var header strings.Builder
+		if err := tmpl.Execute(&header, data); err != nil {
+			return "", nil, err
+		}
+		headers[i] = header.String()
+	}
+	return body.String(), headers, nil
+}
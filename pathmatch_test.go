@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestPathPattern(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		match         bool
+		params        string
+	}{
+		{"/api/users/{id}", "/api/users/42", true, "map[id:42]"},
+		{"/api/users/{id}", "/api/users/42/credits", false, ""},
+		{"/api/users/{id:int}/credits.json", "/api/users/42/credits.json", true, "map[id:42]"},
+		{"/api/users/{id:int}/credits.json", "/api/users/me/credits.json", false, ""},
+		{"/api/users/{id:int}/credits.json", "/api/users/42/creditsxjson", false, ""},
+		{"/orders/{order:uuid}", "/orders/3f2c6a8e-9a1b-4c7e-8d2f-0a1b2c3d4e5f", true, "map[order:3f2c6a8e-9a1b-4c7e-8d2f-0a1b2c3d4e5f]"},
+		{"/orders/{order:uuid}", "/orders/42", false, ""},
+		{"/{lang:alpha}/docs", "/en/docs", true, "map[lang:en]"},
+		{"/{org}/{repo}/issues", "/golang/go/issues", true, "map[org:golang repo:go]"},
+		{"/static/*.css", "/static/site.css", true, "map[]"},
+		{"/static/*.css", "/static/css/site.css", false, ""},
+		{"/files/**", "/files", true, "map[]"},
+		{"/files/**", "/files/a/b/c.txt", true, "map[]"},
+		{"/files/**", "/filesystem", false, ""},
+		{"/a/**/z", "/a/z", true, "map[]"},
+		{"/a/**/z", "/a/b/c/z", true, "map[]"},
+		{"/v1/**.json", "/v1/a/b.json", true, "map[]"},
+		{"/users/{id}/**", "/users/7/posts/1", true, "map[id:7]"},
+	}
+	for _, c := range cases {
+		p, err := compilePathPattern(c.pattern)
+		if err != nil {
+			t.Fatalf("%s: got error %v", c.pattern, err)
+		}
+		params, ok := p.match(c.path)
+		if ok != c.match {
+			t.Errorf("%s matching %s: got %t, want %t", c.pattern, c.path, ok, c.match)
+		} else if ok && fmt.Sprint(params) != c.params {
+			t.Errorf("%s matching %s: got params %v, want %s", c.pattern, c.path, params, c.params)
+		}
+	}
+
+	for pattern, want := range map[string]string{
+		"/users/{id":          `missing } for the param at "{id"`,
+		"/users/{}":           `invalid param name ""`,
+		"/users/{id:float}":   `param id has unknown type "float" (want int, uuid or alpha)`,
+		"/users/{id}/{id}":    "param id is used twice",
+		"/users/{user-id}/me": `invalid param name "user-id"`,
+	} {
+		if _, err := compilePathPattern(pattern); err == nil || err.Error() != want {
+			t.Errorf("%s: got error %v, want %s", pattern, err, want)
+		}
+	}
+}
+
+func TestPathTemplateFakes(t *testing.T) {
+	defaultHyjackTestSetup()
+	fakes := []*Fake{
+		{Path: "/api/users/{id:int}/credits.json", Template: true, ResponseHeaders: StringSlice{"X-User: {{.Params.id}}"}, ResponseBody: `{"user": {{.Params.id}}, "currency": "{{.Query.Get "currency"}}"}`},
+		{Path: "/api/users/{name}", Methods: StringSlice{"GET"}, ResponseBody: "{{.Params.name}} is left as is"},
+		{Path: "/broken/{id}", Template: true, ResponseBody: "{{.Params.id.Nope}}"},
+	}
+	for _, fake := range fakes {
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("got error preparing %s - %v", fake, err)
+		}
+	}
+	updateConfig(func(c *Config) { c.Fakes = append(fakes, c.Fakes...) })
+
+	t.Log(">> verify typed params are captured and rendered into the template")
+	{
+		resp, body := doWithHeaders(t, "/api/users/42/credits.json?currency=EUR", map[string]string{"X-Request-Id": "path-template"})
+		if got, want := body, `{"user": 42, "currency": "EUR"}`; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+		if got, want := resp.Header.Get("X-User"), "42"; got != want {
+			t.Errorf("got X-User header %q, want %q", got, want)
+		}
+		entry := harEntryFor(t, "path-template")
+		if got, want := fmt.Sprintf("%s %v", entry.Fake, entry.Params), "fakes[0] map[id:42]"; got != want {
+			t.Errorf("got fake and params %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify a value of the wrong type falls through to the next fake")
+	{
+		_, body := doWithHeaders(t, "/api/users/me/credits.json", nil)
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+		_, body = doWithHeaders(t, "/api/users/me", nil)
+		if got, want := body, "{{.Params.name}} is left as is"; got != want {
+			t.Errorf("got body %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify template errors answer 500")
+	{
+		resp, _ := doWithHeaders(t, "/broken/1", nil)
+		if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+			t.Errorf("got status %d, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify hyjack and path cannot both be set")
+	{
+		fake := &Fake{HyjackPath: "/a", Path: "/a/{id}"}
+		if err := fake.prepare(); err == nil {
+			t.Error("got no error, want one")
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoRegistry holds the messages and service methods of protobuf descriptor sets, as
+// written by protoc --descriptor_set_out --include_imports, so messages written as JSON in
+// the config can be encoded
+type protoRegistry struct {
+	files *protoregistry.Files
+	// types resolves the messages of the files, for google.protobuf.Any
+	types *dynamicpb.Types
+	// methods are keyed by their gRPC path, /package.Service/Method
+	methods map[string]*protoMethod
+}
+
+type protoMethod struct {
+	input, output                    string
+	clientStreaming, serverStreaming bool
+}
+
+// loadDescriptorSets reads protobuf descriptor set files
+func loadDescriptorSets(paths []string) (*protoRegistry, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// files of several sets are gathered, so each set can import the others' files
+		var s descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("%s: invalid descriptor set - %v", path, err)
+		}
+		set.File = append(set.File, s.File...)
+	}
+	return newProtoRegistry(set)
+}
+
+// newProtoRegistry builds the registry of the descriptor set's files. Files given more than
+// once, such as a shared import, are kept once.
+func newProtoRegistry(set *descriptorpb.FileDescriptorSet) (*protoRegistry, error) {
+	seen := make(map[string]bool)
+	unique := &descriptorpb.FileDescriptorSet{}
+	for _, file := range set.File {
+		if !seen[file.GetName()] {
+			seen[file.GetName()] = true
+			unique.File = append(unique.File, file)
+		}
+	}
+	files, err := protodesc.NewFiles(unique)
+	if err != nil {
+		return nil, fmt.Errorf("%v (build descriptor sets with protoc --include_imports)", err)
+	}
+
+	reg := &protoRegistry{files: files, types: dynamicpb.NewTypes(files), methods: make(map[string]*protoMethod)}
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		services := file.Services()
+		for i := 0; i < services.Len(); i++ {
+			service := services.Get(i)
+			methods := service.Methods()
+			for j := 0; j < methods.Len(); j++ {
+				m := methods.Get(j)
+				reg.methods["/"+string(service.FullName())+"/"+string(m.Name())] = &protoMethod{
+					input:           string(m.Input().FullName()),
+					output:          string(m.Output().FullName()),
+					clientStreaming: m.IsStreamingClient(),
+					serverStreaming: m.IsStreamingServer(),
+				}
+			}
+		}
+		return true
+	})
+	return reg, nil
+}
+
+// encodeJSON encodes a message written in the protobuf JSON mapping, where fields are given
+// by name or JSON name
+func (reg *protoRegistry) encodeJSON(typeName string, data []byte) ([]byte, error) {
+	desc, err := reg.files.FindDescriptorByName(protoreflect.FullName(typeName))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type %s", typeName)
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message type", typeName)
+	}
+	msg := dynamicpb.NewMessage(md)
+	if err := (protojson.UnmarshalOptions{Resolver: reg.types}).Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("%s: %v", typeName, err)
+	}
+	// deterministic, so map entries are always encoded in the same order
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
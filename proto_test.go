@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testField describes a field of a test message
+func testField(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, kind descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+	field := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: label.Enum(), Type: kind.Enum()}
+	if typeName != "" {
+		field.TypeName = proto.String(typeName)
+	}
+	return field
+}
+
+// testDescriptorSet is the descriptor set of test.proto, with its import:
+//
+//	syntax = "proto3";
+//	package test.v1;
+//	import "google/protobuf/timestamp.proto";
+//	enum Kind { KIND_UNKNOWN = 0; KIND_BOOK = 1; }
+//	message Item {
+//	  string name = 1; int32 count = 2; repeated int64 ids = 3; Kind kind = 4;
+//	  map<string, string> tags = 5; Item child = 6; bytes raw = 7; double score = 8;
+//	  sint32 delta = 9; google.protobuf.Timestamp created = 10;
+//	  oneof price { uint32 cents = 11; string label = 12; }
+//	  string next_page_token = 13;
+//	}
+//	message GetRequest { string name = 1; }
+//	service Items {
+//	  rpc Get(GetRequest) returns (Item);
+//	  rpc List(GetRequest) returns (stream Item);
+//	}
+func testDescriptorSet() *descriptorpb.FileDescriptorSet {
+	const (
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	)
+	cents := testField("cents", 11, optional, descriptorpb.FieldDescriptorProto_TYPE_UINT32, "")
+	cents.OneofIndex = proto.Int32(0)
+	label := testField("label", 12, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")
+	label.OneofIndex = proto.Int32(0)
+
+	item := &descriptorpb.DescriptorProto{
+		Name: proto.String("Item"),
+		Field: []*descriptorpb.FieldDescriptorProto{
+			testField("name", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+			testField("count", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+			testField("ids", 3, repeated, descriptorpb.FieldDescriptorProto_TYPE_INT64, ""),
+			testField("kind", 4, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.v1.Kind"),
+			testField("tags", 5, repeated, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.v1.Item.TagsEntry"),
+			testField("child", 6, optional, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.v1.Item"),
+			testField("raw", 7, optional, descriptorpb.FieldDescriptorProto_TYPE_BYTES, ""),
+			testField("score", 8, optional, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, ""),
+			testField("delta", 9, optional, descriptorpb.FieldDescriptorProto_TYPE_SINT32, ""),
+			testField("created", 10, optional, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp"),
+			cents,
+			label,
+			testField("next_page_token", 13, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+		},
+		NestedType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("TagsEntry"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				testField("key", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				testField("value", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+			},
+			Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+		}},
+		OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("price")}},
+	}
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test.proto"),
+		Package:    proto.String("test.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			item,
+			{Name: proto.String("GetRequest"), Field: []*descriptorpb.FieldDescriptorProto{testField("name", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING, "")}},
+		},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Kind"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("KIND_UNKNOWN"), Number: proto.Int32(0)},
+				{Name: proto.String("KIND_BOOK"), Number: proto.Int32(1)},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Items"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("Get"), InputType: proto.String(".test.v1.GetRequest"), OutputType: proto.String(".test.v1.Item")},
+				{Name: proto.String("List"), InputType: proto.String(".test.v1.GetRequest"), OutputType: proto.String(".test.v1.Item"), ServerStreaming: proto.Bool(true)},
+			},
+		}},
+	}
+	timestamp := protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto)
+	return &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{timestamp, file}}
+}
+
+// writeDescriptorSet writes the descriptor set to a file in a temp dir
+func writeDescriptorSet(t *testing.T, set *descriptorpb.FileDescriptorSet) string {
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("unable to encode descriptor set - %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "test.protoset")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("unable to write descriptor set - %v", err)
+	}
+	return path
+}
+
+func TestProtoRegistry(t *testing.T) {
+	protos, err := loadDescriptorSets([]string{writeDescriptorSet(t, testDescriptorSet())})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	t.Log(">> verify services are keyed by their gRPC path")
+	{
+		m := protos.methods["/test.v1.Items/List"]
+		if m == nil {
+			t.Fatalf("got no method /test.v1.Items/List in %v", protos.methods)
+		}
+		if got, want := m.input+" "+m.output, "test.v1.GetRequest test.v1.Item"; got != want {
+			t.Errorf("got types %s, want %s", got, want)
+		}
+		if !m.serverStreaming {
+			t.Errorf("got List not server streaming")
+		}
+		if protos.methods["/test.v1.Items/Get"].serverStreaming {
+			t.Errorf("got Get server streaming")
+		}
+	}
+
+	t.Log(">> verify messages written as JSON are encoded")
+	{
+		msg := `{"name": "a", "count": 2, "ids": [1, "300"], "kind": "KIND_BOOK", "tags": {"b": "2", "a": "1"},
+			"child": {"name": "c"}, "raw": "AQI=", "score": 1.5, "delta": -2, "created": "1970-01-01T00:00:01Z",
+			"cents": 5, "nextPageToken": "x"}`
+		data, err := protos.encodeJSON("test.v1.Item", []byte(msg))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		// ids are packed, tags are in key order, created is a Timestamp message and the
+		// price oneof comes after the other fields
+		want := "0a0161" + "1002" + "1a0301ac02" + "2001" + "2a060a0161120131" + "2a060a0162120132" +
+			"32030a0163" + "3a020102" + "41000000000000f83f" + "4803" + "52020801" + "6a0178" + "5805"
+		if got := hex.EncodeToString(data); got != want {
+			t.Errorf("got encoding %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify messages that do not fit the type are errors")
+	{
+		cases := map[string]string{
+			`{"nmae": "a"}`:               `unknown field "nmae"`,
+			`{"kind": "KIND_CD"}`:         `invalid value for enum field kind: "KIND_CD"`,
+			`{"count": "lots"}`:           `invalid value for int32 field count: "lots"`,
+			`{"child": {"x": 1}}`:         `unknown field "x"`,
+			`{"ids": 1}`:                  `unexpected token 1`,
+			`{"count": 5000000000}`:       `invalid value for int32 field count: 5000000000`,
+			`{"cents": 1, "label": "a"}`:  `oneof test.v1.Item.price is already set`,
+			`{"created": "yesterday"}`:    `invalid google.protobuf.Timestamp value`,
+			`{"tags": {"a": 1}}`:          `invalid value for string field value: 1`,
+			`{"name": "a", "name": "b"}`:  `duplicate field "name"`,
+			`{"child": {"name": "a"}} {}`: `unexpected token`,
+		}
+		for msg, want := range cases {
+			_, err := protos.encodeJSON("test.v1.Item", []byte(msg))
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v for %s, want one containing %q", err, msg, want)
+			}
+		}
+		if _, err := protos.encodeJSON("test.v1.Kind", []byte(`{}`)); err == nil {
+			t.Error("got no error encoding an enum type as a message")
+		}
+	}
+
+	t.Log(">> verify descriptor sets without their imports are rejected")
+	{
+		set := testDescriptorSet()
+		set.File = set.File[1:]
+		if _, err := loadDescriptorSets([]string{writeDescriptorSet(t, set)}); err == nil || !strings.Contains(err.Error(), "--include_imports") {
+			t.Errorf("got error %v, want one suggesting --include_imports", err)
+		}
+	}
+
+	t.Log(">> verify imports shared by several descriptor sets are loaded once")
+	{
+		path := writeDescriptorSet(t, testDescriptorSet())
+		if _, err := loadDescriptorSets([]string{path, path}); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+	}
+}
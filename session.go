@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionHeader carries the session a request belongs to
+	sessionHeader = "X-Fakettp-Session"
+	// sessionPathPrefix is the alternative to sessionHeader: /__session/<id>/path is served
+	// as /path in session id
+	sessionPathPrefix = "/__session/"
+)
+
+var sessionIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// session scopes fakes to the requests carrying its id, so test suites running in parallel
+// against one fakettp do not see each other's fakes. Requests in a session try the
+// session's fakes before the global ones. A session keeps its own journal, sticky
+// X-Return-* overrides and position in the sequences of the fakes it is served, whether
+// its own or global ones.
+//
+// Like the config holding it, a session is not changed once stored: adding fakes replaces
+// it with a session sharing the journal, overrides and sequences.
+type session struct {
+	id      string
+	created time.Time
+	fakes   []*Fake
+
+	index     *fakeIndex
+	journal   *journal
+	overrides *overrideStore
+	sequences *sequenceCounters
+}
+
+func newSession(id string, fakes []*Fake) *session {
+	s := &session{
+		id:        id,
+		created:   time.Now(),
+		journal:   newJournal(exchanges.size, exchanges.bodyLimit),
+		overrides: &overrideStore{overrides: make(map[string]*returnOverride)},
+		sequences: &sequenceCounters{served: make(map[*Fake]uint64)},
+	}
+	return s.withFakes(fakes)
+}
+
+// sequenceCounters keep a session's position in the sequences of the fakes it is served
+type sequenceCounters struct {
+	sync.Mutex
+	served map[*Fake]uint64
+}
+
+// next returns the position of the fake's next response in its sequence, counting it
+func (c *sequenceCounters) next(f *Fake) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	n := c.served[f]
+	c.served[f] = n + 1
+	return n
+}
+
+// withFakes returns a copy of the session with the fakes added
+func (s *session) withFakes(fakes []*Fake) *session {
+	updated := *s
+	updated.fakes = append(append([]*Fake(nil), s.fakes...), fakes...)
+	updated.index = newLabelledFakeIndex(updated.fakes, "session:")
+	return &updated
+}
+
+// sessionID reads the session of the request from its X-Fakettp-Session header, or from a
+// /__session/<id>/ path prefix, which is removed from the request
+func sessionID(r *http.Request) (string, *http.Request) {
+	if id := r.Header.Get(sessionHeader); id != "" {
+		return id, r
+	}
+	if !strings.HasPrefix(r.URL.Path, sessionPathPrefix) {
+		return "", r
+	}
+
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, sessionPathPrefix), "/")
+	r = r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = "/"+rest, ""
+	r.URL = &u
+	r.RequestURI = u.RequestURI()
+	return id, r
+}
+
+type requestSessionKey struct{}
+
+// withSession sets the session the request belongs to
+func withSession(r *http.Request, s *session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestSessionKey{}, s))
+}
+
+// requestSession returns the session the request belongs to, nil if none
+func requestSession(r *http.Request) *session {
+	s, _ := r.Context().Value(requestSessionKey{}).(*session)
+	return s
+}
+
+// sessionSummary describes a session in the admin API
+type sessionSummary struct {
+	ID         string    `json:"id"`
+	Header     string    `json:"header"`
+	PathPrefix string    `json:"path_prefix"`
+	Created    time.Time `json:"created"`
+	Fakes      []*Fake   `json:"fakes"`
+	Exchanges  int       `json:"exchanges"`
+}
+
+func (s *session) summary() *sessionSummary {
+	return &sessionSummary{
+		ID:         s.id,
+		Header:     sessionHeader + ": " + s.id,
+		PathPrefix: sessionPathPrefix + s.id,
+		Created:    s.created,
+		Fakes:      s.fakes,
+		Exchanges:  len(s.journal.list()),
+	}
+}
+
+// sessionsHandler serves the admin API for sessions:
+//
+//	GET    /sessions             lists the sessions
+//	POST   /sessions             creates a session from {"id": "...", "fakes": [...]}, where
+//	                             both are optional; the id is generated when not given
+//	GET    /sessions/<id>        describes a session
+//	DELETE /sessions/<id>        tears a session down
+//	POST   /sessions/<id>/fakes  adds fakes to a session, from {"fakes": [...]}
+//	GET    /sessions/<id>/har    exports the session's journal as a HAR file
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		sessions := currentConfig().sessionList()
+		summaries := make([]*sessionSummary, 0, len(sessions))
+		for _, s := range sessions {
+			summaries = append(summaries, s.summary())
+		}
+		writeJSON(w, http.StatusOK, summaries)
+	case id == "" && r.Method == http.MethodPost:
+		req, err := readSessionRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" {
+			req.ID = fmt.Sprintf("%08x", rand.Int31())
+		}
+		s, status, err := createSession(req.ID, req.Fakes)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		logger.Info("created session", "session", s.id, "fakes", len(s.fakes))
+		writeJSON(w, http.StatusCreated, s.summary())
+	case id == "":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case action == "" && r.Method == http.MethodGet, action == "har" && r.Method == http.MethodGet:
+		s := currentConfig().sessions[id]
+		if s == nil {
+			http.Error(w, fmt.Sprintf("no session %q", id), http.StatusNotFound)
+			return
+		}
+		if action == "har" {
+			writeJSON(w, http.StatusOK, newHAR(s.journal.list()))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.summary())
+	case action == "" && r.Method == http.MethodDelete:
+		if !deleteSession(id) {
+			http.Error(w, fmt.Sprintf("no session %q", id), http.StatusNotFound)
+			return
+		}
+		logger.Info("deleted session", "session", id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "fakes" && r.Method == http.MethodPost:
+		req, err := readSessionRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s, status, err := addSessionFakes(id, req.Fakes)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		logger.Info("added fakes to session", "session", id, "fakes", len(req.Fakes))
+		writeJSON(w, http.StatusOK, s.summary())
+	case action == "" || action == "har" || action == "fakes":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sessionRequest is the body of the admin requests creating a session or adding fakes to
+// one, where the id is ignored
+type sessionRequest struct {
+	ID    string  `json:"id"`
+	Fakes []*Fake `json:"fakes"`
+}
+
+// readSessionRequest decodes the JSON body of a session request, and prepares its fakes
+func readSessionRequest(r *http.Request) (*sessionRequest, error) {
+	req := &sessionRequest{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, req); err != nil {
+			return nil, fmt.Errorf("parsing request - %v", err)
+		}
+	}
+	for i, fake := range req.Fakes {
+		if fake == nil {
+			return nil, fmt.Errorf("fakes[%d]: empty fake", i)
+		}
+		if err := fake.prepare(); err != nil {
+			return nil, fmt.Errorf("fakes[%d]: %v", i, err)
+		}
+	}
+	return req, nil
+}
+
+// createSession stores a new session, returning the status to answer with on errors
+func createSession(id string, fakes []*Fake) (*session, int, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid session id %q (use up to 64 letters, digits, '.', '_' or '-')", id)
+	}
+	var s *session
+	var err error
+	updateConfig(func(c *Config) {
+		if c.sessions[id] != nil {
+			err = fmt.Errorf("session %q already exists", id)
+			return
+		}
+		s = newSession(id, fakes)
+		c.sessions[id] = s
+	})
+	if err != nil {
+		return nil, http.StatusConflict, err
+	}
+	return s, 0, nil
+}
+
+// addSessionFakes adds fakes to a stored session
+func addSessionFakes(id string, fakes []*Fake) (*session, int, error) {
+	var s *session
+	updateConfig(func(c *Config) {
+		if existing := c.sessions[id]; existing != nil {
+			s = existing.withFakes(fakes)
+			c.sessions[id] = s
+		}
+	})
+	if s == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("no session %q", id)
+	}
+	return s, 0, nil
+}
+
+// deleteSession removes a session, reporting if it existed
+func deleteSession(id string) bool {
+	found := false
+	updateConfig(func(c *Config) {
+		if _, found = c.sessions[id]; found {
+			delete(c.sessions, id)
+		}
+	})
+	return found
+}
+
+// sessionList returns the config's sessions by id
+func (c *Config) sessionList() []*session {
+	if c == nil {
+		return nil
+	}
+	sessions := make([]*session, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionAdmin sends a request to the sessions admin API, decoding the response into v
+func sessionAdmin(t *testing.T, method, path, body string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	adminMux().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if v != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("unable to parse response to %s %s - %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestSessions(t *testing.T) {
+	defaultHyjackTestSetup()
+
+	t.Log(">> verify sessions are created with their fakes")
+	{
+		for _, id := range []string{"alice", "bob"} {
+			var s sessionSummary
+			body := `{"id": "` + id + `", "fakes": [{"hyjack": "/session", "code": 200, "body": "` + id + `"}]}`
+			if got, want := sessionAdmin(t, "POST", "/sessions", body, &s), http.StatusCreated; got != want {
+				t.Fatalf("got status %d creating session %s, want %d", got, id, want)
+			}
+			if got, want := s.Header, "X-Fakettp-Session: "+id; got != want {
+				t.Errorf("got header %q, want %q", got, want)
+			}
+		}
+		if got, want := sessionAdmin(t, "POST", "/sessions", `{"id": "alice"}`, nil), http.StatusConflict; got != want {
+			t.Errorf("got status %d creating a session twice, want %d", got, want)
+		}
+		if got, want := sessionAdmin(t, "POST", "/sessions", `{"id": "no/slashes"}`, nil), http.StatusBadRequest; got != want {
+			t.Errorf("got status %d for an invalid id, want %d", got, want)
+		}
+		if got, want := sessionAdmin(t, "POST", "/sessions", `{"fakes": [{"hyjack": "/a", "path": "/a"}]}`, nil), http.StatusBadRequest; got != want {
+			t.Errorf("got status %d for an invalid fake, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify sessions are isolated, by header or path prefix")
+	{
+		_, body := doWithHeaders(t, "/session", map[string]string{"X-Fakettp-Session": "alice"})
+		if got, want := body, "alice"; got != want {
+			t.Errorf("got body %q for alice's header, want %q", got, want)
+		}
+		_, body = doWithHeaders(t, "/__session/bob/session", nil)
+		if got, want := body, "bob"; got != want {
+			t.Errorf("got body %q for bob's path prefix, want %q", got, want)
+		}
+		_, body = doWithHeaders(t, "/session", nil)
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("got body %q outside sessions, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify requests in a session fall through to the global fakes, without the session header")
+	{
+		_, body := doWithHeaders(t, "/bar", map[string]string{"X-Fakettp-Session": "alice"})
+		if got, want := body, "hyjacked"; got != want {
+			t.Errorf("got body %q, want %q", got, want)
+		}
+		_, body = doWithHeaders(t, "/headers", map[string]string{"X-Fakettp-Session": "alice"})
+		if strings.Contains(body, sessionHeader) {
+			t.Errorf("got the session header upstream, in %q", body)
+		}
+	}
+
+	t.Log(">> verify fakes added to a session keep their own sequences")
+	{
+		fakes := `{"fakes": [{"hyjack": "/seq", "sequence": [{"body": "1"}, {"body": "2"}]}]}`
+		for _, id := range []string{"alice", "bob"} {
+			if got, want := sessionAdmin(t, "POST", "/sessions/"+id+"/fakes", fakes, nil), http.StatusOK; got != want {
+				t.Fatalf("got status %d adding fakes to %s, want %d", got, id, want)
+			}
+		}
+		var got []string
+		for _, id := range []string{"alice", "alice", "bob"} {
+			_, body := doWithHeaders(t, "/seq", map[string]string{"X-Fakettp-Session": id})
+			got = append(got, body)
+		}
+		if got, want := strings.Join(got, ","), "1,2,1"; got != want {
+			t.Errorf("got bodies %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify sessions keep their own place in the sequences of global fakes")
+	{
+		fake := &Fake{HyjackPath: "/global-seq", Sequence: []*FakeResponse{{ResponseBody: "1"}, {ResponseBody: "2"}}}
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		updateConfig(func(c *Config) {
+			c.Fakes = append([]*Fake{fake}, c.Fakes...)
+		})
+		var got []string
+		for _, id := range []string{"alice", "alice", "bob", ""} {
+			headers := map[string]string{}
+			if id != "" {
+				headers["X-Fakettp-Session"] = id
+			}
+			_, body := doWithHeaders(t, "/global-seq", headers)
+			got = append(got, body)
+		}
+		if got, want := strings.Join(got, ","), "1,2,1,1"; got != want {
+			t.Errorf("got bodies %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify a session's exchanges are only in its own HAR")
+	{
+		doWithHeaders(t, "/session", map[string]string{"X-Fakettp-Session": "bob", "X-Request-Id": "bob-har"})
+		harHas := func(id string) bool {
+			var h harFile
+			sessionAdmin(t, "GET", "/sessions/"+id+"/har", "", &h)
+			for _, entry := range h.Log.Entries {
+				if entry.RequestID == "bob-har" {
+					return true
+				}
+			}
+			return false
+		}
+		// exchanges are recorded once the response is written
+		found := false
+		for deadline := time.Now().Add(time.Second); !found && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			found = harHas("bob")
+		}
+		if !found {
+			t.Error("got no entry for bob's request in bob's HAR")
+		}
+		if harHas("alice") {
+			t.Error("got bob's request in alice's HAR")
+		}
+	}
+
+	t.Log(">> verify deleted and unknown sessions are answered 404")
+	{
+		if got, want := sessionAdmin(t, "DELETE", "/sessions/alice", "", nil), http.StatusNoContent; got != want {
+			t.Errorf("got status %d deleting a session, want %d", got, want)
+		}
+		if got, want := sessionAdmin(t, "DELETE", "/sessions/alice", "", nil), http.StatusNotFound; got != want {
+			t.Errorf("got status %d deleting a session twice, want %d", got, want)
+		}
+		resp, _ := doWithHeaders(t, "/session", map[string]string{"X-Fakettp-Session": "alice"})
+		if got, want := resp.StatusCode, http.StatusNotFound; got != want {
+			t.Errorf("got status %d for a deleted session, want %d", got, want)
+		}
+
+		var sessions []sessionSummary
+		sessionAdmin(t, "GET", "/sessions", "", &sessions)
+		if got, want := len(sessions), 1; got != want || sessions[0].ID != "bob" {
+			t.Errorf("got sessions %+v, want only bob", sessions)
+		}
+	}
+}
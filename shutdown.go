@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthPath answers readiness checks, on the ports fakettp serves and on the admin port
+const healthPath = "/__health"
+
+// defaultDrainTimeout is how long in-flight requests are given to complete on shutdown
+const defaultDrainTimeout = 10 * time.Second
+
+// draining is set once fakettp starts shutting down, failing readiness checks
+var draining atomic.Bool
+
+// healthHandler answers 200 while fakettp serves, and 503 once it is draining
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"draining"}` + "\n"))
+		return
+	}
+	w.Write([]byte(`{"status":"ready"}` + "\n"))
+}
+
+// adminServer names the admin port among the open servers
+const adminServer = "admin"
+
+// openServer is a server with the listener it accepts connections on
+type openServer struct {
+	// name is the listener's name, mainListener for the top level port or adminServer
+	name   string
+	server *http.Server
+	ln     net.Listener
+	// tlsCert and tlsKey are set to serve with TLS
+	tlsCert, tlsKey string
+}
+
+// openServers listens on the top level port, the port of each listener and the admin port
+// when set, so their addresses are known before requests are served. A port of 0 picks a
+// free one.
+func openServers(c *Config) ([]*openServer, error) {
+	configs := []*Config{c}
+	for _, l := range c.Listeners {
+		configs = append(configs, c.listenerConfig(l.Name))
+	}
+
+	var servers []*openServer
+	open := func(s *openServer) error {
+		ln, err := net.Listen("tcp", s.server.Addr)
+		if err != nil {
+			return fmt.Errorf("%s: %v", s.name, err)
+		}
+		s.ln = ln
+		servers = append(servers, s)
+		return nil
+	}
+	for _, lc := range configs {
+		if err := open(&openServer{name: lc.listenerName(), server: newServer(lc), tlsCert: lc.TLSCert, tlsKey: lc.TLSKey}); err != nil {
+			closeServers(servers)
+			return nil, err
+		}
+	}
+	if c.AdminPort != 0 {
+		// the admin endpoints are only reachable where the fakes are, unless told otherwise
+		bind := c.AdminBind
+		if bind == "" {
+			bind = c.Bind
+		}
+		if bind == "" {
+			bind = "0.0.0.0"
+		}
+		admin := &http.Server{Addr: net.JoinHostPort(bind, strconv.Itoa(c.AdminPort)), Handler: adminMux()}
+		if err := open(&openServer{name: adminServer, server: admin}); err != nil {
+			closeServers(servers)
+			return nil, err
+		}
+	}
+	return servers, nil
+}
+
+// closeServers closes servers that have not been served yet
+func closeServers(servers []*openServer) {
+	for _, s := range servers {
+		s.ln.Close()
+	}
+}
+
+// serve serves requests until the server is shut down
+func (s *openServer) serve() error {
+	var err error
+	if s.tlsCert != "" {
+		err = s.server.ServeTLS(s.ln, s.tlsCert, s.tlsKey)
+	} else {
+		err = s.server.Serve(s.ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// readyInfo is published once fakettp listens, for harnesses to know where to reach it
+type readyInfo struct {
+	Addr      string            `json:"addr"`
+	Port      int               `json:"port"`
+	AdminAddr string            `json:"admin_addr,omitempty"`
+	Listeners map[string]string `json:"listeners,omitempty"`
+}
+
+func newReadyInfo(servers []*openServer) readyInfo {
+	var info readyInfo
+	for _, s := range servers {
+		addr := s.ln.Addr().String()
+		switch s.name {
+		case mainListener:
+			info.Addr, info.Port = addr, s.ln.Addr().(*net.TCPAddr).Port
+		case adminServer:
+			info.AdminAddr = addr
+		default:
+			if info.Listeners == nil {
+				info.Listeners = make(map[string]string)
+			}
+			info.Listeners[s.name] = addr
+		}
+	}
+	return info
+}
+
+// publishReady writes the addresses of the servers as a line of JSON to stdout when path
+// is -, and to the file at path otherwise. The file is renamed into place, so it is never
+// seen half written.
+func publishReady(path string, servers []*openServer, stdout io.Writer) error {
+	data, err := json.Marshal(newReadyInfo(servers))
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// shutdown fails readiness checks, and keeps serving for delay so they are seen before it
+// stops the servers accepting requests. It then waits up to timeout for the in-flight ones
+// to complete, closing the connections of those that do not. The admin port is shut down
+// last, so it reports the drain. Hijacked connections, such as websockets, are not waited on.
+func shutdown(servers []*openServer, delay, timeout time.Duration) error {
+	draining.Store(true)
+	time.Sleep(delay)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var errs []error
+	stop := func(servers []*openServer) {
+		var wg sync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *openServer) {
+				defer wg.Done()
+				if err := s.server.Shutdown(ctx); err != nil {
+					s.server.Close()
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %v", s.name, err))
+					mu.Unlock()
+				}
+			}(s)
+		}
+		wg.Wait()
+	}
+
+	var fakes, admin []*openServer
+	for _, s := range servers {
+		if s.name == adminServer {
+			admin = append(admin, s)
+		} else {
+			fakes = append(fakes, s)
+		}
+	}
+	stop(fakes)
+	stop(admin)
+	return errors.Join(errs...)
+}
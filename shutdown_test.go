@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	defaultHyjackTestSetup()
+
+	t.Log(">> verify readiness checks are answered ahead of fakes and the proxy")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, healthPath))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := fmt.Sprintf("%d %s", resp.StatusCode, body), "200 {\"status\":\"ready\"}\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got := resp.Header.Get("X-Request-Id"); got != "" {
+			t.Errorf("got request id %s, want readiness checks left out of the logs", got)
+		}
+	}
+
+	t.Log(">> verify readiness checks fail while draining")
+	{
+		draining.Store(true)
+		defer draining.Store(false)
+		rec := httptest.NewRecorder()
+		adminMux().ServeHTTP(rec, httptest.NewRequest("GET", healthPath, nil))
+		if got, want := fmt.Sprintf("%d %s", rec.Code, rec.Body), "503 {\"status\":\"draining\"}\n"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defaultHyjackTestSetup()
+	fake := &Fake{HyjackPath: "/draining", ResponseCode: http.StatusOK, ResponseBody: "done", ResponseTime: 300 * time.Millisecond}
+	if err := fake.prepare(); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	updateConfig(func(c *Config) {
+		c.Fakes = append(c.Fakes, fake)
+	})
+	defer draining.Store(false)
+
+	// start opens a server on a free port and makes a slow request to it, returning the
+	// server and the outcome of the request
+	start := func() ([]*openServer, chan string) {
+		servers, err := openServers(&Config{Bind: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		go servers[0].serve()
+		addr := servers[0].ln.Addr().String()
+
+		got := make(chan string, 1)
+		go func() {
+			resp, err := http.Get("http://" + addr + "/draining")
+			if err != nil {
+				got <- "error"
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				got <- "error"
+				return
+			}
+			got <- fmt.Sprintf("%d %s", resp.StatusCode, body)
+		}()
+		// let the request reach the fake
+		time.Sleep(100 * time.Millisecond)
+		return servers, got
+	}
+
+	t.Log(">> verify the addresses of servers on free ports are published")
+	{
+		servers, err := openServers(&Config{Bind: "127.0.0.1"})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		defer closeServers(servers)
+		addr := servers[0].ln.Addr().(*net.TCPAddr)
+		want := fmt.Sprintf(`{"addr":"%s","port":%d}`+"\n", addr, addr.Port)
+
+		stdout := &bytes.Buffer{}
+		if err := publishReady("-", servers, stdout); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got := stdout.String(); got != want {
+			t.Errorf("got %s on stdout, want %s", got, want)
+		}
+		path := filepath.Join(t.TempDir(), "ready.json")
+		if err := publishReady(path, servers, nil); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, err := ioutil.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("got %s (error %v) in the file, want %s", got, err, want)
+		}
+	}
+
+	t.Log(">> verify the admin port listens on the bind address unless admin_bind is set")
+	{
+		// find a free port for the admin port, which cannot be picked with 0
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		adminPort := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		for _, c := range []struct {
+			config   *Config
+			loopback bool
+		}{
+			{&Config{Bind: "127.0.0.1", AdminPort: adminPort}, true},
+			{&Config{Bind: "127.0.0.1", AdminBind: "0.0.0.0", AdminPort: adminPort}, false},
+		} {
+			servers, err := openServers(c.config)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			closeServers(servers)
+			addr := servers[len(servers)-1].ln.Addr().(*net.TCPAddr)
+			if got := addr.IP.IsLoopback(); got != c.loopback || addr.Port != adminPort {
+				t.Errorf("got admin address %s with bind %q and admin_bind %q, want loopback %t", addr, c.config.Bind, c.config.AdminBind, c.loopback)
+			}
+		}
+	}
+
+	t.Log(">> verify shutting down lets in-flight requests complete and refuses new ones")
+	{
+		servers, got := start()
+		if err := shutdown(servers, 0, time.Second); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		if got, want := <-got, "200 done"; got != want {
+			t.Errorf("got %s for the in-flight request, want %s", got, want)
+		}
+		if _, err := http.Get("http://" + servers[0].ln.Addr().String() + healthPath); err == nil {
+			t.Errorf("got no error for a request after shutting down, want one")
+		}
+		draining.Store(false)
+	}
+
+	t.Log(">> verify readiness checks fail during the drain delay, before connections are refused")
+	{
+		servers, got := start()
+		done := make(chan error, 1)
+		go func() { done <- shutdown(servers, 200*time.Millisecond, time.Second) }()
+		time.Sleep(50 * time.Millisecond)
+		resp, err := http.Get("http://" + servers[0].ln.Addr().String() + healthPath)
+		if err != nil {
+			t.Fatalf("got error %v during the drain delay, want a response", err)
+		}
+		resp.Body.Close()
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("got status %d during the drain delay, want %d", got, want)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		if got, want := <-got, "200 done"; got != want {
+			t.Errorf("got %s for the in-flight request, want %s", got, want)
+		}
+		draining.Store(false)
+	}
+
+	t.Log(">> verify requests still in flight after the drain timeout are cut off")
+	{
+		servers, got := start()
+		if err := shutdown(servers, 0, 50*time.Millisecond); err == nil {
+			t.Errorf("got no error, want one for the request cut off")
+		}
+		if got, want := <-got, "error"; got != want {
+			t.Errorf("got %s for the request cut off, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// liveConfig holds the config requests are served with. A config is never changed once it
+// is stored: changes are made to a copy that replaces it (see updateConfig), so a request
+// sees the same config from start to finish, and reloads and edits need no locking.
+var liveConfig atomic.Pointer[Config]
+
+// updateMu serializes updateConfig, so concurrent changes are not lost
+var updateMu sync.Mutex
+
+// currentConfig returns the config new requests are served with, nil before one is stored
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// storeConfig indexes the config's fakes, builds the configs of its listeners and makes it
+// the config new requests are served with. The config must not be changed afterwards.
+func storeConfig(c *Config) {
+	c.index = newFakeIndex(c.Fakes)
+	c.listeners = make(map[string]*Config, len(c.Listeners))
+	for _, l := range c.Listeners {
+		c.listeners[l.Name] = c.forListener(l)
+	}
+	liveConfig.Store(c)
+}
+
+// updateConfig applies change to a copy of the current config and stores the copy,
+// returning it. Fakes are shared with the current config, so change must replace a fake
+// rather than edit it.
+func updateConfig(change func(c *Config)) *Config {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	c := currentConfig().clone()
+	change(c)
+	storeConfig(c)
+	return c
+}
+
+// clone copies the config, with its own lists of the same fakes and sessions
+func (c *Config) clone() *Config {
+	if c == nil {
+		return &Config{sessions: make(map[string]*session)}
+	}
+	clone := *c
+	clone.Fakes = append([]*Fake(nil), c.Fakes...)
+	clone.index, clone.listeners = nil, nil
+	clone.sessions = make(map[string]*session, len(c.sessions))
+	for id, s := range c.sessions {
+		clone.sessions[id] = s
+	}
+	return &clone
+}
+
+type requestConfigKey struct{}
+
+// withConfig sets the config the request is served with
+func withConfig(r *http.Request, c *Config) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestConfigKey{}, c))
+}
+
+// requestConfig returns the config the request is served with, or the current config for
+// requests that did not go through the handler
+func requestConfig(r *http.Request) *Config {
+	if r != nil {
+		if c, ok := r.Context().Value(requestConfigKey{}).(*Config); ok {
+			return c
+		}
+	}
+	return currentConfig()
+}
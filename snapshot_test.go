@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConfigSnapshots(t *testing.T) {
+	saved := currentConfig()
+	defer liveConfig.Store(saved)
+	storeConfig(&Config{Fakes: []*Fake{{HyjackPath: "/a", ResponseBody: "a"}}})
+
+	t.Log(">> verify updates replace the config rather than change it")
+	{
+		before := currentConfig()
+		after := updateConfig(func(c *Config) {
+			c.ProxyPort = 1234
+			c.Fakes = append(c.Fakes, &Fake{HyjackPath: "/b", ResponseBody: "b"})
+		})
+		if got, want := fmt.Sprint(before.ProxyPort, len(before.Fakes)), "0 1"; got != want {
+			t.Errorf("got port and fakes %s in the old config, want %s", got, want)
+		}
+		if currentConfig() != after {
+			t.Error("got a different current config, want the updated one")
+		}
+		if m, _ := after.fakeIndex().lookup(httptest.NewRequest("GET", "/b", nil), nil); m == nil {
+			t.Error("got no match for the added fake")
+		}
+		if m, _ := before.fakeIndex().lookup(httptest.NewRequest("GET", "/b", nil), nil); m != nil {
+			t.Error("got a match for the added fake in the old config")
+		}
+	}
+
+	t.Log(">> verify requests keep the config they started with")
+	{
+		r := withConfig(httptest.NewRequest("GET", "/", nil), currentConfig())
+		updateConfig(func(c *Config) { c.ProxyPort = 5678 })
+		if got, want := requestConfig(r).ProxyPort, 1234; got != want {
+			t.Errorf("got port %d, want %d", got, want)
+		}
+		if got, want := requestConfig(httptest.NewRequest("GET", "/", nil)).ProxyPort, 5678; got != want {
+			t.Errorf("got port %d for a request outside the handler, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify concurrent updates and requests are race free and none are lost")
+	{
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				updateConfig(func(c *Config) {
+					c.Fakes = append(c.Fakes, &Fake{HyjackPath: fmt.Sprintf("/c%d", i), Sequence: []*FakeResponse{{ResponseBody: "1"}, {ResponseBody: "2"}}})
+				})
+			}(i)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				defaultHandler(rec, httptest.NewRequest("GET", "/a", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("got status %d, want %d", rec.Code, http.StatusOK)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, want := len(currentConfig().Fakes), 22; got != want {
+			t.Errorf("got %d fakes, want %d", got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamFormats are the content types set for each stream format, unless the fake's headers
+// set one
+var streamFormats = map[string]string{
+	"":       "",
+	"raw":    "",
+	"sse":    "text/event-stream",
+	"ndjson": "application/x-ndjson",
+}
+
+// FakeStream makes a fake answer with chunks written one after another, each after its own
+// delay and flushed as it is written, to fake Server-Sent Events, NDJSON feeds and long
+// chunked downloads
+type FakeStream struct {
+	// Format is sse to write each chunk as an event, ndjson to end each chunk with a
+	// newline, or raw (the default) to write chunks as they are
+	Format string         `json:"format,omitempty"`
+	Chunks []*StreamChunk `json:"chunks"`
+	// Loop starts over once the chunks are written, until the client goes away
+	Loop bool `json:"loop,omitempty"`
+	// DisconnectAfter drops the connection once that many chunks are written, without
+	// ending the response
+	DisconnectAfter int `json:"disconnect_after,omitempty"`
+}
+
+// StreamChunk is one of the chunks of a FakeStream
+type StreamChunk struct {
+	Data       string `json:"data,omitempty"`
+	DataBase64 string `json:"data_base64,omitempty"`
+	// Event, ID and Retry set the fields of the same name of sse events
+	Event    string        `json:"event,omitempty"`
+	ID       string        `json:"id,omitempty"`
+	Retry    int           `json:"retry,omitempty"`
+	DelayRaw string        `json:"delay,omitempty"`
+	Delay    time.Duration `json:"-"`
+}
+
+// prepare converts the stream's delays and base64 data for use
+func (s *FakeStream) prepare() error {
+	if _, ok := streamFormats[s.Format]; !ok {
+		return fmt.Errorf("unknown stream format %q (want sse, ndjson or raw)", s.Format)
+	}
+	if len(s.Chunks) == 0 {
+		return fmt.Errorf("stream has no chunks")
+	}
+	for i, chunk := range s.Chunks {
+		if chunk == nil {
+			return fmt.Errorf("chunks[%d]: empty chunk", i)
+		}
+		if chunk.DelayRaw != "" {
+			d, err := time.ParseDuration(chunk.DelayRaw)
+			if err != nil {
+				return fmt.Errorf("chunks[%d]: converting string delay to time duration - %v", i, err)
+			}
+			chunk.Delay = d
+		}
+		if chunk.DataBase64 != "" {
+			data, err := base64.StdEncoding.DecodeString(chunk.DataBase64)
+			if err != nil {
+				return fmt.Errorf("chunks[%d]: decoding data_base64 - %v", i, err)
+			}
+			chunk.Data = string(data)
+		}
+	}
+	return nil
+}
+
+// setContentType sets the content type of the stream's format, unless one is set
+func (s *FakeStream) setContentType(h http.Header) {
+	if contentType := streamFormats[s.Format]; contentType != "" && h.Get("Content-Type") == "" {
+		h.Set("Content-Type", contentType)
+	}
+	if s.Format == "sse" && h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "no-cache")
+	}
+}
+
+// encode returns the chunk as written in the stream's format
+func (s *FakeStream) encode(chunk *StreamChunk) string {
+	switch s.Format {
+	case "sse":
+		var b strings.Builder
+		if chunk.ID != "" {
+			b.WriteString("id: " + chunk.ID + "\n")
+		}
+		if chunk.Event != "" {
+			b.WriteString("event: " + chunk.Event + "\n")
+		}
+		if chunk.Retry > 0 {
+			b.WriteString("retry: " + strconv.Itoa(chunk.Retry) + "\n")
+		}
+		for _, line := range strings.Split(chunk.Data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+		b.WriteString("\n")
+		return b.String()
+	case "ndjson":
+		return chunk.Data + "\n"
+	}
+	return chunk.Data
+}
+
+// write streams the chunks once the response headers are written. It returns when the
+// chunks are written, or when the client goes away. Dropping the connection aborts the
+// handler with http.ErrAbortHandler.
+func (s *FakeStream) write(w http.ResponseWriter, r *http.Request) {
+	rl := reqLog(r)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	written := 0
+	for {
+		for _, chunk := range s.Chunks {
+			if chunk.Delay > 0 {
+				select {
+				case <-time.After(chunk.Delay):
+				case <-r.Context().Done():
+					rl.Info("client went away during stream", "chunks", written)
+					return
+				}
+			}
+			if _, err := w.Write([]byte(s.encode(chunk))); err != nil {
+				rl.Info("client went away during stream", "chunks", written, "error", err)
+				return
+			}
+			flush()
+			written++
+
+			if written == s.DisconnectAfter {
+				rl.Info("dropping stream connection", "chunks", written)
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if !s.Loop || r.Context().Err() != nil {
+			rl.Debug("stream complete", "chunks", written)
+			return
+		}
+	}
+}
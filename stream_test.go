@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamEncoding(t *testing.T) {
+	chunk := &StreamChunk{Data: "line 1\nline 2", Event: "update", ID: "7", Retry: 1000}
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{"sse", "id: 7\nevent: update\nretry: 1000\ndata: line 1\ndata: line 2\n\n"},
+		{"ndjson", "line 1\nline 2\n"},
+		{"raw", "line 1\nline 2"},
+	}
+	for _, c := range cases {
+		if got := (&FakeStream{Format: c.format}).encode(chunk); got != c.want {
+			t.Errorf("got %q for format %s, want %q", got, c.format, c.want)
+		}
+	}
+}
+
+func TestStreamingFakes(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.Fakes = append(c.Fakes,
+			&Fake{HyjackPath: "/events", Stream: &FakeStream{Format: "sse", Chunks: []*StreamChunk{
+				{Data: "first", ID: "1"},
+				{Data: "second", ID: "2", Delay: 300 * time.Millisecond},
+			}}},
+			&Fake{HyjackPath: "/feed", Stream: &FakeStream{Format: "ndjson", Loop: true, Chunks: []*StreamChunk{
+				{Data: `{"n":1}`}, {Data: `{"n":2}`, Delay: 5 * time.Millisecond},
+			}}},
+			&Fake{HyjackPath: "/download", ResponseHeaders: StringSlice{"Content-Type: application/octet-stream"}, Stream: &FakeStream{DisconnectAfter: 2, Chunks: []*StreamChunk{
+				{Data: "aaaa"}, {Data: "bbbb"}, {Data: "cccc"},
+			}}},
+		)
+	})
+	url := func(path string) string { return fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path) }
+
+	t.Log(">> verify sse events are flushed as they are written")
+	{
+		start := time.Now()
+		resp, err := http.Get(url("/events"))
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		defer resp.Body.Close()
+		if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+			t.Errorf("got content type %q, want %q", got, want)
+		}
+		reader := bufio.NewReader(resp.Body)
+		var first []string
+		for len(first) == 0 || first[len(first)-1] != "\n" {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("error reading the first event - %v", err)
+			}
+			first = append(first, line)
+		}
+		if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+			t.Errorf("got the first event after %v, want it before the second's delay", elapsed)
+		}
+		if got, want := strings.Join(first, ""), "id: 1\ndata: first\n\n"; got != want {
+			t.Errorf("got first event %q, want %q", got, want)
+		}
+		rest, _ := ioutil.ReadAll(reader)
+		if got, want := string(rest), "id: 2\ndata: second\n\n"; got != want {
+			t.Errorf("got second event %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify looping streams go on until the client goes away")
+	{
+		resp, err := http.Get(url("/feed"))
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		var lines []string
+		for len(lines) < 5 && scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		resp.Body.Close()
+		if got, want := strings.Join(lines, ","), `{"n":1},{"n":2},{"n":1},{"n":2},{"n":1}`; got != want {
+			t.Errorf("got lines %s, want %s", got, want)
+		}
+	}
+
+	t.Log(">> verify streams can drop the connection mid-stream")
+	{
+		resp, err := http.Get(url("/download"))
+		if err != nil {
+			t.Fatalf("error performing HTTP request - %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			t.Error("got the stream ended cleanly, want an error")
+		}
+		if got, want := string(body), "aaaabbbb"; got != want {
+			t.Errorf("got body %q before the disconnect, want %q", got, want)
+		}
+		if got, want := resp.Header.Get("Content-Type"), "application/octet-stream"; got != want {
+			t.Errorf("got content type %q, want %q", got, want)
+		}
+	}
+}
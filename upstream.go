@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// upstreamErrorData is available to the proxy_error_body template
+type upstreamErrorData struct {
+	Status int
+	Cause  string
+	Error  string
+	Method string
+	URL    string
+}
+
+// prepareErrorBody parses the proxy_error_body template, so it is not parsed again on
+// every upstream failure
+func (c *Config) prepareErrorBody() error {
+	c.errorBody = nil
+	if c.ProxyErrorBody == "" {
+		return nil
+	}
+	tmpl, err := template.New("proxy_error_body").Parse(c.ProxyErrorBody)
+	if err != nil {
+		return err
+	}
+	c.errorBody = tmpl
+	return nil
+}
+
+// newUpstreamTransport builds the transport used to reach ProxyHost, honoring the
+// configured dial, TLS and response header timeouts and the number of retries
+func newUpstreamTransport(c *Config) http.RoundTripper {
+	var transport http.RoundTripper = upstreamTransport(c)
+	if c.UpstreamHTTP2 {
+		alpn := upstreamTransport(c)
+		alpn.Protocols = new(http.Protocols)
+		alpn.Protocols.SetHTTP1(true)
+		alpn.Protocols.SetHTTP2(true)
+		transport = &http2Transport{alpn: alpn, h2c: newGRPCTransport(c)}
+	}
+	if c.ProxyRetries > 0 {
+		return &retryTransport{base: transport, retries: c.ProxyRetries}
+	}
+	return transport
+}
+
+// newGRPCTransport builds the transport gRPC calls are proxied with. gRPC needs HTTP/2,
+// so it is spoken without TLS (h2c) to http upstreams.
+func newGRPCTransport(c *Config) http.RoundTripper {
+	transport := upstreamTransport(c)
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return transport
+}
+
+// http2Transport proxies over HTTP/2 for upstream_http2. Upgrades cannot be made over
+// HTTP/2, so they stay on HTTP/1.
+type http2Transport struct {
+	// alpn negotiates HTTP/2 over TLS, and speaks HTTP/1 otherwise; h2c speaks HTTP/2
+	// without TLS
+	alpn, h2c http.RoundTripper
+}
+
+func (t *http2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && req.Header.Get("Upgrade") == "" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.alpn.RoundTrip(req)
+}
+
+// upstreamTransport builds a transport from http.DefaultTransport's settings, with the
+// timeouts that are configured in place of the defaults
+func upstreamTransport(c *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.ProxyDialTimeout != 0 {
+		dialer := &net.Dialer{
+			Timeout:   c.ProxyDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if c.ProxyTLSTimeout != 0 {
+		transport.TLSHandshakeTimeout = c.ProxyTLSTimeout
+	}
+	transport.ResponseHeaderTimeout = c.ProxyHeaderTimeout
+	return transport
+}
+
+// retryTransport retries idempotent requests that failed before any response was received
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	for attempt := 1; err != nil && attempt <= t.retries && canRetry(req); attempt++ {
+		if req.Context().Err() != nil {
+			break
+		}
+		reqLog(req).Warn("retrying upstream request", "attempt", attempt, "retries", t.retries, "cause", upstreamErrorCause(err), "error", err)
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				break
+			}
+		}
+		resp, err = t.base.RoundTrip(req)
+	}
+	return resp, err
+}
+
+// canRetry reports if the request is idempotent and its body (if any) can be sent again
+func canRetry(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// withProxyTimeout bounds the whole upstream exchange by the configured proxy_timeout
+func withProxyTimeout(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	if timeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// upstreamErrorCause classifies an upstream error as dial, timeout, tls or other
+func upstreamErrorCause(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timeout"
+	}
+
+	var recordErr tls.RecordHeaderError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &recordErr) || errors.As(err, &unknownAuthErr) || errors.As(err, &hostnameErr) || errors.As(err, &certErr) || strings.Contains(err.Error(), "tls: ") {
+		return "tls"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "dial"
+	}
+	return "other"
+}
+
+// writeUpstreamError responds to a failed upstream exchange. Timeouts are a 504 and all other
+// failures a 502, unless proxy_error_code says otherwise. The body comes from proxy_error_body.
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	cause := upstreamErrorCause(err)
+	status := http.StatusBadGateway
+	if cause == "timeout" {
+		status = http.StatusGatewayTimeout
+	}
+	config := requestConfig(r)
+	if config.ProxyErrorCode != 0 {
+		status = config.ProxyErrorCode
+	}
+	rl := reqLog(r)
+	rl.Error("upstream failure", "cause", cause, "status", status, "url", r.URL.String(), "error", err)
+
+	var body bytes.Buffer
+	if config.errorBody != nil {
+		data := upstreamErrorData{Status: status, Cause: cause, Error: err.Error(), Method: r.Method, URL: r.URL.String()}
+		if tmplErr := config.errorBody.Execute(&body, data); tmplErr != nil {
+			rl.Error("unable to render proxy_error_body", "error", tmplErr)
+			body.Reset()
+		}
+	}
+
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTimeout(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.ProxyTimeout = 50 * time.Millisecond
+		c.ProxyErrorBody = "{{.Cause}} {{.Method}} {{.URL}}"
+		c.prepareErrorBody()
+	})
+
+	t.Log(">> verify a slow upstream is answered with a 504 and the error body template")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/slow", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := string(body), "timeout GET http://0.0.0.0:4332/slow"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusGatewayTimeout; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+}
+
+func TestUpstreamUnreachable(t *testing.T) {
+	defaultHyjackTestSetup()
+	// nothing listens here
+	updateConfig(func(c *Config) {
+		c.ProxyPort = 4331
+		c.ProxyErrorCode = http.StatusServiceUnavailable
+		c.ProxyErrorBody = "{{.Cause}} {{.Status}}"
+		c.prepareErrorBody()
+	})
+
+	t.Log(">> verify an unreachable upstream uses the configured error code and body")
+	{
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/foo", currentConfig().Port))
+		if err != nil {
+			t.Fatalf("error getting url from proxy service - %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if got, want := string(body), "dial 503"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+}
+
+func TestPrepareErrorBody(t *testing.T) {
+	t.Log(">> verify the proxy_error_body template is parsed once, when the config is prepared")
+	{
+		c := &Config{ProxyErrorBody: "{{.Cause}}"}
+		if err := c.prepareErrorBody(); err != nil || c.errorBody == nil {
+			t.Fatalf("got template %v and error %v, want a template", c.errorBody, err)
+		}
+		c.ProxyErrorBody = "{{.Cause"
+		if err := c.prepareErrorBody(); err == nil || c.errorBody != nil {
+			t.Errorf("got template %v and error %v, want an error", c.errorBody, err)
+		}
+		c.ProxyErrorBody = ""
+		if err := c.prepareErrorBody(); err != nil || c.errorBody != nil {
+			t.Errorf("got template %v and error %v, want neither", c.errorBody, err)
+		}
+	}
+}
+
+// failingTransport fails the first n round trips
+type failingTransport struct {
+	n     int
+	calls int
+}
+
+func (t *failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.calls <= t.n {
+		return nil, errors.New("connection reset")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestUpstreamTransportDefaults(t *testing.T) {
+	defaults := http.DefaultTransport.(*http.Transport)
+
+	t.Log(">> verify unset timeouts keep the defaults of http.DefaultTransport")
+	{
+		transport := upstreamTransport(&Config{})
+		if got, want := transport.TLSHandshakeTimeout, defaults.TLSHandshakeTimeout; got != want || got == 0 {
+			t.Errorf("got TLS handshake timeout %v, want %v", got, want)
+		}
+		if transport.DialContext == nil || !transport.ForceAttemptHTTP2 {
+			t.Errorf("got dialer set %v and HTTP/2 attempted %v, want both", transport.DialContext != nil, transport.ForceAttemptHTTP2)
+		}
+	}
+
+	t.Log(">> verify configured timeouts replace the defaults")
+	{
+		transport := upstreamTransport(&Config{ProxyTLSTimeout: time.Second, ProxyHeaderTimeout: 2 * time.Second})
+		if got, want := fmt.Sprintf("%v %v", transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout), "1s 2s"; got != want {
+			t.Errorf("got timeouts %s, want %s", got, want)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Log(">> verify idempotent requests are retried")
+	{
+		base := &failingTransport{n: 2}
+		transport := &retryTransport{base: base, retries: 2}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		if got, want := base.calls, 3; got != want {
+			t.Errorf("got %d calls, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify non-idempotent requests are not retried")
+	{
+		base := &failingTransport{n: 1}
+		transport := &retryTransport{base: base, retries: 2}
+		req, _ := http.NewRequest("POST", "http://example.com/", nil)
+		if _, err := transport.RoundTrip(req); err == nil {
+			t.Errorf("got no error, want one")
+		}
+		if got, want := base.calls, 1; got != want {
+			t.Errorf("got %d calls, want %d", got, want)
+		}
+	}
+}
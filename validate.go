@@ -0,0 +1,702 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// configProblem is something wrong with a config, pointing at the fake and field it is in
+type configProblem struct {
+	// fake is the index of the fake, or -1 for the top level config
+	fake  int
+	field string
+	msg   string
+	// listener prefixes the fake when it is one of a listener's, as in listeners[0].
+	listener string
+
+	// warning problems do not stop fakettp from starting
+	warning bool
+}
+
+func (p configProblem) String() string {
+	where := p.field
+	if p.fake >= 0 {
+		where = fmt.Sprintf("%sfakes[%d]", p.listener, p.fake)
+		if p.field != "" {
+			where += "." + p.field
+		}
+	}
+	if where == "" {
+		return p.msg
+	}
+	return where + ": " + p.msg
+}
+
+// validateConfig checks a config, given as JSON, for everything that would make it fail at
+// startup or behave differently than it reads: bad regexes, durations, status codes,
+// headers, unknown fields, and fakes that can never match
+func validateConfig(data []byte) []configProblem {
+	var problems []configProblem
+	add := func(fake int, field, format string, args ...interface{}) {
+		problems = append(problems, configProblem{fake: fake, field: field, msg: fmt.Sprintf(format, args...)})
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		add(-1, "", "%v", err)
+		return problems
+	}
+	problems = append(problems, unknownFields(raw, reflect.TypeOf(Config{}), -1, "")...)
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		add(-1, "", "%v", err)
+		return problems
+	}
+
+	durations := []struct{ field, raw string }{
+		{"proxy_delay", config.ProxyDelayRaw},
+		{"proxy_dial_timeout", config.ProxyDialTimeoutRaw},
+		{"proxy_tls_timeout", config.ProxyTLSTimeoutRaw},
+		{"proxy_response_header_timeout", config.ProxyHeaderTimeoutRaw},
+		{"proxy_timeout", config.ProxyTimeoutRaw},
+	}
+	for _, d := range durations {
+		if msg := checkDuration(d.raw); msg != "" {
+			add(-1, d.field, "%s", msg)
+		}
+	}
+	if config.ProxyErrorCode != 0 && !validStatusCode(config.ProxyErrorCode) {
+		add(-1, "proxy_error_code", "%d is not a status code (want 100 to 599)", config.ProxyErrorCode)
+	}
+	if config.ProxyErrorBody != "" {
+		if _, err := template.New("proxy_error_body").Parse(config.ProxyErrorBody); err != nil {
+			add(-1, "proxy_error_body", "invalid template - %v", err)
+		}
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		add(-1, "tls_cert", "tls_cert and tls_key must be given together")
+	}
+
+	var protos *protoRegistry
+	if len(config.GRPCDescriptorSets) > 0 {
+		var err error
+		if protos, err = loadDescriptorSets(config.GRPCDescriptorSets); err != nil {
+			add(-1, "grpc_descriptor_sets", "%v", err)
+		}
+	}
+
+	problems = append(problems, validateFakes(config.Fakes, protos)...)
+
+	names, ports := make(map[string]int), make(map[string]string)
+	if config.Port != 0 {
+		ports[net.JoinHostPort(config.Bind, strconv.Itoa(config.Port))] = "port"
+	}
+	for i, l := range config.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		if l == nil {
+			add(-1, field, "empty listener")
+			continue
+		}
+		if l.Name == "" {
+			add(-1, field+".name", "a listener needs a name")
+		} else if l.Name == mainListener || l.Name == adminServer {
+			add(-1, field+".name", "the name %s is reserved", l.Name)
+		} else if j, ok := names[l.Name]; ok {
+			add(-1, field+".name", "%q is already the name of listeners[%d]", l.Name, j)
+		} else {
+			names[l.Name] = i
+		}
+		addr := net.JoinHostPort(l.Bind, strconv.Itoa(l.Port))
+		if l.Port == 0 {
+			add(-1, field+".port", "a listener needs a port")
+		} else if other, ok := ports[addr]; ok {
+			add(-1, field+".port", "%d is already the port of %s", l.Port, other)
+		} else {
+			ports[addr] = field
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			add(-1, field+".tls_cert", "tls_cert and tls_key must be given together")
+		}
+		for _, p := range validateFakes(l.Fakes, protos) {
+			p.listener = field + "."
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// validateFakes checks a list of fakes, each on its own and against the fakes before it
+func validateFakes(fakes []*Fake, protos *protoRegistry) []configProblem {
+	var problems []configProblem
+	add := func(fake int, field, format string, args ...interface{}) {
+		problems = append(problems, configProblem{fake: fake, field: field, msg: fmt.Sprintf(format, args...)})
+	}
+	warn := func(fake int, field, format string, args ...interface{}) {
+		problems = append(problems, configProblem{fake: fake, field: field, msg: fmt.Sprintf(format, args...), warning: true})
+	}
+
+	for i, fake := range fakes {
+		if fake == nil {
+			add(i, "", "empty fake")
+			continue
+		}
+		if fake.Path != "" {
+			if fake.HyjackPath != "" {
+				add(i, "path", "set either hyjack or path, not both")
+			}
+			if _, err := compilePathPattern(fake.Path); err != nil {
+				add(i, "path", "invalid path template - %v", err)
+			}
+			if fake.IsRegex {
+				warn(i, "pattern_match", "has no effect with path")
+			}
+		} else if fake.IsRegex {
+			if _, err := regexp.Compile(fake.HyjackPath); err != nil {
+				add(i, "hyjack", "invalid regular expression - %v", err)
+			}
+		} else if strings.Contains(fake.HyjackPath, "?") && !fake.UseRequestURI {
+			warn(i, "hyjack", "has a query string but request_uri is not set, so it never matches")
+		}
+		for _, method := range fake.Methods {
+			if !validHeaderName(method) {
+				add(i, "methods", "%q is not a method", method)
+			}
+		}
+		for _, status := range fake.FallbackStatus {
+			if !validStatusPattern(status) {
+				add(i, "fallback_status", "%q is not a code like 503 or a class like 5xx", status)
+			}
+		}
+		if len(fake.FallbackStatus) > 0 && !fake.Fallback {
+			warn(i, "fallback_status", "has no effect unless fallback is set")
+		}
+
+		if ws := fake.WebSocket; ws != nil {
+			messages := func(list []*WebSocketMessage, where string) {
+				for k, msg := range list {
+					field := fmt.Sprintf("websocket.%s[%d]", where, k)
+					if msg == nil {
+						add(i, field, "empty message")
+						continue
+					}
+					if msg := checkDuration(msg.DelayRaw); msg != "" {
+						add(i, field+".delay", "%s", msg)
+					}
+					if msg.Close != 0 && !validCloseCode(msg.Close) {
+						add(i, field+".close", "%d is not a close code (want 1000 to 4999)", msg.Close)
+					}
+					if msg.BinaryBase64 != "" {
+						if _, err := base64.StdEncoding.DecodeString(msg.BinaryBase64); err != nil {
+							add(i, field+".binary_base64", "invalid base64 - %v", err)
+						}
+					}
+				}
+			}
+			messages(ws.OnConnect, "on_connect")
+			for k, reply := range ws.Replies {
+				if reply == nil {
+					add(i, fmt.Sprintf("websocket.replies[%d]", k), "empty reply")
+					continue
+				}
+				if _, err := regexp.Compile(reply.Match); err != nil {
+					add(i, fmt.Sprintf("websocket.replies[%d].match", k), "invalid regular expression - %v", err)
+				}
+				messages(reply.Send, fmt.Sprintf("replies[%d].send", k))
+			}
+			if fake.Stream != nil {
+				warn(i, "stream", "is not used, the websocket conversation is played instead")
+			}
+		}
+
+		if g := fake.GRPC; g != nil {
+			if _, err := parseGRPCStatus(g.Status); err != nil {
+				add(i, "grpc.status", "%v", err)
+			}
+			if msg := checkDuration(g.MessageDelayRaw); msg != "" {
+				add(i, "grpc.message_delay", "%s", msg)
+			}
+			for _, trailer := range g.Trailers {
+				if msg := checkHeader(trailer); msg != "" {
+					add(i, "grpc.trailers", "%s", msg)
+				}
+			}
+			for k, msg := range g.MessagesBase64 {
+				if _, err := base64.StdEncoding.DecodeString(msg); err != nil {
+					add(i, fmt.Sprintf("grpc.messages_base64[%d]", k), "invalid base64 - %v", err)
+				}
+			}
+			// messages are checked against the descriptors when the config names them
+			if protos != nil && len(g.Messages) > 0 && !fake.IsRegex && fake.Path == "" {
+				if m := protos.methods[fake.HyjackPath]; m == nil {
+					add(i, "hyjack", "no method %s in the grpc_descriptor_sets", fake.HyjackPath)
+				} else {
+					for k, msg := range g.Messages {
+						if _, err := protos.encodeJSON(m.output, msg); err != nil {
+							add(i, fmt.Sprintf("grpc.messages[%d]", k), "%v", err)
+						}
+					}
+				}
+			}
+			if fake.WebSocket != nil || fake.Stream != nil {
+				warn(i, "grpc", "is answered instead of the websocket or stream")
+			}
+		}
+
+		responses := append([]*FakeResponse{{
+			ResponseBody:       fake.ResponseBody,
+			ResponseCode:       fake.ResponseCode,
+			ResponseHeaders:    fake.ResponseHeaders,
+			ResponseTimeRaw:    fake.ResponseTimeRaw,
+			ResponseBodyBase64: fake.ResponseBodyBase64,
+			Stream:             fake.Stream,
+		}}, fake.Sequence...)
+		for j, resp := range responses {
+			prefix := ""
+			if j > 0 {
+				prefix = fmt.Sprintf("sequence[%d].", j-1)
+			}
+			if resp == nil {
+				add(i, strings.TrimSuffix(prefix, "."), "empty response")
+				continue
+			}
+			if resp.ResponseCode != 0 && !validStatusCode(resp.ResponseCode) {
+				add(i, prefix+"code", "%d is not a status code (want 100 to 599)", resp.ResponseCode)
+			}
+			if msg := checkDuration(resp.ResponseTimeRaw); msg != "" {
+				add(i, prefix+"time", "%s", msg)
+			}
+			for _, header := range resp.ResponseHeaders {
+				if msg := checkHeader(header); msg != "" {
+					add(i, prefix+"headers", "%s", msg)
+				}
+			}
+			if resp.ResponseBodyBase64 != "" {
+				if _, err := base64.StdEncoding.DecodeString(resp.ResponseBodyBase64); err != nil {
+					add(i, prefix+"body_base64", "invalid base64 - %v", err)
+				}
+			}
+			if stream := resp.Stream; stream != nil {
+				if _, ok := streamFormats[stream.Format]; !ok {
+					add(i, prefix+"stream.format", "%q is not sse, ndjson or raw", stream.Format)
+				}
+				if len(stream.Chunks) == 0 {
+					add(i, prefix+"stream.chunks", "a stream needs chunks")
+				}
+				if stream.DisconnectAfter < 0 {
+					add(i, prefix+"stream.disconnect_after", "%d is negative", stream.DisconnectAfter)
+				}
+				for k, chunk := range stream.Chunks {
+					if chunk == nil {
+						add(i, fmt.Sprintf("%sstream.chunks[%d]", prefix, k), "empty chunk")
+						continue
+					}
+					if msg := checkDuration(chunk.DelayRaw); msg != "" {
+						add(i, fmt.Sprintf("%sstream.chunks[%d].delay", prefix, k), "%s", msg)
+					}
+					if chunk.DataBase64 != "" {
+						if _, err := base64.StdEncoding.DecodeString(chunk.DataBase64); err != nil {
+							add(i, fmt.Sprintf("%sstream.chunks[%d].data_base64", prefix, k), "invalid base64 - %v", err)
+						}
+					}
+				}
+				if resp.ResponseBody != "" || resp.ResponseBodyBase64 != "" {
+					warn(i, prefix+"body", "is not used, the stream is written instead")
+				}
+			}
+			if fake.Template {
+				if _, err := template.New("body").Parse(resp.ResponseBody); err != nil {
+					add(i, prefix+"body", "invalid template - %v", err)
+				}
+				for _, header := range resp.ResponseHeaders {
+					if _, err := template.New("header").Parse(header); err != nil {
+						add(i, prefix+"headers", "invalid template - %v", err)
+					}
+				}
+			}
+		}
+	}
+
+	for i, fake := range fakes {
+		for j := 0; j < i; j++ {
+			if fake != nil && fakes[j] != nil && shadows(fakes[j], fake) {
+				warn(i, "", "never matches, as fakes[%d] matches every request it does", j)
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// unknownFields reports the keys of raw that are not json fields of the struct type t,
+// looking into listeners, fakes, their sequences, streams, websocket conversations and gRPC
+// answers
+func unknownFields(raw map[string]interface{}, t reflect.Type, fake int, prefix string) []configProblem {
+	known := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			known[name] = f.Type
+		}
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []configProblem
+	for _, key := range keys {
+		if _, ok := known[key]; !ok {
+			msg := "unknown field"
+			if suggestion := closestName(key, known); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+			}
+			problems = append(problems, configProblem{fake: fake, field: prefix + key, msg: msg, warning: true})
+		}
+	}
+
+	items := func(key string) []interface{} {
+		list, _ := raw[key].([]interface{})
+		return list
+	}
+	switch t {
+	case reflect.TypeOf(Config{}):
+		for i, item := range items("fakes") {
+			if m, ok := item.(map[string]interface{}); ok {
+				problems = append(problems, unknownFields(m, reflect.TypeOf(Fake{}), i, "")...)
+			}
+		}
+		for i, item := range items("listeners") {
+			if m, ok := item.(map[string]interface{}); ok {
+				problems = append(problems, unknownFields(m, reflect.TypeOf(Listener{}), -1, fmt.Sprintf("listeners[%d].", i))...)
+			}
+		}
+	case reflect.TypeOf(Listener{}):
+		for i, item := range items("fakes") {
+			if m, ok := item.(map[string]interface{}); ok {
+				for _, p := range unknownFields(m, reflect.TypeOf(Fake{}), i, "") {
+					p.listener = prefix
+					problems = append(problems, p)
+				}
+			}
+		}
+	case reflect.TypeOf(Fake{}):
+		for i, item := range items("sequence") {
+			if m, ok := item.(map[string]interface{}); ok {
+				problems = append(problems, unknownFields(m, reflect.TypeOf(FakeResponse{}), fake, fmt.Sprintf("sequence[%d].", i))...)
+			}
+		}
+		if m, ok := raw["websocket"].(map[string]interface{}); ok {
+			problems = append(problems, unknownFields(m, reflect.TypeOf(FakeWebSocket{}), fake, "websocket.")...)
+		}
+		if m, ok := raw["grpc"].(map[string]interface{}); ok {
+			// messages are checked against the descriptors instead
+			problems = append(problems, unknownFields(m, reflect.TypeOf(FakeGRPC{}), fake, "grpc.")...)
+		}
+		fallthrough
+	case reflect.TypeOf(FakeResponse{}):
+		if m, ok := raw["stream"].(map[string]interface{}); ok {
+			problems = append(problems, unknownFields(m, reflect.TypeOf(FakeStream{}), fake, prefix+"stream.")...)
+		}
+	case reflect.TypeOf(FakeWebSocket{}):
+		messages := func(list []interface{}, where string) {
+			for i, item := range list {
+				if m, ok := item.(map[string]interface{}); ok {
+					problems = append(problems, unknownFields(m, reflect.TypeOf(WebSocketMessage{}), fake, fmt.Sprintf("%s%s[%d].", prefix, where, i))...)
+				}
+			}
+		}
+		messages(items("on_connect"), "on_connect")
+		for i, item := range items("replies") {
+			if m, ok := item.(map[string]interface{}); ok {
+				problems = append(problems, unknownFields(m, reflect.TypeOf(WebSocketReply{}), fake, fmt.Sprintf("%sreplies[%d].", prefix, i))...)
+				send, _ := m["send"].([]interface{})
+				messages(send, fmt.Sprintf("replies[%d].send", i))
+			}
+		}
+	case reflect.TypeOf(FakeStream{}):
+		for i, item := range items("chunks") {
+			if m, ok := item.(map[string]interface{}); ok {
+				problems = append(problems, unknownFields(m, reflect.TypeOf(StreamChunk{}), fake, fmt.Sprintf("%schunks[%d].", prefix, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+// closestName returns the known name within two edits of name, if any
+func closestName(name string, known map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for candidate := range known {
+		if d := editDistance(name, candidate); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func checkDuration(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Sprintf("%q is not a duration like 250ms or 1m30s", raw)
+	}
+	if d < 0 {
+		return fmt.Sprintf("%q is negative", raw)
+	}
+	return ""
+}
+
+func validStatusCode(code int) bool {
+	return code >= 100 && code <= 599
+}
+
+// checkHeader checks a header is written as "Name: value", the way serveFake splits it
+func checkHeader(header string) string {
+	name, value, ok := strings.Cut(header, ": ")
+	if !ok || name == "" || value == "" {
+		return fmt.Sprintf("%q is not written as \"Name: value\"", header)
+	}
+	if !validHeaderName(name) {
+		return fmt.Sprintf("%q is not a valid header name", name)
+	}
+	return ""
+}
+
+// validHeaderName reports if name is an HTTP token, as header names and methods are
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// shadows reports if the earlier fake matches every request the later one does, following
+// fakeMatcher.match: a fake with a request_body matches on the body alone, regardless of method
+func shadows(earlier, later *Fake) bool {
+	if earlier.Fallback || later.Fallback {
+		// fallbacks only apply once the upstream failed, see findFallback
+		return false
+	}
+
+	switch {
+	case earlier.HyjackPath == "" && earlier.Path == "":
+	case earlier.UseRequestURI != later.UseRequestURI:
+		return false
+	case earlier.Path != "":
+		if later.Path != "" {
+			if earlier.Path != later.Path {
+				return false
+			}
+			break
+		}
+		p, err := compilePathPattern(earlier.Path)
+		if err != nil || later.IsRegex || later.HyjackPath == "" {
+			return false
+		}
+		if _, ok := p.match(later.HyjackPath); !ok {
+			return false
+		}
+	case later.Path != "":
+		// only the same template is known to match the same requests
+		return false
+	case !earlier.IsRegex && !later.IsRegex:
+		if earlier.HyjackPath != later.HyjackPath {
+			return false
+		}
+	case earlier.IsRegex && !later.IsRegex:
+		re, err := regexp.Compile(earlier.HyjackPath)
+		if err != nil || !re.MatchString(later.HyjackPath) {
+			return false
+		}
+	default:
+		if earlier.HyjackPath != later.HyjackPath || earlier.IsRegex != later.IsRegex {
+			return false
+		}
+	}
+
+	if earlier.RequestBodySubStr != "" {
+		return later.RequestBodySubStr != "" && strings.Contains(later.RequestBodySubStr, earlier.RequestBodySubStr)
+	}
+	if len(earlier.Methods) == 0 {
+		return true
+	}
+	if len(later.Methods) == 0 || later.RequestBodySubStr != "" {
+		return false
+	}
+	for _, method := range later.Methods {
+		found := false
+		for _, m := range earlier.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// runValidate implements `fakettp validate [-config path]... [-overlay path]... [-config_format format] [config...]`,
+// printing the problems found and returning the exit code. The -config files are composed with the
+// overlays as fakettp composes them at startup, and each config given as an argument is checked
+// on its own. Flags are also read from their FAKETTP_* environment variables.
+func runValidate(args []string, environ []string, out io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	var configs, overlays StringSlice
+	fs.Var(&configs, "config", "config file or directory, composed with the others as fakettp does at startup (can be repeated)")
+	fs.Var(&overlays, "overlay", "config file applied after -config, patching or disabling fakes by name (can be repeated)")
+	format := fs.String("config_format", "", "format of the config files: json, yaml or toml (defaults to the file extension, then json)")
+	fs.Usage = func() {
+		fmt.Fprintln(out, "usage: fakettp validate [-config path]... [-overlay path]... [-config_format format] [config...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	// other FAKETTP_* variables are meant for the flags of fakettp itself
+	if _, err := applyEnvFlags(fs, environ); err != nil {
+		fmt.Fprintln(out, err)
+		return 2
+	}
+	if len(configs) == 0 && fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if len(overlays) > 0 && len(configs) == 0 {
+		fmt.Fprintln(out, "-overlay needs -config")
+		return 2
+	}
+
+	type check struct {
+		name            string
+		paths, overlays []string
+	}
+	var checks []check
+	if len(configs) > 0 {
+		checks = append(checks, check{validateArgs(configs, overlays), configs, overlays})
+	}
+	for _, path := range fs.Args() {
+		checks = append(checks, check{path, []string{path}, nil})
+	}
+
+	failed := false
+	for _, c := range checks {
+		problems, err := validateConfigFiles(c.paths, c.overlays, *format)
+		if err != nil {
+			fmt.Fprintf(out, "%s: %v\n", c.name, err)
+			failed = true
+			continue
+		}
+		for _, p := range problems {
+			if p.warning {
+				fmt.Fprintf(out, "%s: warning: %s\n", c.name, p)
+			} else {
+				fmt.Fprintf(out, "%s: %s\n", c.name, p)
+			}
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(out, "%s: %d problems\n", c.name, len(problems))
+			failed = true
+		} else {
+			fmt.Fprintf(out, "%s: ok\n", c.name)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// validateConfigFiles reads, composes and validates config files or directories, with their includes
+// and the overlays. Errors are returned for files that cannot be read or parsed at all.
+func validateConfigFiles(paths, overlays []string, format string) ([]configProblem, error) {
+	data, err := loadConfig(paths, overlays, format)
+	if err != nil {
+		return nil, err
+	}
+	return validateConfig(data), nil
+}
+
+// reportConfigProblems logs the problems in a config at startup, returning an error when
+// any of them are not warnings
+func reportConfigProblems(paths, overlays []string, data []byte) error {
+	path := strings.Join(paths, ", ")
+	errs := 0
+	for _, p := range validateConfig(data) {
+		if p.warning {
+			logger.Warn("config problem", "config", path, "problem", p.String())
+			continue
+		}
+		logger.Error("config problem", "config", path, "problem", p.String())
+		errs++
+	}
+	if errs > 0 {
+		return fmt.Errorf("config %s has %d problems (run fakettp validate %s)", path, errs, validateArgs(paths, overlays))
+	}
+	return nil
+}
+
+// shellSafe matches arguments that need no quoting in a shell
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+// validateArgs gives the arguments of fakettp validate that check the configs composed
+// with the overlays, quoted for a shell
+func validateArgs(configs, overlays []string) string {
+	var args []string
+	add := func(flag string, paths []string) {
+		for _, path := range paths {
+			if !shellSafe.MatchString(path) {
+				path = "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
+			}
+			args = append(args, flag, path)
+		}
+	}
+	add("-config", configs)
+	add("-overlay", overlays)
+	return strings.Join(args, " ")
+}
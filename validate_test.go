@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	t.Log(">> verify the sample configs have no problems")
+	{
+		for _, data := range [][]byte{getSampleConfig(), mustRead(t, "example.conf")} {
+			if problems := validateConfig(data); len(problems) != 0 {
+				t.Errorf("got problems %v, want none", problems)
+			}
+		}
+	}
+
+	t.Log(">> verify every problem is reported with its fake and field")
+	{
+		config := `{
+			"proxy_delay": "soon",
+			"proxy_error_code": 42,
+			"proxy_hots": "localhost",
+			"fakes": [
+				{"hyjack": "/api/(users", "pattern_match": true},
+				{"hyjack": "/a", "code": 1000, "time": "-1s", "headers": ["Content-Type:text/plain", "Bad Name: x"], "metods": ["GET"]},
+				{"hyjack": "/b", "sequence": [{"code": 200}, {"body_base64": "%%%", "tme": "1s"}]},
+				{"hyjack": "/c?x=1", "fallback_status": ["503"]},
+				{"hyjack": "/users", "path": "/users/{id:float}", "template": true, "body": "{{.Params.id"},
+				{"hyjack": "/d", "body": "x", "stream": {"format": "xml", "chunks": [{"dely": "1s", "delay": "later"}]}},
+				{"hyjack": "/ws", "websocket": {"on_connect": [{"close": 99}], "replies": [{"match": "(", "send": [{"txt": "hi"}]}]}},
+				{"hyjack": "/pkg.Svc/Get", "grpc": {"status": "LOST", "message_delay": "1", "trailers": ["x"], "mesages": []}}
+			]
+		}`
+		var got []string
+		for _, p := range validateConfig([]byte(config)) {
+			got = append(got, p.String())
+		}
+		want := []string{
+			"proxy_hots: unknown field (did you mean proxy_host?)",
+			"fakes[1].metods: unknown field (did you mean methods?)",
+			"fakes[2].sequence[1].tme: unknown field (did you mean time?)",
+			"fakes[5].stream.chunks[0].dely: unknown field (did you mean delay?)",
+			"fakes[6].websocket.replies[0].send[0].txt: unknown field (did you mean text?)",
+			"fakes[7].grpc.mesages: unknown field (did you mean messages?)",
+			`proxy_delay: "soon" is not a duration like 250ms or 1m30s`,
+			"proxy_error_code: 42 is not a status code (want 100 to 599)",
+			"fakes[0].hyjack: invalid regular expression - error parsing regexp: missing closing ): `/api/(users`",
+			"fakes[1].code: 1000 is not a status code (want 100 to 599)",
+			`fakes[1].time: "-1s" is negative`,
+			`fakes[1].headers: "Content-Type:text/plain" is not written as "Name: value"`,
+			`fakes[1].headers: "Bad Name" is not a valid header name`,
+			"fakes[2].sequence[1].body_base64: invalid base64 - illegal base64 data at input byte 0",
+			"fakes[3].hyjack: has a query string but request_uri is not set, so it never matches",
+			"fakes[3].fallback_status: has no effect unless fallback is set",
+			"fakes[4].path: set either hyjack or path, not both",
+			`fakes[4].path: invalid path template - param id has unknown type "float" (want int, uuid or alpha)`,
+			"fakes[4].body: invalid template - template: body:1: unclosed action",
+			`fakes[5].stream.format: "xml" is not sse, ndjson or raw`,
+			`fakes[5].stream.chunks[0].delay: "later" is not a duration like 250ms or 1m30s`,
+			"fakes[5].body: is not used, the stream is written instead",
+			"fakes[6].websocket.on_connect[0].close: 99 is not a close code (want 1000 to 4999)",
+			"fakes[6].websocket.replies[0].match: invalid regular expression - error parsing regexp: missing closing ): `(`",
+			`fakes[7].grpc.status: unknown grpc status "LOST" (want a name like NOT_FOUND or a code from 0 to 16)`,
+			`fakes[7].grpc.message_delay: "1" is not a duration like 250ms or 1m30s`,
+			`fakes[7].grpc.trailers: "x" is not written as "Name: value"`,
+		}
+		if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+			t.Errorf("got problems\n%s\nwant\n%s", g, w)
+		}
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	t.Log(">> verify listeners are checked with their fakes")
+	{
+		config := `{
+			"port": 5000,
+			"listeners": [
+				{"name": "billing", "port": 5001, "tls_cert": "cert.pem", "fakes": [{"hyjack": "/a", "metods": ["GET"]}, {"hyjack": "/b", "code": 1000}]},
+				{"name": "billing", "port": 5000},
+				{"port": 5001, "bind": "127.0.0.1", "proxy_hots": "localhost"},
+				{"name": "users"},
+				{"name": "admin", "port": 5002},
+				null
+			]
+		}`
+		var got []string
+		for _, p := range validateConfig([]byte(config)) {
+			got = append(got, p.String())
+		}
+		want := []string{
+			"listeners[0].fakes[0].metods: unknown field (did you mean methods?)",
+			"listeners[2].proxy_hots: unknown field (did you mean proxy_host?)",
+			"listeners[0].tls_cert: tls_cert and tls_key must be given together",
+			"listeners[0].fakes[1].code: 1000 is not a status code (want 100 to 599)",
+			`listeners[1].name: "billing" is already the name of listeners[0]`,
+			"listeners[1].port: 5000 is already the port of port",
+			"listeners[2].name: a listener needs a name",
+			"listeners[3].port: a listener needs a port",
+			"listeners[4].name: the name admin is reserved",
+			"listeners[5]: empty listener",
+		}
+		if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+			t.Errorf("got problems\n%s\nwant\n%s", g, w)
+		}
+	}
+}
+
+func TestShadowedFakes(t *testing.T) {
+	cases := []struct {
+		earlier, later *Fake
+		want           bool
+	}{
+		{&Fake{HyjackPath: "/a"}, &Fake{HyjackPath: "/a", Methods: StringSlice{"GET"}}, true},
+		{&Fake{HyjackPath: "/a", Methods: StringSlice{"GET"}}, &Fake{HyjackPath: "/a"}, false},
+		{&Fake{HyjackPath: "/a", Methods: StringSlice{"get", "POST"}}, &Fake{HyjackPath: "/a", Methods: StringSlice{"GET"}}, true},
+		{&Fake{}, &Fake{HyjackPath: "/anything"}, true},
+		{&Fake{HyjackPath: "^/users/[0-9]+$", IsRegex: true}, &Fake{HyjackPath: "/users/1"}, true},
+		{&Fake{HyjackPath: "^/users/[0-9]+$", IsRegex: true}, &Fake{HyjackPath: "/users/me"}, false},
+		{&Fake{HyjackPath: "/a", RequestBodySubStr: "x"}, &Fake{HyjackPath: "/a", RequestBodySubStr: "xyz"}, true},
+		{&Fake{HyjackPath: "/a", RequestBodySubStr: "x"}, &Fake{HyjackPath: "/a"}, false},
+		{&Fake{HyjackPath: "/a", Methods: StringSlice{"GET"}}, &Fake{HyjackPath: "/a", RequestBodySubStr: "x"}, false},
+		{&Fake{HyjackPath: "/a", Fallback: true}, &Fake{HyjackPath: "/a"}, false},
+		{&Fake{HyjackPath: "/a?x=1", UseRequestURI: true}, &Fake{HyjackPath: "/a?x=1"}, false},
+		{&Fake{Path: "/users/{id:int}"}, &Fake{HyjackPath: "/users/1"}, true},
+		{&Fake{Path: "/users/{id:int}"}, &Fake{Path: "/users/{id:int}", Methods: StringSlice{"GET"}}, true},
+		{&Fake{Path: "/users/{id}"}, &Fake{Path: "/users/{id:int}"}, false},
+		{&Fake{HyjackPath: "/users/1"}, &Fake{Path: "/users/{id:int}"}, false},
+	}
+	for _, c := range cases {
+		if got := shadows(c.earlier, c.later); got != c.want {
+			t.Errorf("%s shadows %s: got %t, want %t", c.earlier, c.later, got, c.want)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create temp dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	good, bad := filepath.Join(dir, "good.yaml"), filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(good, []byte("fakes:\n  - hyjack: /a\n    code: 200\n"), 0644)
+	ioutil.WriteFile(bad, []byte("fakes:\n  - hyjack: /a\n  - hyjack: /a\n    code: 200\n"), 0644)
+
+	t.Log(">> verify valid configs exit 0")
+	{
+		var out bytes.Buffer
+		if got, want := runValidate([]string{good}, nil, &out), 0; got != want {
+			t.Errorf("got exit code %d, want %d\n%s", got, want, out.String())
+		}
+		if got, want := out.String(), good+": ok\n"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify problems are printed and exit non-zero")
+	{
+		var out bytes.Buffer
+		if got, want := runValidate([]string{good, bad}, nil, &out), 1; got != want {
+			t.Errorf("got exit code %d, want %d", got, want)
+		}
+		want := bad + ": warning: fakes[1]: never matches, as fakes[0] matches every request it does\n" + bad + ": 1 problems\n"
+		if got := out.String(); !strings.HasSuffix(got, want) {
+			t.Errorf("got output %q, want it to end with %q", got, want)
+		}
+	}
+
+	t.Log(">> verify -config files are composed with the overlays, as at startup")
+	{
+		catchAll, overlay := filepath.Join(dir, "catchall.yaml"), filepath.Join(dir, "overlay.yaml")
+		ioutil.WriteFile(catchAll, []byte("fakes:\n  - name: all\n    hyjack: /a\n"), 0644)
+		ioutil.WriteFile(overlay, []byte("fakes:\n  - name: all\n    disabled: true\n"), 0644)
+
+		var out bytes.Buffer
+		if got, want := runValidate([]string{"-config", catchAll, "-config", good}, nil, &out), 1; got != want {
+			t.Errorf("got exit code %d, want %d\n%s", got, want, out.String())
+		}
+		if got, want := out.String(), "-config "+catchAll+" -config "+good+": warning: fakes[1]: never matches"; !strings.HasPrefix(got, want) {
+			t.Errorf("got output %q, want it to start with %q", got, want)
+		}
+
+		out.Reset()
+		if got, want := runValidate([]string{"-config", catchAll, "-overlay", overlay, good}, nil, &out), 0; got != want {
+			t.Errorf("got exit code %d, want %d\n%s", got, want, out.String())
+		}
+		if got, want := out.String(), "-config "+catchAll+" -overlay "+overlay+": ok\n"+good+": ok\n"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify flags are read from the environment")
+	{
+		catchAll, overlay := filepath.Join(dir, "catchall.yaml"), filepath.Join(dir, "overlay.yaml")
+		environ := []string{"FAKETTP_CONFIG=" + catchAll + "," + good, "FAKETTP_OVERLAY=" + overlay, "FAKETTP_PORT=5000"}
+		var out bytes.Buffer
+		if got, want := runValidate(nil, environ, &out), 0; got != want {
+			t.Errorf("got exit code %d, want %d\n%s", got, want, out.String())
+		}
+		if got, want := out.String(), "-config "+catchAll+" -config "+good+" -overlay "+overlay+": ok\n"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	}
+
+	t.Log(">> verify shadowing only warns at startup")
+	{
+		if err := reportConfigProblems([]string{bad}, nil, []byte(`{"fakes": [{"hyjack": "/a"}, {"hyjack": "/a"}]}`)); err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		if err := reportConfigProblems([]string{bad}, nil, []byte(`{"fakes": [{"time": "soon"}]}`)); err == nil {
+			t.Error("got no error for a bad duration")
+		}
+	}
+
+	t.Log(">> verify the startup error gives a runnable validate command")
+	{
+		err := reportConfigProblems([]string{"base.yaml", "my fakes/"}, []string{"it's.yaml"}, []byte(`{"fakes": [{"time": "soon"}]}`))
+		want := `config base.yaml, my fakes/ has 1 problems (run fakettp validate -config base.yaml -config 'my fakes/' -overlay 'it'\''s.yaml')`
+		if err == nil || err.Error() != want {
+			t.Errorf("got error %v, want %s", err, want)
+		}
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read %s - %v", path, err)
+	}
+	return data
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// websocketGUID is appended to the client's key to accept a handshake (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// wsDrop is the close code that drops the connection without a close frame. It is reserved
+// for closures seen without one, so it is never sent.
+const wsDrop = 1006
+
+// wsMaxMessage bounds the messages a websocket fake reads, and the frames logged in full
+// when proxying
+const wsMaxMessage = 1 << 20
+
+var wsOpcodeNames = map[byte]string{
+	wsContinuation: "continuation",
+	wsText:         "text",
+	wsBinary:       "binary",
+	wsClose:        "close",
+	wsPing:         "ping",
+	wsPong:         "pong",
+}
+
+// FakeWebSocket makes a fake accept websocket upgrades and play a scripted conversation:
+// it sends its on_connect messages, then answers each message from the client with the
+// first reply matching it
+type FakeWebSocket struct {
+	OnConnect []*WebSocketMessage `json:"on_connect,omitempty"`
+	Replies   []*WebSocketReply   `json:"replies,omitempty"`
+	// Echo sends back the messages no reply matches
+	Echo bool `json:"echo,omitempty"`
+}
+
+// WebSocketReply answers the client's messages matching a regular expression, or every
+// message when match is empty
+type WebSocketReply struct {
+	Match string              `json:"match,omitempty"`
+	Send  []*WebSocketMessage `json:"send"`
+
+	match *regexp.Regexp
+}
+
+// WebSocketMessage is sent after its delay. Setting close sends a close frame with that
+// code and reason and ends the conversation; a close of 1006 drops the connection instead.
+type WebSocketMessage struct {
+	Text         string        `json:"text,omitempty"`
+	BinaryBase64 string        `json:"binary_base64,omitempty"`
+	Close        int           `json:"close,omitempty"`
+	CloseReason  string        `json:"close_reason,omitempty"`
+	DelayRaw     string        `json:"delay,omitempty"`
+	Delay        time.Duration `json:"-"`
+
+	binary []byte
+}
+
+// prepare compiles the replies' patterns and converts the messages' delays and binary data
+func (ws *FakeWebSocket) prepare() error {
+	messages := func(list []*WebSocketMessage, where string) error {
+		for i, msg := range list {
+			if msg == nil {
+				return fmt.Errorf("%s[%d]: empty message", where, i)
+			}
+			if err := msg.prepare(); err != nil {
+				return fmt.Errorf("%s[%d]: %v", where, i, err)
+			}
+		}
+		return nil
+	}
+	if err := messages(ws.OnConnect, "on_connect"); err != nil {
+		return err
+	}
+	for i, reply := range ws.Replies {
+		if reply == nil {
+			return fmt.Errorf("replies[%d]: empty reply", i)
+		}
+		var err error
+		if reply.match, err = regexp.Compile(reply.Match); err != nil {
+			return fmt.Errorf("replies[%d]: invalid match - %v", i, err)
+		}
+		if err := messages(reply.Send, fmt.Sprintf("replies[%d].send", i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msg *WebSocketMessage) prepare() error {
+	if msg.DelayRaw != "" {
+		d, err := time.ParseDuration(msg.DelayRaw)
+		if err != nil {
+			return fmt.Errorf("converting string delay to time duration - %v", err)
+		}
+		msg.Delay = d
+	}
+	if msg.BinaryBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(msg.BinaryBase64)
+		if err != nil {
+			return fmt.Errorf("decoding binary_base64 - %v", err)
+		}
+		msg.binary = data
+	}
+	if msg.Close != 0 && !validCloseCode(msg.Close) {
+		return fmt.Errorf("invalid close code %d (want 1000 to 4999)", msg.Close)
+	}
+	return nil
+}
+
+// validCloseCode reports if a close code can be set on a message
+func validCloseCode(code int) bool {
+	return code >= 1000 && code <= 4999
+}
+
+// isWebSocketUpgrade reports if the request asks to switch to the websocket protocol
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerHasToken reports if a comma separated header lists token, ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for the client's key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// recordSwitch records the 101 answering an upgrade, as it is written to the hijacked
+// connection rather than through the ResponseWriter
+func recordSwitch(w http.ResponseWriter, header http.Header) {
+	if rec, ok := w.(*statusRecorder); ok && rec.status == 0 {
+		rec.status, rec.header = http.StatusSwitchingProtocols, header.Clone()
+	}
+}
+
+// serve accepts the upgrade and plays the conversation, with the fake's headers already
+// set on w. Requests that are not websocket upgrades are answered 426.
+func (ws *FakeWebSocket) serve(w http.ResponseWriter, r *http.Request) {
+	rl := reqLog(r)
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !isWebSocketUpgrade(r) || key == "" {
+		rl.Warn("websocket fake needs a websocket upgrade request")
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		http.Error(w, "fakettp: websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		rl.Error("connection cannot be hijacked for websocket")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", websocketAccept(key))
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		rl.Error("unable to hijack connection for websocket", "error", err)
+		return
+	}
+	defer conn.Close()
+	recordSwitch(w, header)
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		rl.Info("client went away during websocket handshake", "error", err)
+		return
+	}
+	rl.Info("websocket connected")
+
+	c := &wsConn{conn: conn, r: buf.Reader, rl: rl}
+	if !c.sendAll(ws.OnConnect) {
+		return
+	}
+	for {
+		opcode, data, err := c.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				rl.Info("websocket closed", "error", err)
+			}
+			return
+		}
+		reply := ws.reply(data)
+		switch {
+		case reply != nil:
+			if !c.sendAll(reply.Send) {
+				return
+			}
+		case ws.Echo:
+			if c.write(opcode, data) != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply returns the first reply matching the message, nil if none does
+func (ws *FakeWebSocket) reply(data []byte) *WebSocketReply {
+	for _, reply := range ws.Replies {
+		match := reply.match
+		if match == nil {
+			// the fake was not prepared
+			var err error
+			if match, err = regexp.Compile(reply.Match); err != nil {
+				continue
+			}
+		}
+		if match.Match(data) {
+			return reply
+		}
+	}
+	return nil
+}
+
+// wsConn is the server side of a websocket connection
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	rl   *requestLog
+}
+
+// sendAll sends the messages in turn, reporting false once the conversation is over
+func (c *wsConn) sendAll(messages []*WebSocketMessage) bool {
+	for _, msg := range messages {
+		if msg.Delay > 0 {
+			time.Sleep(msg.Delay)
+		}
+		switch {
+		case msg.Close == wsDrop:
+			c.rl.Info("dropping websocket connection")
+			return false
+		case msg.Close != 0:
+			c.close(msg.Close, msg.CloseReason)
+			return false
+		case msg.binary != nil:
+			if c.write(wsBinary, msg.binary) != nil {
+				return false
+			}
+		default:
+			if c.write(wsText, []byte(msg.Text)) != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// close sends a close frame and waits for the client's, briefly
+func (c *wsConn) close(code int, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if c.write(wsClose, payload) != nil {
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := c.readMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	logFrame(c.rl, "fakettp", opcode, payload, len(payload))
+	_, err := c.conn.Write(encodeFrame(opcode, payload))
+	if err != nil {
+		c.rl.Info("websocket closed", "error", err)
+	}
+	return err
+}
+
+// readMessage returns the next text or binary message from the client, answering pings
+// and joining fragments. A close from the client is answered, and returns io.EOF.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		h, payload, err := readFrame(c.r, wsMaxMessage-len(message))
+		if err != nil {
+			return 0, nil, err
+		}
+		logFrame(c.rl, "client", h.opcode, payload, len(payload))
+		switch h.opcode {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.conn.Write(encodeFrame(wsClose, payload))
+			return 0, nil, io.EOF
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, errors.New("continuation frame without a message")
+			}
+		default:
+			opcode = h.opcode
+		}
+		message = append(message, payload...)
+		if h.fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// frameHeader is the start of a websocket frame
+type frameHeader struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+	// size is the length of the header
+	size int
+}
+
+// headerSize returns the length of a frame header from its first two bytes
+func headerSize(b0, b1 byte) int {
+	size := 2
+	switch b1 & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if b1&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+// parseFrameHeader parses the frame header at the start of b, if b holds all of it
+func parseFrameHeader(b []byte) (frameHeader, bool) {
+	if len(b) < 2 {
+		return frameHeader{}, false
+	}
+	h := frameHeader{fin: b[0]&0x80 != 0, opcode: b[0] & 0x0f, masked: b[1]&0x80 != 0, size: headerSize(b[0], b[1])}
+	if len(b) < h.size {
+		return frameHeader{}, false
+	}
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		h.length = uint64(binary.BigEndian.Uint16(b[2:]))
+	case 127:
+		h.length = binary.BigEndian.Uint64(b[2:])
+	default:
+		h.length = uint64(n)
+	}
+	if h.masked {
+		copy(h.mask[:], b[h.size-4:h.size])
+	}
+	return h, true
+}
+
+// readFrame reads a frame, unmasking its payload, which must not be longer than limit
+func readFrame(r io.Reader, limit int) (frameHeader, []byte, error) {
+	head := make([]byte, 14)
+	if _, err := io.ReadFull(r, head[:2]); err != nil {
+		return frameHeader{}, nil, err
+	}
+	size := headerSize(head[0], head[1])
+	if _, err := io.ReadFull(r, head[2:size]); err != nil {
+		return frameHeader{}, nil, err
+	}
+	h, _ := parseFrameHeader(head[:size])
+	if h.length > uint64(limit) {
+		return h, nil, fmt.Errorf("%d byte frame is over the %d byte limit", h.length, limit)
+	}
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, err
+	}
+	if h.masked {
+		unmask(payload, h.mask, 0)
+	}
+	return h, payload, nil
+}
+
+// unmask applies the mask to a payload, starting at offset in the frame's payload
+func unmask(payload []byte, mask [4]byte, offset int) {
+	for i := range payload {
+		payload[i] ^= mask[(offset+i)%4]
+	}
+}
+
+// encodeFrame encodes an unfragmented, unmasked frame, as sent by servers
+func encodeFrame(opcode byte, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	return append(frame, payload...)
+}
+
+// logFrame logs a websocket frame, with the start of its text or its close code. size is
+// the length of the payload, of which payload may only hold the start.
+func logFrame(rl *requestLog, from string, opcode byte, payload []byte, size int) {
+	attrs := []any{"from", from, "type", wsOpcodeNames[opcode], "size", size}
+	switch opcode {
+	case wsText:
+		text := string(payload)
+		if len(text) > 200 {
+			text = text[:200] + "..."
+		}
+		attrs = append(attrs, "text", text)
+	case wsClose:
+		if len(payload) >= 2 {
+			attrs = append(attrs, "code", binary.BigEndian.Uint16(payload), "reason", string(payload[2:]))
+		}
+	}
+	rl.Info("websocket frame", attrs...)
+}
+
+// wsFrameLog parses the frames in one direction of a proxied websocket connection as they
+// go through, and logs them
+type wsFrameLog struct {
+	rl   *requestLog
+	from string
+	buf  []byte
+	// skip is what is left of a frame too large to buffer
+	skip uint64
+}
+
+func (l *wsFrameLog) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if l.skip > 0 {
+			k := uint64(len(p))
+			if k > l.skip {
+				k = l.skip
+			}
+			l.skip -= k
+			p = p[k:]
+			continue
+		}
+		l.buf = append(l.buf, p...)
+		p = nil
+		for {
+			h, ok := parseFrameHeader(l.buf)
+			if !ok {
+				break
+			}
+			if h.length > wsMaxMessage {
+				// log the frame without its payload, and skip the payload as it goes by
+				logFrame(l.rl, l.from, h.opcode, nil, int(h.length))
+				rest := l.buf[h.size:]
+				l.buf = nil
+				l.skip = h.length
+				p = rest
+				break
+			}
+			end := h.size + int(h.length)
+			if len(l.buf) < end {
+				break
+			}
+			payload := append([]byte(nil), l.buf[h.size:end]...)
+			if h.masked {
+				unmask(payload, h.mask, 0)
+			}
+			logFrame(l.rl, l.from, h.opcode, payload, len(payload))
+			l.buf = append(l.buf[:0], l.buf[end:]...)
+		}
+	}
+	return n, nil
+}
+
+// loggedUpgrade is the upstream connection of a proxied websocket, logging the frames
+// read from and written to it
+type loggedUpgrade struct {
+	io.ReadWriteCloser
+	fromUpstream, fromClient *wsFrameLog
+}
+
+func newLoggedUpgrade(conn io.ReadWriteCloser, rl *requestLog) *loggedUpgrade {
+	return &loggedUpgrade{
+		ReadWriteCloser: conn,
+		fromUpstream:    &wsFrameLog{rl: rl, from: "upstream"},
+		fromClient:      &wsFrameLog{rl: rl, from: "client"},
+	}
+}
+
+func (u *loggedUpgrade) Read(p []byte) (int, error) {
+	n, err := u.ReadWriteCloser.Read(p)
+	u.fromUpstream.Write(p[:n])
+	return n, err
+}
+
+func (u *loggedUpgrade) Write(p []byte) (int, error) {
+	u.fromClient.Write(p)
+	return u.ReadWriteCloser.Write(p)
+}
+
+// CloseWrite half closes the upstream connection, when it supports it, once the client is
+// done sending
+func (u *loggedUpgrade) CloseWrite() error {
+	if cw, ok := u.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("upstream connection cannot be half closed")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client side of a websocket connection to the fake server
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialWebSocket opens a websocket to the fake server, returning the handshake response
+func dialWebSocket(t *testing.T, path, id string) (*wsClient, *http.Response) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", currentConfig().Port))
+	if err != nil {
+		t.Fatalf("unable to connect - %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := make([]byte, 16)
+	rand.Read(key)
+	req, _ := http.NewRequest("GET", "http://"+conn.RemoteAddr().String()+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("X-Request-Id", id)
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("unable to send handshake - %v", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("unable to read handshake - %v", err)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), websocketAccept(req.Header.Get("Sec-WebSocket-Key")); resp.StatusCode == http.StatusSwitchingProtocols && got != want {
+		t.Errorf("got accept %q, want %q", got, want)
+	}
+	return &wsClient{conn: conn, r: r}, resp
+}
+
+// send writes a masked text frame, as clients must
+func (c *wsClient) send(t *testing.T, opcode byte, payload []byte) {
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	masked := append([]byte(nil), payload...)
+	unmask(masked, mask, 0)
+	if _, err := c.conn.Write(append(frame, masked...)); err != nil {
+		t.Fatalf("unable to send frame - %v", err)
+	}
+}
+
+// next reads the next frame as "type payload", or the close code and reason
+func (c *wsClient) next(t *testing.T) (string, error) {
+	h, payload, err := readFrame(c.r, wsMaxMessage)
+	if err != nil {
+		return "", err
+	}
+	if h.opcode == wsClose && len(payload) >= 2 {
+		return fmt.Sprintf("close %d %s", binary.BigEndian.Uint16(payload), payload[2:]), nil
+	}
+	return wsOpcodeNames[h.opcode] + " " + string(payload), nil
+}
+
+func TestWebSocketFakes(t *testing.T) {
+	defaultHyjackTestSetup()
+	conversation := &Fake{HyjackPath: "/ws-fake", WebSocket: &FakeWebSocket{
+		OnConnect: []*WebSocketMessage{{Text: "hello"}},
+		Replies: []*WebSocketReply{
+			{Match: "^ping$", Send: []*WebSocketMessage{{Text: "pong", DelayRaw: "20ms"}}},
+			{Match: "^bye$", Send: []*WebSocketMessage{{Close: 4000, CloseReason: "done"}}},
+		},
+	}}
+	drop := &Fake{HyjackPath: "/ws-drop", WebSocket: &FakeWebSocket{
+		OnConnect: []*WebSocketMessage{{BinaryBase64: "AQI="}, {Close: wsDrop}},
+	}}
+	for _, fake := range []*Fake{conversation, drop} {
+		if err := fake.prepare(); err != nil {
+			t.Fatalf("unable to prepare fake - %v", err)
+		}
+	}
+	updateConfig(func(c *Config) {
+		c.Fakes = append(c.Fakes, conversation, drop)
+	})
+
+	t.Log(">> verify websocket fakes play their conversation")
+	{
+		c, resp := dialWebSocket(t, "/ws-fake", "ws-fake")
+		defer c.conn.Close()
+		if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
+			t.Fatalf("got status %d, want %d", got, want)
+		}
+		var got []string
+		read := func() {
+			msg, err := c.next(t)
+			if err != nil {
+				t.Fatalf("unable to read frame - %v", err)
+			}
+			got = append(got, msg)
+		}
+		read()
+		c.send(t, wsText, []byte("ping"))
+		read()
+		c.send(t, wsText, []byte("unmatched"))
+		c.send(t, wsPing, []byte("p"))
+		read()
+		c.send(t, wsText, []byte("bye"))
+		read()
+		c.send(t, wsClose, []byte{0x0f, 0xa0})
+		if got, want := fmt.Sprint(got), "[text hello text pong pong p close 4000 done]"; got != want {
+			t.Errorf("got frames %s, want %s", got, want)
+		}
+		if got, want := harEntryFor(t, "ws-fake").Response.Status, http.StatusSwitchingProtocols; got != want {
+			t.Errorf("got status %d in the HAR, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify websocket fakes can drop the connection")
+	{
+		c, _ := dialWebSocket(t, "/ws-drop", "ws-drop")
+		defer c.conn.Close()
+		if got, err := c.next(t); got != "binary \x01\x02" {
+			t.Errorf("got frame %q (%v), want the binary message", got, err)
+		}
+		if got, err := c.next(t); err != io.EOF {
+			t.Errorf("got frame %q (%v), want the connection dropped", got, err)
+		}
+	}
+
+	t.Log(">> verify websocket fakes answer other requests 426")
+	{
+		resp, _ := doWithHeaders(t, "/ws-fake", nil)
+		if got, want := resp.StatusCode, http.StatusUpgradeRequired; got != want {
+			t.Errorf("got status %d, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify websockets are proxied to the upstream")
+	{
+		c, resp := dialWebSocket(t, "/ws", "ws-proxy")
+		defer c.conn.Close()
+		if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
+			t.Fatalf("got status %d, want %d", got, want)
+		}
+		c.send(t, wsText, []byte("through"))
+		if got, err := c.next(t); got != "text through" {
+			t.Errorf("got frame %q (%v), want the echo", got, err)
+		}
+		c.send(t, wsClose, []byte{0x03, 0xe8})
+		if got, err := c.next(t); got != "close 1000 " {
+			t.Errorf("got frame %q (%v), want the close echoed", got, err)
+		}
+		c.conn.Close()
+		entry := harEntryFor(t, "ws-proxy")
+		if got, want := fmt.Sprintf("%s %d", entry.Decision, entry.Response.Status), "proxy 101"; got != want {
+			t.Errorf("got %s in the HAR, want %s", got, want)
+		}
+	}
+}
+
+func TestWebSocketFrameLog(t *testing.T) {
+	frames := append(encodeFrame(wsText, []byte("one")), encodeFrame(wsBinary, make([]byte, wsMaxMessage+1))...)
+	frames = append(frames, encodeFrame(wsText, []byte("two"))...)
+
+	t.Log(">> verify frames are parsed however the stream is split, skipping large payloads")
+	{
+		var logs bytes.Buffer
+		l := &wsFrameLog{rl: &requestLog{Logger: slog.New(slog.NewTextHandler(&logs, nil))}, from: "upstream"}
+		for len(frames) > 0 {
+			n := 1000
+			if n > len(frames) {
+				n = len(frames)
+			}
+			l.Write(frames[:n])
+			frames = frames[n:]
+		}
+		if got, want := fmt.Sprintf("%d %d", len(l.buf), l.skip), "0 0"; got != want {
+			t.Errorf("got buffered and skipped %s, want %s", got, want)
+		}
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			got = append(got, line[strings.Index(line, "from="):])
+		}
+		want := []string{
+			"from=upstream type=text size=3 text=one",
+			fmt.Sprintf("from=upstream type=binary size=%d", wsMaxMessage+1),
+			"from=upstream type=text size=3 text=two",
+		}
+		if g, w := strings.Join(got, "\n"), strings.Join(want, "\n"); g != w {
+			t.Errorf("got logs\n%s\nwant\n%s", g, w)
+		}
+	}
+}
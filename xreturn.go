@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faults that can be requested with X-Return-Fault
+const (
+	faultReset    = "reset"    // close the connection with a TCP RST
+	faultEmpty    = "empty"    // close the connection without responding
+	faultGarbage  = "garbage"  // respond with bytes that are not HTTP
+	faultTruncate = "truncate" // close the connection part way through the body
+)
+
+// returnOverride is the response requested by a client through X-Return-* headers
+type returnOverride struct {
+	// hyjack replaces the response; modify alters the proxied response instead
+	hyjack bool
+	modify bool
+
+	code    int
+	headers http.Header
+	body    []byte
+	hasBody bool
+	fault   string
+	delay   *delayDistribution
+
+	// times is how many requests to the same method and path this override applies to
+	times int
+}
+
+// defaultReturnHeaderPrefix starts the names of the headers that control fakettp
+const defaultReturnHeaderPrefix = "X-Return-"
+
+// returnHeaderPrefix is the configured header_prefix, or X-Return- when unset
+func (c *Config) returnHeaderPrefix() string {
+	if c.HeaderPrefix == "" {
+		return defaultReturnHeaderPrefix
+	}
+	return http.CanonicalHeaderKey(c.HeaderPrefix)
+}
+
+// allowReturnOverrides reports if the request may override responses with headers. Overrides
+// can be disabled entirely, or require the request to carry the header_token in a
+// <prefix>Token header.
+func allowReturnOverrides(r *http.Request) bool {
+	config := requestConfig(r)
+	if config.DisableHeaderOverrides {
+		return false
+	}
+	if config.HeaderToken == "" {
+		return true
+	}
+	token := r.Header.Get(config.returnHeaderPrefix() + "Token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.HeaderToken)) == 1
+}
+
+// controlHeaders lists the headers meant for fakettp
+func (c *Config) controlHeaders(h http.Header) []string {
+	var names []string
+	prefix := c.returnHeaderPrefix()
+	for name := range h {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// stripControlHeaders removes the headers meant for fakettp so they are not proxied. While
+// header overrides are disabled, fakettp does not read these headers and leaves them alone.
+func (c *Config) stripControlHeaders(h http.Header) {
+	if c.DisableHeaderOverrides {
+		return
+	}
+	for _, name := range c.controlHeaders(h) {
+		h.Del(name)
+	}
+}
+
+// parseReturnOverride reads the X-Return-* headers (or those under the configured
+// header_prefix) from the request. Headers that cannot be read are logged and ignored.
+//
+// When more than one body header is present, X-Return-Body-File wins over
+// X-Return-Body-Base64, which wins over X-Return-Data. Likewise,
+// X-Return-Delay-Distribution wins over X-Return-Delay.
+func parseReturnOverride(r *http.Request) *returnOverride {
+	o := &returnOverride{times: 1}
+	config := requestConfig(r)
+	prefix := config.returnHeaderPrefix()
+	rl := reqLog(r)
+
+	if hdr := r.Header.Get(prefix + "Delay"); hdr != "" {
+		d, err := time.ParseDuration(hdr)
+		if err != nil {
+			rl.Warn("cannot set delay", "error", err)
+		} else {
+			o.delay = &delayDistribution{kind: "fixed", a: d}
+		}
+	}
+	if hdr := r.Header.Get(prefix + "Delay-Distribution"); hdr != "" {
+		dist, err := parseDelayDistribution(hdr)
+		if err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Delay-Distribution", "error", err)
+		} else {
+			o.delay = dist
+		}
+	}
+
+	if hdr := r.Header.Get(prefix + "Headers"); hdr != "" {
+		if err := json.Unmarshal([]byte(hdr), &o.headers); err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Headers", "error", err)
+		} else {
+			o.hyjack = true
+		}
+	}
+	if hdr := r.Header.Get(prefix + "Code"); hdr != "" {
+		code, err := strconv.Atoi(hdr)
+		if err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Code", "error", err)
+		} else {
+			if code == 100 {
+				rl.Info("code 100 hangs the stdlib. Adusting code to 101")
+				code++
+			}
+			o.code = code
+			o.hyjack = true
+		}
+	}
+
+	if hdr := r.Header.Get(prefix + "Data"); hdr != "" {
+		o.body, o.hasBody = []byte(hdr), true
+	}
+	if hdr := r.Header.Get(prefix + "Body-Base64"); hdr != "" {
+		body, err := base64.StdEncoding.DecodeString(hdr)
+		if err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Body-Base64", "error", err)
+		} else {
+			o.body, o.hasBody = body, true
+		}
+	}
+	if hdr := r.Header.Get(prefix + "Body-File"); hdr != "" {
+		body, err := config.readFixture(hdr)
+		if err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Body-File", "error", err)
+		} else {
+			o.body, o.hasBody = body, true
+		}
+	}
+	if o.hasBody {
+		o.hyjack = true
+	}
+
+	if hdr := r.Header.Get(prefix + "Fault"); hdr != "" {
+		switch hdr {
+		case faultReset, faultEmpty, faultGarbage, faultTruncate:
+			o.fault = hdr
+			o.hyjack = true
+		default:
+			rl.Warn("unknown fault", "header", prefix+"Fault", "value", hdr)
+		}
+	}
+
+	if hdr := r.Header.Get(prefix + "Times"); hdr != "" {
+		times, err := strconv.Atoi(hdr)
+		if err != nil || times < 1 {
+			rl.Warn("unable to read header", "header", prefix+"Times", "value", hdr)
+		} else {
+			o.times = times
+		}
+	}
+
+	if hdr := r.Header.Get(prefix + "Proxy-Modify"); hdr != "" {
+		modify, err := strconv.ParseBool(hdr)
+		if err != nil {
+			rl.Warn("unable to read header", "header", prefix+"Proxy-Modify", "error", err)
+		} else if modify && o.fault == "" {
+			// a fault cannot be applied to a proxied response, so it still replaces it
+			o.modify = o.hyjack
+			o.hyjack = false
+		}
+	}
+
+	return o
+}
+
+// active reports if the override changes the response (beyond delaying it)
+func (o *returnOverride) active() bool {
+	return o.hyjack || o.modify
+}
+
+// write sends the override as the response
+func (o *returnOverride) write(w http.ResponseWriter, r *http.Request) {
+	if o.fault != "" {
+		writeFault(w, r, o.fault)
+		return
+	}
+
+	rl := reqLog(r)
+	for name, values := range o.headers {
+		rl.Debug("setting header", "header", name, "value", strings.Join(values, ","))
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	code := o.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	w.Write(o.body)
+}
+
+// modifyResponse applies the override to a proxied response
+func (o *returnOverride) modifyResponse(resp *http.Response) {
+	rl := reqLog(resp.Request)
+	if o.code != 0 {
+		rl.Info("modifying proxied status", "upstream_status", resp.StatusCode, "status", o.code)
+		resp.StatusCode = o.code
+		resp.Status = fmt.Sprintf("%d %s", o.code, http.StatusText(o.code))
+	}
+	for name, values := range o.headers {
+		rl.Debug("modifying proxied header", "header", name, "value", strings.Join(values, ","))
+		resp.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if o.hasBody {
+		rl.Info("modifying proxied body")
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(strings.NewReader(string(o.body)))
+		resp.ContentLength = int64(len(o.body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(o.body)))
+		resp.Header.Del("Content-Encoding")
+	}
+}
+
+// writeFault breaks the response at the connection level
+func writeFault(w http.ResponseWriter, r *http.Request, fault string) {
+	rl := reqLog(r)
+	if r.ProtoMajor == 2 {
+		writeStreamFault(w, r, fault)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		rl.Error("connection cannot be hijacked for fault", "fault", fault)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		rl.Error("unable to hijack connection for fault", "fault", fault, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	rl.Info("injecting fault", "fault", fault)
+	switch fault {
+	case faultReset:
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+	case faultGarbage:
+		writeAndFlush(buf, "\x00\x13\x37 not http \x00\r\n\r\n")
+	case faultTruncate:
+		writeAndFlush(buf, "HTTP/1.1 200 OK\r\nContent-Length: 1024\r\n\r\ntruncated")
+	}
+}
+
+// writeStreamFault injects a fault into an HTTP/2 stream, whose connection cannot be
+// hijacked: the stream is reset, after part of the body for a truncate. HTTP/2 framing
+// leaves no room for an empty or garbage response, so those are resets too.
+func writeStreamFault(w http.ResponseWriter, r *http.Request, fault string) {
+	rl := reqLog(r)
+	rl.Info("injecting fault", "fault", fault, "proto", r.Proto)
+	if fault == faultTruncate {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("truncated"))
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func writeAndFlush(buf *bufio.ReadWriter, data string) {
+	buf.WriteString(data)
+	buf.Flush()
+}
+
+// readFixture reads the named file from the configured fixtures_dir
+func (c *Config) readFixture(name string) ([]byte, error) {
+	if c.FixturesDir == "" {
+		return nil, errors.New("no fixtures_dir configured")
+	}
+	// cleaning the name as an absolute path keeps it inside the fixtures dir
+	return ioutil.ReadFile(filepath.Join(c.FixturesDir, filepath.Clean("/"+name)))
+}
+
+// delayDistribution samples response delays. Supported kinds are fixed (a),
+// uniform (between a and b), normal (mean a, standard deviation b) and
+// exponential (mean a).
+type delayDistribution struct {
+	kind string
+	a, b time.Duration
+}
+
+// parseDelayDistribution reads distributions like `uniform:100ms,500ms`,
+// `normal:200ms,50ms` or `exponential:200ms`
+func parseDelayDistribution(s string) (*delayDistribution, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("want kind:durations, got %q", s)
+	}
+	kind, args := strings.ToLower(strings.TrimSpace(parts[0])), strings.Split(parts[1], ",")
+
+	wantArgs := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "exponential": 1}[kind]
+	if wantArgs == 0 {
+		return nil, fmt.Errorf("unknown distribution %q", kind)
+	}
+	if len(args) != wantArgs {
+		return nil, fmt.Errorf("%s takes %d durations, got %d", kind, wantArgs, len(args))
+	}
+
+	d := &delayDistribution{kind: kind}
+	for i, arg := range args {
+		v, err := time.ParseDuration(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			d.a = v
+		} else {
+			d.b = v
+		}
+	}
+	if kind == "uniform" && d.b < d.a {
+		return nil, fmt.Errorf("uniform upper bound %s is below lower bound %s", d.b, d.a)
+	}
+	return d, nil
+}
+
+// sample returns a delay drawn from the distribution, never below zero
+func (d *delayDistribution) sample() time.Duration {
+	var v float64
+	switch d.kind {
+	case "uniform":
+		v = float64(d.a) + rand.Float64()*float64(d.b-d.a)
+	case "normal":
+		v = float64(d.a) + rand.NormFloat64()*float64(d.b)
+	case "exponential":
+		v = rand.ExpFloat64() * float64(d.a)
+	default:
+		v = float64(d.a)
+	}
+	return time.Duration(math.Max(v, 0))
+}
+
+// overrideStore keeps X-Return-Times overrides for the requests that follow
+type overrideStore struct {
+	sync.Mutex
+	overrides map[string]*returnOverride
+}
+
+var stickyOverrides = &overrideStore{overrides: make(map[string]*returnOverride)}
+
+// overrideKey keys overrides by listener, so an override set through one port is not
+// served on another
+func overrideKey(r *http.Request) string {
+	return requestListener(r) + " " + r.Method + " " + r.URL.Path
+}
+
+// add keeps the override for the remaining times after the current request
+func (s *overrideStore) add(r *http.Request, o *returnOverride) {
+	s.Lock()
+	defer s.Unlock()
+	remaining := *o
+	remaining.times--
+	s.overrides[overrideKey(r)] = &remaining
+}
+
+// take returns a stored override for the request, counting it as used
+func (s *overrideStore) take(r *http.Request) *returnOverride {
+	s.Lock()
+	defer s.Unlock()
+	key := overrideKey(r)
+	o, ok := s.overrides[key]
+	if !ok {
+		return nil
+	}
+	o.times--
+	if o.times <= 0 {
+		delete(s.overrides, key)
+	}
+	taken := *o
+	return &taken
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doWithHeaders performs a GET against fakettp with the given headers set
+func doWithHeaders(t *testing.T, path string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d%s", currentConfig().Port, path), nil)
+	if err != nil {
+		t.Fatalf("unable to set up request - %v", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	cli := http.Client{Timeout: 5 * time.Second}
+	resp, err := cli.Do(req)
+	if err != nil {
+		t.Fatalf("error performing HTTP request - %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestXReturnBodies(t *testing.T) {
+	defaultHyjackTestSetup()
+	dir, err := ioutil.TempDir("", "fakettp")
+	if err != nil {
+		t.Fatalf("unable to create fixtures dir - %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "user.json"), []byte(`{"id":1}`), 0644); err != nil {
+		t.Fatalf("unable to write fixture - %v", err)
+	}
+	updateConfig(func(c *Config) { c.FixturesDir = dir })
+
+	t.Log(">> verify X-Return-Body-Base64 is decoded")
+	{
+		resp, body := doWithHeaders(t, "/foo", map[string]string{"X-Return-Body-Base64": "AAFiaW5hcnk="})
+		if got, want := body, "\x00\x01binary"; got != want {
+			t.Errorf("\ngot body:\n%q\nwant body:\n%q\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+
+	t.Log(">> verify X-Return-Body-File reads from fixtures_dir and wins over X-Return-Data")
+	{
+		_, body := doWithHeaders(t, "/foo", map[string]string{"X-Return-Body-File": "user.json", "X-Return-Data": "data"})
+		if got, want := body, `{"id":1}`; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+	}
+
+	t.Log(">> verify X-Return-Body-File cannot leave fixtures_dir")
+	{
+		_, body := doWithHeaders(t, "/foo", map[string]string{"X-Return-Body-File": "../" + filepath.Base(dir) + "/user.json/../../etc/passwd"})
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+	}
+}
+
+func TestXReturnFault(t *testing.T) {
+	defaultHyjackTestSetup()
+	t.Log(">> verify X-Return-Fault breaks the connection")
+	for _, fault := range []string{faultReset, faultEmpty, faultGarbage, faultTruncate} {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/foo", currentConfig().Port), nil)
+		req.Header.Set("X-Return-Fault", fault)
+		cli := http.Client{Timeout: 5 * time.Second}
+		resp, err := cli.Do(req)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil {
+			t.Errorf("fault %s: got no error, want one", fault)
+		}
+	}
+}
+
+func TestXReturnTimes(t *testing.T) {
+	defaultHyjackTestSetup()
+	t.Log(">> verify X-Return-Times keeps the override for following requests")
+	{
+		resp, _ := doWithHeaders(t, "/times", map[string]string{"X-Return-Code": "503", "X-Return-Times": "2"})
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("first request: got status code %d, want %d", got, want)
+		}
+		resp, _ = doWithHeaders(t, "/times", nil)
+		if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+			t.Errorf("second request: got status code %d, want %d", got, want)
+		}
+		resp, body := doWithHeaders(t, "/times", nil)
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("third request:\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+	}
+}
+
+func TestXReturnProxyModify(t *testing.T) {
+	defaultHyjackTestSetup()
+	t.Log(">> verify X-Return-Proxy-Modify alters the proxied response")
+	{
+		resp, body := doWithHeaders(t, "/foo", map[string]string{
+			"X-Return-Proxy-Modify": "true",
+			"X-Return-Code":         "500",
+			"X-Return-Headers":      `{"X-Custom-Header":["custom value"]}`,
+		})
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+		if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+		if got, want := resp.Header.Get("X-Custom-Header"), "custom value"; got != want {
+			t.Errorf("got value for header X-Custom-Header `%s`, want `%s`", got, want)
+		}
+	}
+}
+
+func TestParseDelayDistribution(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max time.Duration
+		wantErr  bool
+	}{
+		{in: "uniform:100ms,200ms", min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{in: "fixed:50ms", min: 50 * time.Millisecond, max: 50 * time.Millisecond},
+		{in: "exponential:10ms", min: 0, max: time.Hour},
+		{in: "uniform:200ms,100ms", wantErr: true},
+		{in: "normal:100ms", wantErr: true},
+		{in: "pareto:100ms", wantErr: true},
+		{in: "100ms", wantErr: true},
+	}
+	for _, test := range tests {
+		d, err := parseDelayDistribution(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: got no error, want one", test.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error %v", test.in, err)
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			if got := d.sample(); got < test.min || got > test.max {
+				t.Errorf("%s: got sample %s, want between %s and %s", test.in, got, test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestControlHeadersStripped(t *testing.T) {
+	defaultHyjackTestSetup()
+	t.Log(">> verify control headers are not proxied")
+	{
+		_, body := doWithHeaders(t, "/headers", map[string]string{"X-Return-Delay": "1ms", "X-Other": "kept"})
+		if strings.Contains(body, "X-Return-Delay") {
+			t.Errorf("got proxied headers\n%s\nwant no X-Return-Delay", body)
+		}
+		if !strings.Contains(body, "X-Other: kept") {
+			t.Errorf("got proxied headers\n%s\nwant X-Other", body)
+		}
+	}
+}
+
+func TestHeaderPrefixAndToken(t *testing.T) {
+	defaultHyjackTestSetup()
+	updateConfig(func(c *Config) {
+		c.HeaderPrefix = "x-fake-"
+		c.HeaderToken = "secret"
+	})
+
+	t.Log(">> verify the configured prefix replaces X-Return-")
+	{
+		resp, _ := doWithHeaders(t, "/foo", map[string]string{"X-Fake-Code": "418", "X-Fake-Token": "secret"})
+		if got, want := resp.StatusCode, http.StatusTeapot; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+		_, body := doWithHeaders(t, "/foo", map[string]string{"X-Return-Code": "418", "X-Fake-Token": "secret"})
+		if got, want := body, "proxied"; got != want {
+			t.Errorf("\ngot body:\n%s\nwant body:\n%s\n", got, want)
+		}
+	}
+
+	t.Log(">> verify overrides without the token are ignored and stripped")
+	{
+		_, body := doWithHeaders(t, "/headers", map[string]string{"X-Fake-Code": "418", "X-Fake-Token": "wrong"})
+		if strings.Contains(body, "X-Fake-") {
+			t.Errorf("got proxied headers\n%s\nwant no X-Fake-* headers", body)
+		}
+	}
+
+	t.Log(">> verify overrides can be disabled")
+	{
+		updateConfig(func(c *Config) { c.DisableHeaderOverrides = true })
+		resp, _ := doWithHeaders(t, "/foo", map[string]string{"X-Fake-Code": "418", "X-Fake-Token": "secret"})
+		if got, want := resp.StatusCode, http.StatusOK; got != want {
+			t.Errorf("got status code %d, want %d", got, want)
+		}
+	}
+}